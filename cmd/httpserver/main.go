@@ -1,155 +1,65 @@
 package main
 
 import (
-	"crypto/sha256"
+	"flag"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
-	"strings"
 	"syscall"
+	"time"
 
-	"github.com/ohrelaxo/httpfromtcp/internal/headers"
-	"github.com/ohrelaxo/httpfromtcp/internal/request"
-	"github.com/ohrelaxo/httpfromtcp/internal/response"
-	"github.com/ohrelaxo/httpfromtcp/internal/server"
+	"github.com/ohrelaxo/httpfromtcp/internal/config"
+	"github.com/ohrelaxo/httpfromtcp/internal/sse"
 )
 
-const port = 42069
-
 func main() {
-	server, err := server.Serve(port, handler)
+	path := flag.String("config", "httpserver.json", "configuration file")
+	check := flag.Bool("check", false, "validate the configuration and its files, then exit")
+	flag.Parse()
 
+	cfg, err := config.Load(*path)
 	if err != nil {
-		log.Fatalf("Error starting server: %v", err)
-	}
-	defer server.Close()
-	log.Println("Server started on port", port)
-
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
-	log.Println("Server gracefully stopped")
-}
-
-func handler(w *response.Writer, req *request.Request) {
-	if ok := strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin/"); ok {
-		proxyHandler(w, req)
-		return
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-
-	if ok := strings.HasPrefix(req.RequestLine.RequestTarget, "/video"); ok && req.RequestLine.Method == "GET" {
-		videoHandler(w, req)
+	if *check {
+		if err := cfg.Check(); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", *path, err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s is valid\n", *path)
 		return
 	}
-
-	var respMessage string
-	var statusCode int
-	switch req.RequestLine.RequestTarget {
-	case "/yourproblem":
-		respMessage = "<html><head><title>400 Bad Request</title></head><body><h1>Bad Request</h1><p>Your request honestly kinda sucked.</p></body></html>"
-		statusCode = 400
-	case "/myproblem":
-		respMessage = "<html><head><title>500 Internal Server Error</title></head><body><h1>Internal Server Error</h1><p>Okay, you know what? This one is on me.</p></body></html>"
-		statusCode = 500
-	default:
-		respMessage = "<html><head><title>200 OK</title></head><body><h1>Success!</h1><p>Your request was an absolute banger.</p></body></html>"
-		statusCode = 200
-	}
-
-	header := response.GetDefaultHeaders(len(respMessage))
-	header.Set("Content-Type", "text/html")
-	err := w.WriteStatusLine(response.StatusCode(statusCode))
-	if err != nil {
-		log.Println(err)
-	}
-	err = w.WriteHeaders(header)
+	app, err := cfg.Build()
 	if err != nil {
-		log.Println(err)
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *path, err)
+		os.Exit(1)
 	}
-	_, err = w.WriteBody([]byte(respMessage))
-	if err != nil {
-		log.Println(err)
-	}
-}
+	defer app.Close()
 
-func proxyHandler(w *response.Writer, req *request.Request) {
-	target := strings.TrimPrefix(req.RequestLine.RequestTarget, "/httpbin")
-	url := "http://httpbin.org" + target
-	resp, err := http.Get(url)
+	servers, err := app.Listen()
 	if err != nil {
-		log.Println(err)
-		return
-	}
-	defer resp.Body.Close()
-	log.Printf("Proxing to: %v", url)
-
-	w.WriteStatusLine(response.Ok)
-	header := response.GetDefaultHeaders(0)
-	header.Delete("Content-Length")
-	header.Set("Transfer-Encoding", "chunked")
-	header.Set("Trailer", "X-Content-SHA256, X-Content-Length")
-	w.WriteHeaders(header)
-
-	var respBody []byte
-	buff := make([]byte, 1024)
-	for {
-		n, err := resp.Body.Read(buff)
-		log.Printf("Read %d Bytes", n)
-		if n > 0 {
-			_, err = w.WriteChunkedBody(buff[:n])
-			if err != nil {
-				log.Printf("error writing Chunked Body: %v\n", err)
-				break
-			}
-			respBody = append(respBody, buff[:n]...)
-		}
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			log.Printf("error reading response body: %v\n", err)
-			break
-		}
+		app.Close()
+		log.Fatalf("Error starting server: %v", err)
 	}
-	_, err = w.WriteChunkedBodyDone()
-	if err != nil {
-		log.Printf("error writing chunked body done: %v\n", err)
+	for _, s := range servers {
+		log.Println("Server started on", s.Addr())
 	}
-
-	sha := sha256.Sum256(respBody)
-	log.Printf("%x\n", sha)
-
-	bodyLength := len(respBody)
-	log.Println(bodyLength)
-
-	trailers := headers.NewHeaders()
-	trailers.Set("X-Content-SHA256", fmt.Sprintf("%x", sha))
-	trailers.Set("X-Content-Length", strconv.Itoa(bodyLength))
-	err = w.WriteTrailers(trailers)
-	if err != nil {
-		log.Printf("error while writing Trailers: %v", err)
+	// Routes streaming "clock" get the server time every second.
+	if clock := app.Broker("clock"); clock != nil {
+		go func() {
+			for now := range time.Tick(time.Second) {
+				clock.Publish(sse.Event{Type: "time", Data: now.UTC().Format(time.RFC3339)})
+			}
+		}()
 	}
-}
 
-func videoHandler(w *response.Writer, req *request.Request) {
-	data, err := os.ReadFile("assets/vim.mp4") //file ext.?
-	if err != nil {
-		log.Printf("failed to read file: %v", err)
-		w.WriteStatusLine(response.InternalServerError)
-		return
-	}
-	w.WriteStatusLine(response.Ok)
-	header := response.GetDefaultHeaders(len(data))
-	header.Set("Content-Type", "video/mp4")
-	w.WriteHeaders(header)
-	_, err = w.WriteBody(data)
-	if err != nil {
-		log.Printf("failed to write body: %v", err)
-		w.WriteStatusLine(response.InternalServerError)
-		return
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	<-sigChan
+	for _, s := range servers {
+		s.Close()
 	}
+	log.Println("Server gracefully stopped")
 }
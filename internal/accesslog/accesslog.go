@@ -0,0 +1,181 @@
+package accesslog
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/request"
+	"github.com/ohrelaxo/httpfromtcp/internal/response"
+	"github.com/ohrelaxo/httpfromtcp/internal/server"
+)
+
+// Keys of the attributes every access log record carries.
+const (
+	KeyRemoteAddr = "remote_addr"
+	KeyMethod     = "method"
+	KeyTarget     = "target"
+	KeyProto      = "proto"
+	KeyStatus     = "status"
+	KeyBytes      = "bytes"
+	KeyDuration   = "duration"
+	KeyReferer    = "referer"
+	KeyUserAgent  = "user_agent"
+)
+
+// Format selects how NewHandler writes records.
+type Format int
+
+const (
+	// Common is the Apache Common Log Format.
+	Common Format = iota
+	// Combined is Common followed by the referer and user agent.
+	Combined
+	// JSON writes one JSON object per line.
+	JSON
+)
+
+// ParseFormat returns the Format called name: common, combined or json.
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "common":
+		return Common, nil
+	case "combined":
+		return Combined, nil
+	case "json":
+		return JSON, nil
+	default:
+		return 0, fmt.Errorf("unknown access log format %q", name)
+	}
+}
+
+// Middleware logs every request to logger once its response is complete.
+func Middleware(logger *slog.Logger) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			start := time.Now()
+			w.AfterClose(func() {
+				logger.LogAttrs(req.Context(), slog.LevelInfo, "request",
+					slog.String(KeyRemoteAddr, req.RemoteAddr),
+					slog.String(KeyMethod, req.RequestLine.Method),
+					slog.String(KeyTarget, req.RequestLine.RequestTarget),
+					slog.String(KeyProto, "HTTP/"+req.RequestLine.HttpVersion),
+					slog.Int(KeyStatus, int(w.Status())),
+					slog.Int64(KeyBytes, w.BodyBytes()),
+					slog.Duration(KeyDuration, time.Since(start)),
+					slog.String(KeyReferer, req.Headers.Get("Referer")),
+					slog.String(KeyUserAgent, req.Headers.Get("User-Agent")),
+				)
+			})
+			next(w, req)
+		}
+	}
+}
+
+// NewHandler returns a slog.Handler that writes the records of Middleware
+// to out in format.
+func NewHandler(out io.Writer, format Format) slog.Handler {
+	if format == JSON {
+		return slog.NewJSONHandler(out, nil)
+	}
+	return &lineHandler{out: out, combined: format == Combined, mu: &sync.Mutex{}}
+}
+
+// lineHandler writes the Apache formats, other attributes are ignored.
+type lineHandler struct {
+	out      io.Writer
+	combined bool
+	mu       *sync.Mutex
+}
+
+func (h *lineHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (h *lineHandler) WithAttrs([]slog.Attr) slog.Handler {
+	return h
+}
+
+func (h *lineHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+func (h *lineHandler) Handle(_ context.Context, r slog.Record) error {
+	var remote, method, target, proto, referer, userAgent string
+	var status, bytes int64
+	r.Attrs(func(a slog.Attr) bool {
+		switch a.Key {
+		case KeyRemoteAddr:
+			remote = a.Value.String()
+		case KeyMethod:
+			method = a.Value.String()
+		case KeyTarget:
+			target = a.Value.String()
+		case KeyProto:
+			proto = a.Value.String()
+		case KeyStatus:
+			status = a.Value.Int64()
+		case KeyBytes:
+			bytes = a.Value.Int64()
+		case KeyReferer:
+			referer = a.Value.String()
+		case KeyUserAgent:
+			userAgent = a.Value.String()
+		}
+		return true
+	})
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	size := "-"
+	if bytes > 0 {
+		size = strconv.FormatInt(bytes, 10)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s - - [%s] \"%s %s %s\" %d %s",
+		field(remote), r.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		escape(method), escape(target), escape(proto), status, size)
+	if h.combined {
+		fmt.Fprintf(&b, " \"%s\" \"%s\"", field(escape(referer)), field(escape(userAgent)))
+	}
+	b.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.out, b.String())
+	return err
+}
+
+// field returns "-" for values the client did not send.
+func field(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// escape keeps client controlled values on one line and inside their
+// quotes the way Apache does.
+func escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,124 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"testing"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/request"
+	"github.com/ohrelaxo/httpfromtcp/internal/response"
+	"github.com/ohrelaxo/httpfromtcp/internal/server"
+	"github.com/ohrelaxo/httpfromtcp/internal/servertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// syncBuffer is written by the server goroutine and read by the test.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// logRequest sends raw to a server that logs in format and returns the log.
+func logRequest(t *testing.T, format Format, handler server.Handler, raw string) string {
+	t.Helper()
+	out := &syncBuffer{}
+	s, err := server.Serve(0, handler, server.WithMiddleware(Middleware(slog.New(NewHandler(out, format)))))
+	require.NoError(t, err)
+	defer s.Close()
+	_, port, err := net.SplitHostPort(s.Addr().String())
+	require.NoError(t, err)
+	servertest.RoundTrip(t, net.JoinHostPort("127.0.0.1", port), raw)
+	return out.String()
+}
+
+func hello(w *response.Writer, req *request.Request) {
+	w.Write([]byte("hello"))
+}
+
+func TestMiddleware(t *testing.T) {
+	raw := "GET /a?b=1 HTTP/1.1\r\nHost: localhost\r\nReferer: http://example.com/\r\nUser-Agent: test \"agent\"\r\n\r\n"
+
+	// Test: Common Log Format
+	line := logRequest(t, Common, hello, raw)
+	assert.Regexp(t, regexp.MustCompile(`^127\.0\.0\.1 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [-+]\d{4}\] "GET /a\?b=1 HTTP/1\.1" 200 5\n$`), line)
+
+	// Test: Combined adds the escaped referer and user agent
+	line = logRequest(t, Combined, hello, raw)
+	assert.Regexp(t, regexp.MustCompile(`" 200 5 "http://example.com/" "test \\"agent\\""\n$`), line)
+
+	// Test: A handler that writes nothing is logged with the 500 it gets
+	line = logRequest(t, Combined, func(w *response.Writer, req *request.Request) {}, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Regexp(t, regexp.MustCompile(`"GET / HTTP/1\.1" 500 - "-" "-"\n$`), line)
+
+	// Test: JSON lines carry every attribute
+	line = logRequest(t, JSON, hello, raw)
+	var record map[string]any
+	require.NoError(t, json.Unmarshal([]byte(line), &record))
+	assert.Equal(t, "request", record["msg"])
+	assert.Equal(t, "GET", record[KeyMethod])
+	assert.Equal(t, "/a?b=1", record[KeyTarget])
+	assert.Equal(t, "HTTP/1.1", record[KeyProto])
+	assert.Equal(t, float64(200), record[KeyStatus])
+	assert.Equal(t, float64(5), record[KeyBytes])
+	assert.Equal(t, "test \"agent\"", record[KeyUserAgent])
+	assert.Contains(t, record[KeyRemoteAddr], "127.0.0.1:")
+	assert.Contains(t, record, KeyDuration)
+
+	// Test: HEAD logs no body bytes
+	line = logRequest(t, Common, hello, "HEAD / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Regexp(t, regexp.MustCompile(`" 200 -\n$`), line)
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := OpenRotatingFile(path, 10, 2)
+	require.NoError(t, err)
+
+	// Test: Writes that do not fit move the file to numbered backups
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err := io.WriteString(f, line)
+		require.NoError(t, err)
+	}
+	require.NoError(t, f.Close())
+	for name, want := range map[string]string{path: "fourth\n", path + ".1": "third\n", path + ".2": "second\n"} {
+		data, err := os.ReadFile(name)
+		require.NoError(t, err)
+		assert.Equal(t, want, string(data), name)
+	}
+	_, err = os.Stat(path + ".3")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// Test: Reopening appends to the existing file
+	f, err = OpenRotatingFile(path, 10, 2)
+	require.NoError(t, err)
+	_, err = io.WriteString(f, "x\n")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "fourth\nx\n", string(data))
+
+	// Test: Writing after Close fails
+	_, err = f.Write([]byte("late"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/request"
+	"github.com/ohrelaxo/httpfromtcp/internal/response"
+)
+
+type userKey struct{}
+
+// User returns the user the middleware authenticated for req.
+func User(req *request.Request) (string, bool) {
+	user, ok := req.Context().Value(userKey{}).(string)
+	return user, ok
+}
+
+func withUser(req *request.Request, user string) *request.Request {
+	return req.WithContext(context.WithValue(req.Context(), userKey{}, user))
+}
+
+// ParseAuthorization splits the Authorization header of req into the scheme,
+// lowercased, and the credentials.
+func ParseAuthorization(req *request.Request) (scheme, credentials string, ok bool) {
+	value := req.Headers.Get("Authorization")
+	scheme, credentials, _ = strings.Cut(value, " ")
+	if scheme == "" {
+		return "", "", false
+	}
+	return strings.ToLower(scheme), strings.TrimLeft(credentials, " "), true
+}
+
+// ParseBasic returns the user and password of Basic credentials.
+func ParseBasic(req *request.Request) (user, password string, ok bool) {
+	scheme, credentials, ok := ParseAuthorization(req)
+	if !ok || scheme != "basic" {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+// ParseBearer returns the token of Bearer credentials.
+func ParseBearer(req *request.Request) (string, bool) {
+	scheme, credentials, ok := ParseAuthorization(req)
+	if !ok || scheme != "bearer" || credentials == "" {
+		return "", false
+	}
+	return credentials, true
+}
+
+// challenge rejects the request and tells the client how to authenticate.
+func challenge(w *response.Writer, code response.StatusCode, scheme string, params ...string) {
+	value := scheme
+	for i := 0; i+1 < len(params); i += 2 {
+		sep := " "
+		if i > 0 {
+			sep = ", "
+		}
+		value += sep + params[i] + "=" + quote(params[i+1])
+	}
+	w.Header().Set("WWW-Authenticate", value)
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(code)
+}
+
+// quote returns s as a quoted-string.
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,210 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/request"
+	"github.com/ohrelaxo/httpfromtcp/internal/response"
+	"github.com/ohrelaxo/httpfromtcp/internal/server"
+	"github.com/ohrelaxo/httpfromtcp/internal/servertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// whoami answers with the authenticated user.
+func whoami(w *response.Writer, req *request.Request) {
+	user, _ := User(req)
+	w.Write([]byte(user))
+}
+
+func get(t *testing.T, mw server.Middleware, authorization string) string {
+	t.Helper()
+	raw := "GET / HTTP/1.1\r\nHost: localhost\r\n"
+	if authorization != "" {
+		raw += "Authorization: " + authorization + "\r\n"
+	}
+	return servertest.Send(t, whoami, raw+"\r\n", server.WithMiddleware(mw))
+}
+
+func basic(user, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
+
+func TestShaCrypt(t *testing.T) {
+	// Test: Vectors from the specification and openssl passwd
+	for _, want := range []string{
+		"$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5",
+		"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+		"$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA",
+		"$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.",
+	} {
+		got, ok := shaCrypt("Hello world!", want)
+		require.True(t, ok)
+		assert.Equal(t, want, got)
+	}
+
+	// Test: Rounds below the minimum are raised to it
+	got, _ := shaCrypt("Hello world!", "$5$rounds=100$short$")
+	assert.Equal(t, "$5$rounds=1000$short$Zn1jA7vGSJxSOcxz82BehM5YBK0V0FxI3Muhq4iKhwC", got)
+}
+
+func TestBasic(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	file := "# users\n" +
+		"ada:" + string(bcryptHash) + "\n" +
+		"\n" +
+		"bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n" +
+		"eve:$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5\n"
+	users, err := ParseHtpasswd(strings.NewReader(file))
+	require.NoError(t, err)
+
+	// Test: Every hash variant verifies
+	assert.True(t, users.Verify("ada", "secret"))
+	assert.True(t, users.Verify("bob", "password"))
+	assert.True(t, users.Verify("eve", "Hello world!"))
+	assert.False(t, users.Verify("ada", "password"))
+	assert.False(t, users.Verify("eve", "Hello world"))
+	assert.False(t, users.Verify("nobody", ""))
+
+	// Test: Unknown users are checked against a stand-in hash, which never
+	// lets them in, even with the password it was made from
+	assert.Equal(t, string(bcryptHash), users.dummy)
+	assert.False(t, users.Verify("nobody", "secret"))
+
+	// Test: Unsupported hashes are rejected when loading
+	_, err = ParseHtpasswd(strings.NewReader("mallory:$apr1$abc$def\n"))
+	require.ErrorIs(t, err, ErrUnsupportedHash)
+
+	// Test: The middleware challenges and passes the user on
+	mw := Basic(`tools "internal"`, users.Verify)
+	resp := get(t, mw, "")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 401 Unauthorized\r\n"), resp)
+	assert.Contains(t, resp, "www-authenticate: Basic realm=\"tools \\\"internal\\\"\", charset=\"UTF-8\"\r\n")
+	resp = get(t, mw, basic("bob", "wrong"))
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 401 Unauthorized\r\n"), resp)
+	resp = get(t, mw, basic("bob", "password"))
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\nbob"), resp)
+	resp = get(t, mw, "basic "+strings.TrimPrefix(basic("ada", "secret"), "Basic "))
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\nada"), resp)
+}
+
+func sign(t *testing.T, alg string, key any, claims map[string]any) string {
+	t.Helper()
+	header, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	require.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		require.NoError(t, err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTVerifier(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	exp := time.Now().Add(time.Hour).Unix()
+	hs := NewHS256Verifier(secret, JWTOptions{Issuer: "auth.example", Audience: "tools"})
+
+	// Test: HS256 with a string or array audience
+	claims, err := hs.Verify(sign(t, "HS256", secret, map[string]any{"sub": "ada", "iss": "auth.example", "aud": "tools", "exp": exp}))
+	require.NoError(t, err)
+	assert.Equal(t, "ada", claims.Subject)
+	assert.Equal(t, exp, claims.ExpiresAt.Unix())
+	_, err = hs.Verify(sign(t, "HS256", secret, map[string]any{"sub": "ada", "iss": "auth.example", "aud": []string{"x", "tools"}, "exp": exp}))
+	require.NoError(t, err)
+
+	// Test: Claims that do not match
+	for name, c := range map[string]map[string]any{
+		"issuer":   {"iss": "evil", "aud": "tools", "exp": exp},
+		"audience": {"iss": "auth.example", "aud": "other", "exp": exp},
+		"no exp":   {"iss": "auth.example", "aud": "tools"},
+		"nbf":      {"iss": "auth.example", "aud": "tools", "exp": exp, "nbf": exp},
+	} {
+		_, err := hs.Verify(sign(t, "HS256", secret, c))
+		require.ErrorIs(t, err, ErrInvalidToken, name)
+	}
+	_, err = hs.Verify(sign(t, "HS256", secret, map[string]any{"iss": "auth.example", "aud": "tools", "exp": time.Now().Add(-time.Minute).Unix()}))
+	require.ErrorIs(t, err, ErrTokenExpired)
+
+	// Test: Wrong key, alg none and a tampered payload
+	valid := map[string]any{"iss": "auth.example", "aud": "tools", "exp": exp}
+	_, err = hs.Verify(sign(t, "HS256", []byte("another key"), valid))
+	require.ErrorIs(t, err, ErrInvalidToken)
+	none := sign(t, "none", nil, valid)
+	_, err = hs.Verify(none)
+	require.ErrorIs(t, err, ErrInvalidToken)
+	parts := strings.Split(sign(t, "HS256", secret, valid), ".")
+	parts[1] = base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"auth.example","aud":"tools","exp":9999999999,"sub":"root"}`))
+	_, err = hs.Verify(strings.Join(parts, "."))
+	require.ErrorIs(t, err, ErrInvalidToken)
+
+	// Test: RS256 with a PEM key, an HS256 token signed with the public key is rejected
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	public, err := ParseRSAPublicKey(pemKey)
+	require.NoError(t, err)
+	rs := NewRS256Verifier(public, JWTOptions{})
+	user, err := rs.VerifyToken(sign(t, "RS256", key, map[string]any{"sub": "bob", "exp": exp}))
+	require.NoError(t, err)
+	assert.Equal(t, "bob", user)
+	_, err = rs.Verify(sign(t, "HS256", pemKey, map[string]any{"sub": "bob", "exp": exp}))
+	require.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestBearer(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	mw := Bearer("api", NewHS256Verifier(secret, JWTOptions{}))
+
+	// Test: No credentials get a plain challenge
+	resp := get(t, mw, "")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 401 Unauthorized\r\n"), resp)
+	assert.Contains(t, resp, "www-authenticate: Bearer realm=\"api\"\r\n")
+
+	// Test: An empty token is a malformed request
+	resp = get(t, mw, "Bearer ")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 400 Bad Request\r\n"), resp)
+	assert.Contains(t, resp, "error=\"invalid_request\"")
+
+	// Test: Expired and valid tokens
+	expired := sign(t, "HS256", secret, map[string]any{"sub": "ada", "exp": time.Now().Add(-time.Hour).Unix()})
+	resp = get(t, mw, "Bearer "+expired)
+	assert.Contains(t, resp, "www-authenticate: Bearer realm=\"api\", error=\"invalid_token\", error_description=\"the token expired\"\r\n")
+	valid := sign(t, "HS256", secret, map[string]any{"sub": "ada", "exp": time.Now().Add(time.Hour).Unix()})
+	resp = get(t, mw, "Bearer "+valid)
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\nada"), resp)
+
+	// Test: Any verifier can be plugged in
+	mw = Bearer("api", TokenVerifierFunc(func(token string) (string, error) {
+		if token != "letmein" {
+			return "", ErrInvalidToken
+		}
+		return "robot", nil
+	}))
+	resp = get(t, mw, "Bearer letmein")
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\nrobot"), resp)
+}
@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1" // #nosec G505 -- {SHA} htpasswd entries are SHA-1 by definition
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/request"
+	"github.com/ohrelaxo/httpfromtcp/internal/response"
+	"github.com/ohrelaxo/httpfromtcp/internal/server"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrUnsupportedHash = errors.New("unsupported password hash")
+
+// Htpasswd holds the users of an htpasswd file. Passwords may be hashed
+// with bcrypt ($2a$, $2b$, $2y$), SHA-256 or SHA-512 crypt ($5$, $6$) or
+// SHA-1 ({SHA}).
+type Htpasswd struct {
+	users map[string]string
+	// dummy is checked in place of a missing user's hash, so looking up an
+	// unknown user costs as much as a wrong password.
+	dummy string
+}
+
+// LoadHtpasswd reads the htpasswd file at path.
+func LoadHtpasswd(path string) (*Htpasswd, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseHtpasswd(file)
+}
+
+// ParseHtpasswd reads "user:hash" lines, blank lines and lines starting
+// with # are skipped.
+func ParseHtpasswd(r io.Reader) (*Htpasswd, error) {
+	h := &Htpasswd{users: map[string]string{}}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hashed, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("htpasswd line %d: missing user", n)
+		}
+		if !supportedHash(hashed) {
+			return nil, fmt.Errorf("htpasswd line %d: %w", n, ErrUnsupportedHash)
+		}
+		h.users[user] = hashed
+		if h.dummy == "" {
+			h.dummy = hashed
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func supportedHash(hashed string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$", "$5$", "$6$", "{SHA}"} {
+		if strings.HasPrefix(hashed, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify reports whether password is the password of user.
+func (h *Htpasswd) Verify(user, password string) bool {
+	hashed, ok := h.users[user]
+	if !ok {
+		hashed = h.dummy
+	}
+	return checkPassword(hashed, password) && ok
+}
+
+func checkPassword(hashed, password string) bool {
+	switch {
+	case strings.HasPrefix(hashed, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password)) == nil
+	case strings.HasPrefix(hashed, "{SHA}"):
+		sum := sha1.Sum([]byte(password)) // #nosec G401 -- see the import
+		return equal(hashed, "{SHA}"+base64.StdEncoding.EncodeToString(sum[:]))
+	default:
+		computed, ok := shaCrypt(password, hashed)
+		return ok && equal(hashed, computed)
+	}
+}
+
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// Basic asks for Basic credentials and lets requests through whose user and
+// password verify. The user is available to the handler through User.
+func Basic(realm string, verify func(user, password string) bool) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			user, password, ok := ParseBasic(req)
+			if !ok || !verify(user, password) {
+				challenge(w, response.Unauthorized, "Basic", "realm", realm, "charset", "UTF-8")
+				return
+			}
+			next(w, withUser(req, user))
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"errors"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/request"
+	"github.com/ohrelaxo/httpfromtcp/internal/response"
+	"github.com/ohrelaxo/httpfromtcp/internal/server"
+)
+
+// TokenVerifier checks a bearer token and returns the user it belongs to.
+type TokenVerifier interface {
+	VerifyToken(token string) (user string, err error)
+}
+
+// TokenVerifierFunc adapts a function to a TokenVerifier.
+type TokenVerifierFunc func(token string) (string, error)
+
+func (f TokenVerifierFunc) VerifyToken(token string) (string, error) {
+	return f(token)
+}
+
+// Bearer asks for a bearer token as described in RFC 6750 and lets requests
+// through whose token verifies. The user is available through User.
+func Bearer(realm string, verifier TokenVerifier) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			scheme, _, present := ParseAuthorization(req)
+			token, ok := ParseBearer(req)
+			switch {
+			case !present || scheme != "bearer":
+				challenge(w, response.Unauthorized, "Bearer", "realm", realm)
+				return
+			case !ok:
+				challenge(w, response.BadRequest, "Bearer", "realm", realm, "error", "invalid_request")
+				return
+			}
+			user, err := verifier.VerifyToken(token)
+			if err != nil {
+				description := "the token is invalid"
+				if errors.Is(err, ErrTokenExpired) {
+					description = "the token expired"
+				}
+				challenge(w, response.Unauthorized, "Bearer", "realm", realm, "error", "invalid_token", "error_description", description)
+				return
+			}
+			next(w, withUser(req, user))
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTokenExpired = errors.New("token expired")
+)
+
+// Claims are the registered claims of a JWT.
+type Claims struct {
+	Subject   string
+	Issuer    string
+	Audience  []string
+	ExpiresAt time.Time
+	NotBefore time.Time
+	IssuedAt  time.Time
+}
+
+// JWTOptions are checked against the claims of every token.
+type JWTOptions struct {
+	// Issuer and Audience must match the iss and aud claims if set.
+	Issuer   string
+	Audience string
+	// Leeway allows for clock skew when checking exp and nbf.
+	Leeway time.Duration
+}
+
+// JWTVerifier verifies compact JWS tokens signed with one algorithm. Tokens
+// must carry an exp claim.
+type JWTVerifier struct {
+	alg    string
+	secret []byte
+	key    *rsa.PublicKey
+	opts   JWTOptions
+	now    func() time.Time
+}
+
+func NewHS256Verifier(secret []byte, opts JWTOptions) *JWTVerifier {
+	return &JWTVerifier{alg: "HS256", secret: secret, opts: opts, now: time.Now}
+}
+
+func NewRS256Verifier(key *rsa.PublicKey, opts JWTOptions) *JWTVerifier {
+	return &JWTVerifier{alg: "RS256", key: key, opts: opts, now: time.Now}
+}
+
+// ParseRSAPublicKey reads a PEM encoded PKIX or PKCS #1 RSA public key.
+func ParseRSAPublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%T is not an RSA public key", parsed)
+	}
+	return key, nil
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+}
+
+type jwtClaims struct {
+	Sub string          `json:"sub"`
+	Iss string          `json:"iss"`
+	Aud json.RawMessage `json:"aud"`
+	Exp *float64        `json:"exp"`
+	Nbf *float64        `json:"nbf"`
+	Iat *float64        `json:"iat"`
+}
+
+// Verify checks the signature and the claims of token.
+func (v *JWTVerifier) Verify(token string) (*Claims, error) {
+	header, rest, ok := strings.Cut(token, ".")
+	payload, signature, ok2 := strings.Cut(rest, ".")
+	if !ok || !ok2 {
+		return nil, fmt.Errorf("%w: not a compact JWS", ErrInvalidToken)
+	}
+	var h jwtHeader
+	if err := decodeSegment(header, &h); err != nil {
+		return nil, err
+	}
+	// The algorithm is fixed by the verifier, never chosen by the token.
+	if h.Alg != v.alg {
+		return nil, fmt.Errorf("%w: algorithm %q", ErrInvalidToken, h.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature encoding", ErrInvalidToken)
+	}
+	if !v.verifySignature(token[:len(header)+1+len(payload)], sig) {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+	}
+
+	var c jwtClaims
+	if err := decodeSegment(payload, &c); err != nil {
+		return nil, err
+	}
+	claims := &Claims{Subject: c.Sub, Issuer: c.Iss}
+	if len(c.Aud) > 0 {
+		var aud string
+		if json.Unmarshal(c.Aud, &aud) == nil {
+			claims.Audience = []string{aud}
+		} else if err := json.Unmarshal(c.Aud, &claims.Audience); err != nil {
+			return nil, fmt.Errorf("%w: aud claim", ErrInvalidToken)
+		}
+	}
+	if c.Exp == nil {
+		return nil, fmt.Errorf("%w: missing exp claim", ErrInvalidToken)
+	}
+	claims.ExpiresAt = numericDate(c.Exp)
+	claims.NotBefore = numericDate(c.Nbf)
+	claims.IssuedAt = numericDate(c.Iat)
+
+	now := v.now()
+	if !now.Before(claims.ExpiresAt.Add(v.opts.Leeway)) {
+		return nil, ErrTokenExpired
+	}
+	if c.Nbf != nil && now.Add(v.opts.Leeway).Before(claims.NotBefore) {
+		return nil, fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+	}
+	if v.opts.Issuer != "" && claims.Issuer != v.opts.Issuer {
+		return nil, fmt.Errorf("%w: issuer %q", ErrInvalidToken, claims.Issuer)
+	}
+	if v.opts.Audience != "" && !slices.Contains(claims.Audience, v.opts.Audience) {
+		return nil, fmt.Errorf("%w: audience", ErrInvalidToken)
+	}
+	return claims, nil
+}
+
+// VerifyToken implements TokenVerifier, the user is the sub claim.
+func (v *JWTVerifier) VerifyToken(token string) (string, error) {
+	claims, err := v.Verify(token)
+	if err != nil {
+		return "", err
+	}
+	return claims.Subject, nil
+}
+
+func (v *JWTVerifier) verifySignature(signed string, sig []byte) bool {
+	switch v.alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write([]byte(signed))
+		return hmac.Equal(sig, mac.Sum(nil))
+	case "RS256":
+		digest := sha256.Sum256([]byte(signed))
+		return rsa.VerifyPKCS1v15(v.key, crypto.SHA256, digest[:], sig) == nil
+	}
+	return false
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("%w: segment encoding", ErrInvalidToken)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	return nil
+}
+
+// numericDate converts a JWT NumericDate, seconds since the epoch.
+func numericDate(seconds *float64) time.Time {
+	if seconds == nil {
+		return time.Time{}
+	}
+	// Clamp to what time.Time can hold so absurd values cannot overflow.
+	sec, frac := math.Modf(math.Max(math.Min(*seconds, 1<<53), -(1 << 53)))
+	return time.Unix(int64(sec), int64(frac*1e9))
+}
@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// SHA-crypt as specified by Ulrich Drepper, the $5$ (SHA-256) and $6$
+// (SHA-512) formats of crypt(3) and htpasswd -2 and -5.
+const (
+	shaCryptDefaultRounds = 5000
+	shaCryptMinRounds     = 1000
+	shaCryptMaxRounds     = 999999999
+	shaCryptMaxSalt       = 16
+)
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// The order in which the digest bytes are encoded, three at a time. -1
+// stands for a zero byte in the last group.
+var (
+	sha256CryptOrder = [][3]int{
+		{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+		{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+		{-1, 31, 30},
+	}
+	sha512CryptOrder = [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+		{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+		{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+		{62, 20, 41}, {-1, -1, 63},
+	}
+)
+
+// shaCrypt hashes password with the settings of hashed, which starts with
+// $5$ or $6$, and returns the complete hash string.
+func shaCrypt(password, hashed string) (string, bool) {
+	var newHash func() hash.Hash
+	var order [][3]int
+	switch {
+	case strings.HasPrefix(hashed, "$5$"):
+		newHash, order = sha256.New, sha256CryptOrder
+	case strings.HasPrefix(hashed, "$6$"):
+		newHash, order = sha512.New, sha512CryptOrder
+	default:
+		return "", false
+	}
+	prefix := hashed[:3]
+	settings := hashed[3:]
+
+	rounds, customRounds := shaCryptDefaultRounds, false
+	if rest, ok := strings.CutPrefix(settings, "rounds="); ok {
+		n, after, found := strings.Cut(rest, "$")
+		r, err := strconv.Atoi(n)
+		if !found || err != nil {
+			return "", false
+		}
+		rounds, customRounds, settings = min(max(r, shaCryptMinRounds), shaCryptMaxRounds), true, after
+	}
+	salt, _, _ := strings.Cut(settings, "$")
+	if len(salt) > shaCryptMaxSalt {
+		salt = salt[:shaCryptMaxSalt]
+	}
+
+	p, s := []byte(password), []byte(salt)
+	h := newHash()
+	size := h.Size()
+	sum := func(parts ...[]byte) []byte {
+		h.Reset()
+		for _, part := range parts {
+			h.Write(part)
+		}
+		return h.Sum(nil)
+	}
+	// repeat stretches digest to n bytes.
+	repeat := func(digest []byte, n int) []byte {
+		out := make([]byte, 0, n)
+		for ; n > size; n -= size {
+			out = append(out, digest...)
+		}
+		return append(out, digest[:n]...)
+	}
+
+	b := sum(p, s, p)
+	h.Reset()
+	h.Write(p)
+	h.Write(s)
+	h.Write(repeat(b, len(p)))
+	for n := len(p); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(p)
+		}
+	}
+	a := h.Sum(nil)
+
+	h.Reset()
+	for range len(p) {
+		h.Write(p)
+	}
+	pBytes := repeat(h.Sum(nil), len(p))
+	h.Reset()
+	for range 16 + int(a[0]) {
+		h.Write(s)
+	}
+	sBytes := repeat(h.Sum(nil), len(s))
+
+	c := a
+	for i := range rounds {
+		h.Reset()
+		if i&1 != 0 {
+			h.Write(pBytes)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(sBytes)
+		}
+		if i%7 != 0 {
+			h.Write(pBytes)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(pBytes)
+		}
+		c = h.Sum(c[:0])
+	}
+
+	var out strings.Builder
+	out.WriteString(prefix)
+	if customRounds {
+		out.WriteString("rounds=" + strconv.Itoa(rounds) + "$")
+	}
+	out.WriteString(salt + "$")
+	for i, group := range order {
+		var v uint32
+		for _, index := range group {
+			v <<= 8
+			if index >= 0 {
+				v |= uint32(c[index])
+			}
+		}
+		// The last group holds the one or two bytes that are left.
+		n := 4
+		if i == len(order)-1 {
+			n = len(c) - 3*i + 1
+		}
+		for range n {
+			out.WriteByte(cryptAlphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	return out.String(), true
+}
@@ -0,0 +1,510 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/headers"
+	"github.com/ohrelaxo/httpfromtcp/internal/request"
+	"github.com/ohrelaxo/httpfromtcp/internal/response"
+	"github.com/ohrelaxo/httpfromtcp/internal/server"
+)
+
+const (
+	defaultName         = "httpfromtcp"
+	defaultMaxMemory    = 64 << 20
+	defaultMaxEntrySize = 8 << 20
+	// maxVariants bounds the responses kept per key for different Vary
+	// values.
+	maxVariants = 8
+)
+
+// notStored are the fields of a response that describe one connection or
+// this cache and are not stored with it, and Set-Cookie, which belongs to
+// one client.
+var notStored = []string{
+	"age", "cache-status", "connection", "content-length", "keep-alive",
+	"proxy-connection", "set-cookie", "trailer", "transfer-encoding", "upgrade",
+}
+
+// Options configures a Cache.
+type Options struct {
+	// Name identifies the cache in the Cache-Status header.
+	Name string
+	// MaxMemory is the size of the in-memory store in bytes.
+	MaxMemory int64
+	// MaxEntrySize is the largest response body that is stored.
+	MaxEntrySize int64
+	// Dir keeps responses on disk as well when set, so they survive a
+	// restart.
+	Dir string
+}
+
+// Cache is a shared HTTP cache as described in RFC 9111. It stores the
+// responses to GET requests, serves them while they are fresh and
+// revalidates them with conditional requests once they are stale.
+type Cache struct {
+	name         string
+	maxEntrySize int64
+	memory       *MemoryStore
+	disk         *DiskStore
+	now          func() time.Time
+}
+
+func New(opts Options) (*Cache, error) {
+	if opts.Name == "" {
+		opts.Name = defaultName
+	}
+	if opts.MaxMemory <= 0 {
+		opts.MaxMemory = defaultMaxMemory
+	}
+	if opts.MaxEntrySize <= 0 {
+		opts.MaxEntrySize = defaultMaxEntrySize
+	}
+	c := &Cache{
+		name:         opts.Name,
+		maxEntrySize: opts.MaxEntrySize,
+		memory:       NewMemoryStore(opts.MaxMemory),
+		now:          time.Now,
+	}
+	if opts.Dir != "" {
+		disk, err := NewDiskStore(opts.Dir)
+		if err != nil {
+			return nil, err
+		}
+		c.disk = disk
+	}
+	return c, nil
+}
+
+// Middleware serves the requests it can from the cache and stores the
+// responses of the handler.
+func (c *Cache) Middleware() server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			c.serve(w, req, next)
+		}
+	}
+}
+
+func (c *Cache) serve(w *response.Writer, req *request.Request, next server.Handler) {
+	key := cacheKey(req)
+	method := req.RequestLine.Method
+	if method != "GET" && method != "HEAD" {
+		// A successful unsafe request makes the stored response stale.
+		w.AfterClose(func() {
+			if status := w.Status(); status >= 200 && status < 400 {
+				c.delete(key)
+			}
+		})
+		c.status(w, "fwd=method")
+		next(w, req)
+		return
+	}
+
+	cc := requestDirectives(req.Headers)
+	variants := c.get(key)
+	entry := selectVariant(variants, req)
+	if entry != nil {
+		age := c.age(entry)
+		ttl := lifetime(entry) - age
+		responseCC := parseCacheControl(entry.Header.Get("Cache-Control"))
+		maxAge, limited := cc.seconds("max-age")
+		switch {
+		case cc.has("no-cache"):
+			c.revalidate(w, req, next, key, entry, "fwd=request")
+		case ttl > 0 && !responseCC.has("no-cache") && (!limited || age <= maxAge):
+			c.status(w, fmt.Sprintf("hit; ttl=%d", int64(ttl/time.Second)))
+			c.write(w, req, entry, age)
+		default:
+			c.revalidate(w, req, next, key, entry, "fwd=stale")
+		}
+		return
+	}
+
+	if cc.has("only-if-cached") {
+		c.status(w, "fwd=miss")
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(response.GatewayTimeout)
+		return
+	}
+	fwd := "fwd=uri-miss"
+	if len(variants) > 0 {
+		fwd = "fwd=vary-miss"
+	}
+	c.status(w, fwd)
+	if method == "HEAD" || cc.has("no-store") {
+		next(w, req)
+		return
+	}
+
+	// The response streams to the client while a copy is collected. The
+	// fields the middleware in front of the cache set are left out of it,
+	// they are added again when the stored response is served.
+	outer := w.Fields()
+	capture := &limitedBuffer{limit: c.maxEntrySize + maxHeaderSection}
+	w.Capture(capture)
+	w.AfterClose(func() {
+		if capture.overflow {
+			return
+		}
+		status, header, body, err := parseResponse(capture.Bytes())
+		if err != nil {
+			log.Printf("cache: cannot read back response for %s: %v\n", key, err)
+			return
+		}
+		withoutFields(header, outer)
+		c.store(key, req, status, header, body, c.now())
+	})
+	next(w, req)
+}
+
+// revalidate asks the handler whether entry is still current. A 304 is
+// answered with the stored response, any other response is passed on to the
+// client as the handler writes it and stored if it may be.
+func (c *Cache) revalidate(w *response.Writer, req *request.Request, next server.Handler, key string, entry *Entry, fwd string) {
+	conditional := req.WithContext(req.Context())
+	conditional.Headers = maps.Clone(req.Headers)
+	etag := entry.Header.Get("ETag")
+	lastModified := entry.Header.Get("Last-Modified")
+	if etag != "" {
+		conditional.Headers.Set("If-None-Match", etag)
+	} else {
+		conditional.Headers.Delete("If-None-Match")
+	}
+	if lastModified != "" {
+		conditional.Headers.Set("If-Modified-Since", lastModified)
+	} else {
+		conditional.Headers.Delete("If-Modified-Since")
+	}
+
+	relay := newRelay(w, c.maxEntrySize, func(status int, h headers.Headers) error {
+		c.status(w, fmt.Sprintf("%s; fwd-status=%d", fwd, status))
+		out := w.Header()
+		for name, value := range h {
+			if !slices.Contains(notStored, name) || name == "set-cookie" {
+				out[name] = value
+			}
+		}
+		if length := h.Get("Content-Length"); length != "" && h.Get("Transfer-Encoding") == "" {
+			out.Set("Content-Length", length)
+		}
+		return w.WriteHeader(response.StatusCode(status))
+	})
+	// The handler's Flush reaches the client through the relay.
+	recorder := response.NewBufferedWriter(relay, 0)
+	requested := c.now()
+	next(recorder, conditional)
+	if err := recorder.Close(); err != nil {
+		log.Printf("cache: revalidating %s: %v\n", key, err)
+	}
+
+	switch {
+	case relay.passing:
+		if relay.err == nil && relay.complete() && !relay.body.overflow {
+			c.store(key, req, relay.status, relay.header, relay.body.Bytes(), requested)
+		}
+	case relay.status == int(response.NotModified):
+		updated := *entry
+		updated.Header = maps.Clone(entry.Header)
+		for name, value := range relay.header {
+			if !slices.Contains(notStored, name) && name != "content-type" {
+				updated.Header[name] = value
+			}
+		}
+		updated.Stored, updated.InitialAge = requested, 0
+		c.replace(key, entry, &updated)
+		c.status(w, fwd+"; fwd-status=304")
+		c.write(w, req, &updated, 0)
+	default:
+		log.Printf("cache: cannot read back response for %s: %v\n", key, relay.err)
+		c.status(w, fwd)
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(response.InternalServerError)
+	}
+}
+
+// write sends a stored response. A request whose validator matches gets
+// 304 without the body.
+func (c *Cache) write(w *response.Writer, req *request.Request, e *Entry, age time.Duration) {
+	h := w.Header()
+	for name, value := range e.Header {
+		if !slices.Contains(notStored, name) {
+			h[name] = value
+		}
+	}
+	if age > 0 || e.InitialAge > 0 {
+		h.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	}
+	if e.Status == int(response.Ok) && notModified(req, e) {
+		w.WriteHeader(response.NotModified)
+		return
+	}
+	h.Set("Content-Length", strconv.Itoa(len(e.Body)))
+	w.WriteHeader(response.StatusCode(e.Status))
+	w.Write(e.Body)
+}
+
+// status adds the Cache-Status header, RFC 9211.
+func (c *Cache) status(w *response.Writer, params string) {
+	w.AddHeaderLine("Cache-Status", c.name+"; "+params)
+}
+
+// store keeps the response if it may be stored and returns its entry.
+func (c *Cache) store(key string, req *request.Request, status int, header headers.Headers, body []byte, received time.Time) *Entry {
+	if !storable(req.Headers, status, header) || int64(len(body)) > c.maxEntrySize {
+		return nil
+	}
+	e := &Entry{Status: status, Header: headers.NewHeaders(), Body: body, Stored: received}
+	for name, value := range header {
+		if !slices.Contains(notStored, name) {
+			e.Header[name] = value
+		}
+	}
+	// A response that is never fresh and has no validator would only make
+	// every request wait for the whole response to be revalidated.
+	fresh := lifetime(e) > 0 && !parseCacheControl(e.Header.Get("Cache-Control")).has("no-cache")
+	if !fresh && e.Header.Get("ETag") == "" && e.Header.Get("Last-Modified") == "" {
+		return nil
+	}
+	if age, err := strconv.ParseInt(header.Get("Age"), 10, 64); err == nil && age > 0 {
+		e.InitialAge = time.Duration(age) * time.Second
+	}
+	if vary := header.Get("Vary"); vary != "" {
+		e.Vary = map[string]string{}
+		for name := range strings.SplitSeq(vary, ",") {
+			name = strings.ToLower(strings.TrimSpace(name))
+			e.Vary[name] = req.Headers.Get(name)
+		}
+	}
+
+	variants := slices.DeleteFunc(slices.Clone(c.get(key)), func(old *Entry) bool {
+		return maps.Equal(old.Vary, e.Vary)
+	})
+	variants = append([]*Entry{e}, variants...)
+	if len(variants) > maxVariants {
+		variants = variants[:maxVariants]
+	}
+	c.set(key, variants)
+	return e
+}
+
+// replace swaps old for updated among the variants of key.
+func (c *Cache) replace(key string, old, updated *Entry) {
+	variants := slices.Clone(c.get(key))
+	for i, e := range variants {
+		if e == old || maps.Equal(e.Vary, old.Vary) {
+			variants[i] = updated
+		}
+	}
+	c.set(key, variants)
+}
+
+func (c *Cache) get(key string) []*Entry {
+	if variants, ok := c.memory.Get(key); ok {
+		return variants
+	}
+	if c.disk == nil {
+		return nil
+	}
+	variants, ok := c.disk.Get(key)
+	if !ok {
+		return nil
+	}
+	c.memory.Set(key, variants)
+	return variants
+}
+
+func (c *Cache) set(key string, variants []*Entry) {
+	c.memory.Set(key, variants)
+	if c.disk != nil {
+		if err := c.disk.Set(key, variants); err != nil {
+			log.Printf("cache: failed to store %s on disk: %v\n", key, err)
+		}
+	}
+}
+
+func (c *Cache) delete(key string) {
+	c.memory.Delete(key)
+	if c.disk != nil {
+		if err := c.disk.Delete(key); err != nil {
+			log.Printf("cache: failed to delete %s from disk: %v\n", key, err)
+		}
+	}
+}
+
+// age is the current age of a stored response, RFC 9111 section 4.2.3.
+func (c *Cache) age(e *Entry) time.Duration {
+	return e.InitialAge + max(c.now().Sub(e.Stored), 0)
+}
+
+// cacheKey identifies the target of a request, including the host so
+// virtual hosts do not share entries.
+func cacheKey(req *request.Request) string {
+	return strings.ToLower(req.Headers.Get("Host")) + " " + req.RequestLine.RequestTarget
+}
+
+// selectVariant returns the stored response whose Vary fields match req.
+func selectVariant(variants []*Entry, req *request.Request) *Entry {
+	for _, e := range variants {
+		matches := true
+		for name, value := range e.Vary {
+			if req.Headers.Get(name) != value {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return e
+		}
+	}
+	return nil
+}
+
+// notModified evaluates the conditional headers of req against e.
+func notModified(req *request.Request, e *Entry) bool {
+	if match := req.Headers.Get("If-None-Match"); match != "" {
+		etag := strings.TrimPrefix(e.Header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for candidate := range strings.SplitSeq(match, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, ok := parseDate(req.Headers.Get("If-Modified-Since"))
+	if !ok {
+		return false
+	}
+	lastModified, ok := parseDate(e.Header.Get("Last-Modified"))
+	return ok && !lastModified.After(since)
+}
+
+// withoutFields removes the values of outer from h. A field that was
+// extended by the handler keeps what the handler added.
+func withoutFields(h, outer headers.Headers) {
+	for name, value := range outer {
+		got, ok := h[name]
+		switch {
+		case !ok:
+		case got == value:
+			delete(h, name)
+		case strings.HasPrefix(got, value+", "):
+			h[name] = strings.TrimPrefix(got, value+", ")
+		case strings.HasSuffix(got, ", "+value):
+			h[name] = strings.TrimSuffix(got, ", "+value)
+		}
+	}
+}
+
+// maxHeaderSection is the room a captured response gets beyond the body.
+const maxHeaderSection = 64 << 10
+
+// limitedBuffer collects up to limit bytes and then only notes that more
+// were written, it never fails so the response is not disturbed.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit    int64
+	overflow bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.overflow || int64(b.Len()+len(p)) > b.limit {
+		b.overflow = true
+		b.Reset()
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+var errMalformedResponse = errors.New("malformed response")
+
+// parseResponse reads back the final response a response.Writer produced,
+// interim responses are skipped and trailers are dropped.
+func parseResponse(data []byte) (int, headers.Headers, []byte, error) {
+	status, h, data, complete, err := parseHead(data)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if !complete {
+		return 0, nil, nil, errMalformedResponse
+	}
+	if strings.Contains(strings.ToLower(h.Get("Transfer-Encoding")), "chunked") {
+		body, err := dechunk(data)
+		return status, h, body, err
+	}
+	if cl := h.Get("Content-Length"); cl != "" {
+		length, err := strconv.Atoi(cl)
+		if err != nil || length > len(data) {
+			return 0, nil, nil, errMalformedResponse
+		}
+		data = data[:length]
+	}
+	return status, h, bytes.Clone(data), nil
+}
+
+// parseHead reads the status and the header section of the final response
+// in data and returns what follows them. complete is false while data ends
+// before the header section does.
+func parseHead(data []byte) (status int, h headers.Headers, rest []byte, complete bool, err error) {
+	for {
+		line, after, ok := bytes.Cut(data, []byte("\r\n"))
+		if !ok {
+			return 0, nil, nil, false, nil
+		}
+		fields := strings.SplitN(string(line), " ", 3)
+		if len(fields) < 2 {
+			return 0, nil, nil, false, errMalformedResponse
+		}
+		status, err = strconv.Atoi(fields[1])
+		if err != nil {
+			return 0, nil, nil, false, errMalformedResponse
+		}
+		h = headers.NewHeaders()
+		data = after
+		for done := false; !done; {
+			n, fieldsDone, err := h.Parse(data)
+			if err != nil {
+				return 0, nil, nil, false, errMalformedResponse
+			}
+			if n == 0 {
+				return 0, nil, nil, false, nil
+			}
+			data, done = data[n:], fieldsDone
+		}
+		if status >= 200 {
+			return status, h, data, true, nil
+		}
+	}
+}
+
+func dechunk(data []byte) ([]byte, error) {
+	var body []byte
+	for {
+		line, rest, ok := bytes.Cut(data, []byte("\r\n"))
+		if !ok {
+			return nil, errMalformedResponse
+		}
+		sizeField, _, _ := bytes.Cut(line, []byte(";"))
+		size, err := strconv.ParseInt(strings.TrimSpace(string(sizeField)), 16, 64)
+		if err != nil || size < 0 || size > int64(len(rest)) {
+			return nil, errMalformedResponse
+		}
+		if size == 0 {
+			return body, nil
+		}
+		body = append(body, rest[:size]...)
+		data = bytes.TrimPrefix(rest[size:], []byte("\r\n"))
+	}
+}
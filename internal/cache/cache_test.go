@@ -0,0 +1,353 @@
+package cache
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/cors"
+	"github.com/ohrelaxo/httpfromtcp/internal/headers"
+	"github.com/ohrelaxo/httpfromtcp/internal/request"
+	"github.com/ohrelaxo/httpfromtcp/internal/response"
+	"github.com/ohrelaxo/httpfromtcp/internal/server"
+	"github.com/ohrelaxo/httpfromtcp/internal/servertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type origin struct {
+	calls       atomic.Int64
+	conditional atomic.Int64
+}
+
+// handler answers like an origin server: the path picks the caching policy
+// and the body counts how often it ran.
+func (o *origin) handler(w *response.Writer, req *request.Request) {
+	n := o.calls.Add(1)
+	h := w.Header()
+	switch req.RequestLine.RequestTarget {
+	case "/fresh":
+		h.Set("Cache-Control", "max-age=60")
+	case "/etag":
+		h.Set("Cache-Control", "max-age=10")
+		h.Set("ETag", `"v1"`)
+		if req.Headers.Get("If-None-Match") == `"v1"` {
+			o.conditional.Add(1)
+			w.WriteHeader(response.NotModified)
+			return
+		}
+	case "/no-store":
+		h.Set("Cache-Control", "no-store")
+	case "/no-cache":
+		h.Set("Cache-Control", "no-cache")
+	case "/vary":
+		h.Set("Cache-Control", "max-age=60")
+		h.Set("Vary", "Accept-Language")
+		h.Set("Content-Language", req.Headers.Get("Accept-Language"))
+	case "/items":
+		h.Set("Cache-Control", "max-age=60")
+	}
+	h.Set("Content-Type", "text/plain")
+	w.Write([]byte("response " + string(rune('0'+n))))
+}
+
+func newTestServer(t *testing.T, opts Options) (*Cache, *origin, *atomic.Int64, func(string) string) {
+	t.Helper()
+	c, err := New(opts)
+	require.NoError(t, err)
+	var offset atomic.Int64
+	start := time.Now()
+	c.now = func() time.Time { return start.Add(time.Duration(offset.Load())) }
+	o := &origin{}
+	s, err := server.Serve(0, o.handler, server.WithMiddleware(c.Middleware()))
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	send := func(raw string) string {
+		t.Helper()
+		return servertest.RoundTrip(t, s.Addr().String(), raw)
+	}
+	return c, o, &offset, send
+}
+
+func get(target string, fields ...string) string {
+	return "GET " + target + " HTTP/1.1\r\nHost: localhost\r\n" + strings.Join(fields, "") + "\r\n"
+}
+
+func TestCache(t *testing.T) {
+	c, o, offset, send := newTestServer(t, Options{Name: "test"})
+
+	// Test: A miss is forwarded and stored, the next request is a hit
+	resp := send(get("/fresh"))
+	assert.Contains(t, resp, "cache-status: test; fwd=uri-miss\r\n")
+	assert.True(t, strings.HasSuffix(resp, "response 1"), resp)
+	require.Eventually(t, func() bool { return c.memory.Len() == 1 }, time.Second, time.Millisecond)
+	offset.Store(int64(5 * time.Second))
+	resp = send(get("/fresh"))
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"), resp)
+	assert.Contains(t, resp, "cache-status: test; hit; ttl=55\r\n")
+	assert.Contains(t, resp, "age: 5\r\n")
+	assert.Contains(t, resp, "content-length: 10\r\n")
+	assert.Contains(t, resp, "content-type: text/plain\r\n")
+	assert.NotContains(t, resp, "transfer-encoding")
+	assert.True(t, strings.HasSuffix(resp, "response 1"), resp)
+	assert.Equal(t, int64(1), o.calls.Load())
+
+	// Test: max-age in the request asks for a younger response
+	resp = send(get("/fresh", "Cache-Control: max-age=2\r\n"))
+	assert.Contains(t, resp, "cache-status: test; fwd=stale; fwd-status=200\r\n")
+	assert.True(t, strings.HasSuffix(resp, "response 2"), resp)
+	resp = send(get("/fresh"))
+	assert.Contains(t, resp, "cache-status: test; hit; ttl=60\r\n")
+	assert.True(t, strings.HasSuffix(resp, "response 2"), resp)
+
+	// Test: Requests with no-store bypass the cache
+	resp = send(get("/fresh", "Cache-Control: no-store\r\n"))
+	assert.True(t, strings.HasSuffix(resp, "response 2"), resp)
+	assert.Contains(t, resp, "hit")
+	resp = send(get("/other", "Cache-Control: no-store\r\n"))
+	assert.True(t, strings.HasSuffix(resp, "response 3"), resp)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 1, c.memory.Len())
+
+	// Test: Responses with no-store are not stored
+	send(get("/no-store"))
+	resp = send(get("/no-store"))
+	assert.Contains(t, resp, "fwd=uri-miss")
+	assert.True(t, strings.HasSuffix(resp, "response 5"), resp)
+
+	// Test: Responses that are never fresh and have no validator are not
+	// stored
+	send(get("/no-cache"))
+	resp = send(get("/no-cache"))
+	assert.Contains(t, resp, "fwd=uri-miss")
+	assert.True(t, strings.HasSuffix(resp, "response 7"), resp)
+
+	// Test: only-if-cached without a stored response is a 504
+	resp = send(get("/missing", "Cache-Control: only-if-cached\r\n"))
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 504 Gateway Timeout\r\n"), resp)
+	assert.Equal(t, int64(7), o.calls.Load())
+	assert.Equal(t, 1, c.memory.Len())
+}
+
+func TestCacheRevalidation(t *testing.T) {
+	c, o, offset, send := newTestServer(t, Options{})
+	send(get("/etag"))
+	require.Eventually(t, func() bool { return c.memory.Len() == 1 }, time.Second, time.Millisecond)
+
+	// Test: The client's own validator is answered from the cache
+	resp := send(get("/etag", "If-None-Match: \"v1\"\r\n"))
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 304 Not Modified\r\n"), resp)
+	assert.Contains(t, resp, "cache-status: httpfromtcp; hit")
+	assert.Equal(t, int64(0), o.conditional.Load())
+
+	// Test: A stale response is revalidated and served again after a 304
+	offset.Store(int64(30 * time.Second))
+	resp = send(get("/etag"))
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"), resp)
+	assert.Contains(t, resp, "cache-status: httpfromtcp; fwd=stale; fwd-status=304\r\n")
+	assert.Contains(t, resp, "etag: \"v1\"\r\n")
+	assert.NotContains(t, resp, "age:")
+	assert.True(t, strings.HasSuffix(resp, "response 1"), resp)
+	assert.Equal(t, int64(1), o.conditional.Load())
+
+	// Test: The revalidated response is fresh again
+	resp = send(get("/etag"))
+	assert.Contains(t, resp, "cache-status: httpfromtcp; hit; ttl=10\r\n")
+
+	// Test: no-cache in the request always revalidates
+	resp = send(get("/etag", "Pragma: no-cache\r\n"))
+	assert.Contains(t, resp, "cache-status: httpfromtcp; fwd=request; fwd-status=304\r\n")
+	assert.True(t, strings.HasSuffix(resp, "response 1"), resp)
+	assert.Equal(t, int64(2), o.conditional.Load())
+}
+
+func TestCacheRevalidationStreams(t *testing.T) {
+	c, err := New(Options{})
+	require.NoError(t, err)
+	release := make(chan struct{})
+	handler := func(w *response.Writer, req *request.Request) {
+		w.Header().Set("Cache-Control", "no-cache")
+		if req.Headers.Get("If-None-Match") == "" {
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte("stored"))
+			return
+		}
+		w.Header().Set("ETag", `"v2"`)
+		w.Write([]byte("first "))
+		w.Flush()
+		<-release
+		w.Write([]byte("second"))
+	}
+	s, err := server.Serve(0, handler, server.WithMiddleware(c.Middleware()))
+	require.NoError(t, err)
+	defer s.Close()
+	servertest.RoundTrip(t, s.Addr().String(), get("/"))
+	require.Eventually(t, func() bool { return c.memory.Len() == 1 }, time.Second, time.Millisecond)
+
+	// Test: A response other than 304 reaches the client while the handler
+	// still writes it, and replaces the stored one
+	conn := servertest.Dial(t, s.Addr().String(), get("/"))
+	resp := servertest.ReadUntil(t, conn, "first ")
+	assert.Contains(t, resp, "cache-status: httpfromtcp; fwd=stale; fwd-status=200\r\n")
+	assert.Contains(t, resp, "etag: \"v2\"\r\n")
+	close(release)
+	servertest.ReadUntil(t, conn, "second")
+	require.Eventually(t, func() bool {
+		variants, _ := c.memory.Get("localhost /")
+		return len(variants) == 1 && string(variants[0].Body) == "first second"
+	}, time.Second, time.Millisecond)
+}
+
+func TestCacheBehindCORS(t *testing.T) {
+	c, err := New(Options{})
+	require.NoError(t, err)
+	handler := func(w *response.Writer, req *request.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		w.Write([]byte("shared"))
+	}
+	mw := server.WithMiddleware(cors.Middleware(cors.Options{AllowedOrigins: []string{"https://app.example"}}), c.Middleware())
+	s, err := server.Serve(0, handler, mw)
+	require.NoError(t, err)
+	defer s.Close()
+	raw := get("/", "Origin: https://app.example\r\n")
+	servertest.RoundTrip(t, s.Addr().String(), raw)
+	require.Eventually(t, func() bool { return c.memory.Len() == 1 }, time.Second, time.Millisecond)
+
+	// Test: Only the fields of the handler are stored
+	variants, _ := c.memory.Get("localhost /")
+	require.Len(t, variants, 1)
+	assert.Equal(t, "Accept-Language", variants[0].Header.Get("Vary"))
+	assert.Empty(t, variants[0].Header.Get("Access-Control-Allow-Origin"))
+
+	// Test: A hit carries the CORS fields once, as a miss does
+	resp := servertest.RoundTrip(t, s.Addr().String(), raw)
+	assert.Contains(t, resp, "hit")
+	assert.Equal(t, 1, strings.Count(resp, "access-control-allow-origin: https://app.example\r\n"), resp)
+	assert.Equal(t, 1, strings.Count(resp, "vary: Origin\r\n"), resp)
+	assert.Contains(t, resp, "vary: Accept-Language\r\n")
+
+	// Test: Set-Cookie is never stored
+	e := c.store("localhost /cookie", &request.Request{Headers: headers.NewHeaders()}, 200,
+		headers.Headers{"cache-control": "max-age=60", "set-cookie": "id=1"}, nil, time.Now())
+	assert.Nil(t, e)
+}
+
+func TestCacheVaryAndInvalidation(t *testing.T) {
+	c, o, _, send := newTestServer(t, Options{})
+
+	// Test: Variants are kept apart by the fields named in Vary
+	send(get("/vary", "Accept-Language: en\r\n"))
+	require.Eventually(t, func() bool { return c.memory.Len() == 1 }, time.Second, time.Millisecond)
+	resp := send(get("/vary", "Accept-Language: de\r\n"))
+	assert.Contains(t, resp, "fwd=vary-miss")
+	assert.Contains(t, resp, "content-language: de\r\n")
+	require.Eventually(t, func() bool {
+		variants, _ := c.memory.Get("localhost /vary")
+		return len(variants) == 2
+	}, time.Second, time.Millisecond)
+	resp = send(get("/vary", "Accept-Language: en\r\n"))
+	assert.Contains(t, resp, "hit")
+	assert.Contains(t, resp, "content-language: en\r\n")
+	assert.Equal(t, int64(2), o.calls.Load())
+
+	// Test: A successful POST invalidates the stored response
+	send(get("/items"))
+	require.Eventually(t, func() bool { return c.memory.Len() == 2 }, time.Second, time.Millisecond)
+	resp = send("POST /items HTTP/1.1\r\nHost: localhost\r\nContent-Length: 0\r\n\r\n")
+	assert.Contains(t, resp, "fwd=method")
+	require.Eventually(t, func() bool { return c.memory.Len() == 1 }, time.Second, time.Millisecond)
+	resp = send(get("/items"))
+	assert.Contains(t, resp, "fwd=uri-miss")
+}
+
+func TestDiskStore(t *testing.T) {
+	dir := t.TempDir()
+	c, _, _, send := newTestServer(t, Options{Dir: dir})
+	send(get("/fresh"))
+	require.Eventually(t, func() bool { return c.memory.Len() == 1 }, time.Second, time.Millisecond)
+
+	// Test: A new cache on the same directory serves what the first stored
+	_, o, _, send := newTestServer(t, Options{Dir: dir})
+	resp := send(get("/fresh"))
+	assert.Contains(t, resp, "hit")
+	assert.True(t, strings.HasSuffix(resp, "response 1"), resp)
+	assert.Equal(t, int64(0), o.calls.Load())
+
+	// Test: Keys are stored under hashed names and deleted again
+	store, err := NewDiskStore(dir)
+	require.NoError(t, err)
+	variants, ok := store.Get("localhost /fresh")
+	require.True(t, ok)
+	assert.Equal(t, []byte("response 1"), variants[0].Body)
+	require.NoError(t, store.Delete("localhost /fresh"))
+	require.NoError(t, store.Delete("localhost /fresh"))
+	_, ok = store.Get("localhost /fresh")
+	assert.False(t, ok)
+}
+
+func TestMemoryStoreEviction(t *testing.T) {
+	store := NewMemoryStore(25)
+	entry := func(body string) []*Entry {
+		return []*Entry{{Status: 200, Header: headers.NewHeaders(), Body: []byte(body)}}
+	}
+
+	// Test: The least recently used key is evicted first
+	store.Set("a", entry("0123456789"))
+	store.Set("b", entry("0123456789"))
+	store.Get("a")
+	store.Set("c", entry("0123456789"))
+	_, ok := store.Get("b")
+	assert.False(t, ok)
+	_, ok = store.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 2, store.Len())
+
+	// Test: Entries larger than the store are not kept
+	store.Set("d", entry(strings.Repeat("x", 30)))
+	_, ok = store.Get("d")
+	assert.False(t, ok)
+}
+
+func TestFreshness(t *testing.T) {
+	stored := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	entry := func(fields map[string]string) *Entry {
+		h := headers.NewHeaders()
+		for name, value := range fields {
+			h.Set(name, value)
+		}
+		return &Entry{Status: 200, Header: h, Stored: stored}
+	}
+	date := stored.Format(httpDate)
+
+	// Test: s-maxage wins over max-age, which wins over Expires
+	assert.Equal(t, 30*time.Second, lifetime(entry(map[string]string{"Cache-Control": "max-age=10, s-maxage=30"})))
+	assert.Equal(t, 10*time.Second, lifetime(entry(map[string]string{"Cache-Control": "max-age=10", "Expires": "0"})))
+	assert.Equal(t, time.Hour, lifetime(entry(map[string]string{"Date": date, "Expires": stored.Add(time.Hour).Format(httpDate)})))
+	assert.Equal(t, time.Duration(0), lifetime(entry(map[string]string{"Expires": "0"})))
+
+	// Test: Without expiration a tenth of the time since Last-Modified is used
+	assert.Equal(t, time.Hour, lifetime(entry(map[string]string{"Date": date, "Last-Modified": stored.Add(-10 * time.Hour).Format(httpDate)})))
+	assert.Equal(t, time.Duration(0), lifetime(entry(nil)))
+
+	// Test: What a shared cache may store
+	h := func(fields ...string) headers.Headers {
+		hs := headers.NewHeaders()
+		for i := 0; i < len(fields); i += 2 {
+			hs.Set(fields[i], fields[i+1])
+		}
+		return hs
+	}
+	assert.True(t, storable(h(), 200, h()))
+	assert.False(t, storable(h(), 200, h("Content-Type", "text/event-stream; charset=utf-8")))
+	assert.True(t, storable(h(), 302, h("Cache-Control", "max-age=5")))
+	assert.False(t, storable(h(), 302, h()))
+	assert.False(t, storable(h(), 206, h("Cache-Control", "max-age=5")))
+	assert.False(t, storable(h(), 200, h("Cache-Control", "private")))
+	assert.False(t, storable(h(), 200, h("Set-Cookie", "id=1")))
+	assert.False(t, storable(h(), 200, h("Vary", "*")))
+	assert.False(t, storable(h("Pragma", "no-cache", "Cache-Control", "no-store"), 200, h()))
+	assert.False(t, storable(h("Authorization", "Basic eDp5"), 200, h("Cache-Control", "max-age=5")))
+	assert.True(t, storable(h("Authorization", "Basic eDp5"), 200, h("Cache-Control", "s-maxage=5")))
+}
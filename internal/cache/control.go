@@ -0,0 +1,134 @@
+package cache
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/headers"
+)
+
+// httpDate is the IMF-fixdate format of Date, Expires and Last-Modified.
+const httpDate = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// heuristicFraction of the time since Last-Modified is used as freshness
+// lifetime for responses without explicit expiration.
+const heuristicFraction = 10
+
+// cacheableByDefault are the status codes that may be stored with a
+// heuristic lifetime, RFC 9110 section 15.1.
+var cacheableByDefault = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// directives holds the parsed Cache-Control directives, names lowercased.
+type directives map[string]string
+
+func parseCacheControl(value string) directives {
+	d := directives{}
+	for part := range strings.SplitSeq(value, ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if name == "" {
+			continue
+		}
+		d[strings.ToLower(name)] = strings.Trim(arg, `"`)
+	}
+	return d
+}
+
+func (d directives) has(name string) bool {
+	_, ok := d[name]
+	return ok
+}
+
+// seconds returns the delta-seconds argument of name.
+func (d directives) seconds(name string) (time.Duration, bool) {
+	arg, ok := d[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	// Values too large for a Duration mean forever.
+	if n > math.MaxInt64/int64(time.Second) {
+		return math.MaxInt64, true
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+func parseDate(value string) (time.Time, bool) {
+	t, err := time.Parse(httpDate, value)
+	return t, err == nil
+}
+
+// requestDirectives reads Cache-Control from a request, falling back to
+// Pragma: no-cache.
+func requestDirectives(h headers.Headers) directives {
+	if value := h.Get("Cache-Control"); value != "" {
+		return parseCacheControl(value)
+	}
+	if strings.EqualFold(strings.TrimSpace(h.Get("Pragma")), "no-cache") {
+		return directives{"no-cache": ""}
+	}
+	return directives{}
+}
+
+// storable reports whether a shared cache may store the response to a GET
+// request, RFC 9111 section 3.
+func storable(req headers.Headers, status int, h headers.Headers) bool {
+	if status < 200 || status == 206 {
+		return false
+	}
+	if requestDirectives(req).has("no-store") {
+		return false
+	}
+	cc := parseCacheControl(h.Get("Cache-Control"))
+	if cc.has("no-store") || cc.has("private") {
+		return false
+	}
+	// Event streams never end, there is nothing complete to store.
+	if mediaType, _, _ := strings.Cut(h.Get("Content-Type"), ";"); strings.EqualFold(strings.TrimSpace(mediaType), "text/event-stream") {
+		return false
+	}
+	// Responses that log somebody in are never shared.
+	if h.Get("Set-Cookie") != "" || strings.TrimSpace(h.Get("Vary")) == "*" {
+		return false
+	}
+	if req.Get("Authorization") != "" && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return false
+	}
+	explicit := cc.has("public") || cc.has("max-age") || cc.has("s-maxage") || h.Get("Expires") != ""
+	return explicit || cacheableByDefault[status]
+}
+
+// lifetime is the freshness lifetime of a stored response, RFC 9111
+// section 4.2.1.
+func lifetime(e *Entry) time.Duration {
+	cc := parseCacheControl(e.Header.Get("Cache-Control"))
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+	date := e.Stored
+	if d, ok := parseDate(e.Header.Get("Date")); ok {
+		date = d
+	}
+	if value := e.Header.Get("Expires"); value != "" {
+		// An invalid Expires means already expired.
+		expires, ok := parseDate(value)
+		if !ok || !expires.After(date) {
+			return 0
+		}
+		return expires.Sub(date)
+	}
+	if lastModified, ok := parseDate(e.Header.Get("Last-Modified")); ok && cacheableByDefault[e.Status] && lastModified.Before(date) {
+		return date.Sub(lastModified) / heuristicFraction
+	}
+	return 0
+}
@@ -0,0 +1,159 @@
+package cache
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/headers"
+	"github.com/ohrelaxo/httpfromtcp/internal/response"
+)
+
+// relay receives the response the handler writes while a stored response is
+// revalidated. It is held back until its status is known: a 304 stays
+// here to be merged with the stored response, anything else goes on to the
+// client as it arrives, with a copy of the body kept for storing.
+type relay struct {
+	// start writes the header section of a response that is passed on.
+	start func(status int, h headers.Headers) error
+	w     *response.Writer
+
+	head    limitedBuffer
+	status  int
+	header  headers.Headers
+	passing bool
+	body    limitedBuffer
+	err     error
+
+	// remaining counts the body bytes of a Content-Length body still to
+	// come, -1 without one.
+	remaining int64
+	// chunked bodies are decoded as they pass: line collects a chunk size
+	// line, inChunk counts the data left in the chunk and skip the line
+	// break after it.
+	chunked bool
+	line    []byte
+	inChunk int64
+	skip    int
+	done    bool
+}
+
+func newRelay(w *response.Writer, maxEntrySize int64, start func(status int, h headers.Headers) error) *relay {
+	return &relay{
+		start: start,
+		w:     w,
+		head:  limitedBuffer{limit: maxHeaderSection},
+		body:  limitedBuffer{limit: maxEntrySize},
+	}
+}
+
+func (r *relay) Write(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n := len(p)
+	if !r.passing {
+		if r.status != 0 {
+			// A 304 has no body, the rest is ignored.
+			return n, nil
+		}
+		r.head.Write(p)
+		if r.head.overflow {
+			r.err = errMalformedResponse
+			return 0, r.err
+		}
+		status, h, rest, complete, err := parseHead(r.head.Bytes())
+		if err != nil {
+			r.err = err
+			return 0, err
+		}
+		if !complete {
+			return n, nil
+		}
+		r.status, r.header = status, h
+		if status == int(response.NotModified) {
+			return n, nil
+		}
+		r.passing = true
+		r.chunked = strings.Contains(strings.ToLower(h.Get("Transfer-Encoding")), "chunked")
+		r.remaining = -1
+		if length, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil && !r.chunked {
+			r.remaining = length
+		}
+		if err := r.start(status, h); err != nil {
+			r.err = err
+			return 0, err
+		}
+		p = rest
+	}
+	if err := r.forward(p); err != nil {
+		r.err = err
+		return 0, err
+	}
+	return n, nil
+}
+
+// complete reports whether the whole body of a passed on response arrived.
+func (r *relay) complete() bool {
+	if r.chunked {
+		return r.done
+	}
+	return r.remaining <= 0
+}
+
+// forward removes the framing from a piece of the body and sends the data
+// to the client.
+func (r *relay) forward(p []byte) error {
+	if !r.chunked {
+		if r.remaining >= 0 {
+			p = p[:min(int64(len(p)), r.remaining)]
+			r.remaining -= int64(len(p))
+		}
+		return r.send(p)
+	}
+	for len(p) > 0 && !r.done {
+		switch {
+		case r.inChunk > 0:
+			data := p[:min(int64(len(p)), r.inChunk)]
+			if err := r.send(data); err != nil {
+				return err
+			}
+			r.inChunk -= int64(len(data))
+			p = p[len(data):]
+			if r.inChunk == 0 {
+				r.skip = 2
+			}
+		case r.skip > 0:
+			n := min(len(p), r.skip)
+			r.skip -= n
+			p = p[n:]
+		default:
+			line, rest, ok := bytes.Cut(p, []byte("\n"))
+			r.line = append(r.line, line...)
+			if !ok {
+				return nil
+			}
+			p = rest
+			sizeField, _, _ := bytes.Cut(bytes.TrimSuffix(r.line, []byte("\r")), []byte(";"))
+			r.line = nil
+			size, err := strconv.ParseInt(strings.TrimSpace(string(sizeField)), 16, 64)
+			if err != nil || size < 0 {
+				return errMalformedResponse
+			}
+			// Trailers after the last chunk are dropped.
+			r.inChunk, r.done = size, size == 0
+		}
+	}
+	return nil
+}
+
+func (r *relay) send(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	r.body.Write(p)
+	if _, err := r.w.Write(p); err != nil {
+		return err
+	}
+	return r.w.Flush()
+}
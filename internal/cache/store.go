@@ -0,0 +1,190 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/headers"
+)
+
+// Entry is a stored response.
+type Entry struct {
+	Status int             `json:"status"`
+	Header headers.Headers `json:"header"`
+	Body   []byte          `json:"body"`
+	// Vary holds the values the request had for the fields named in the
+	// Vary header of the response.
+	Vary map[string]string `json:"vary,omitempty"`
+	// Stored is when the response was received, InitialAge the Age it
+	// already had then.
+	Stored     time.Time     `json:"stored"`
+	InitialAge time.Duration `json:"initial_age"`
+}
+
+func (e *Entry) size() int64 {
+	n := int64(len(e.Body))
+	for name, value := range e.Header {
+		n += int64(len(name) + len(value))
+	}
+	return n
+}
+
+// Store keeps the variants of the responses stored under one key.
+type Store interface {
+	Get(key string) ([]*Entry, bool)
+	Set(key string, variants []*Entry) error
+	Delete(key string) error
+}
+
+// MemoryStore is a Store that evicts the least recently used keys once the
+// stored responses exceed its size.
+type MemoryStore struct {
+	mu      sync.Mutex
+	maxSize int64
+	size    int64
+	lru     *list.List
+	items   map[string]*list.Element
+}
+
+type memoryItem struct {
+	key      string
+	variants []*Entry
+	size     int64
+}
+
+func NewMemoryStore(maxSize int64) *MemoryStore {
+	return &MemoryStore{maxSize: maxSize, lru: list.New(), items: map[string]*list.Element{}}
+}
+
+func (m *MemoryStore) Get(key string) ([]*Entry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	el, ok := m.items[key]
+	if !ok {
+		return nil, false
+	}
+	m.lru.MoveToFront(el)
+	return el.Value.(*memoryItem).variants, true
+}
+
+func (m *MemoryStore) Set(key string, variants []*Entry) error {
+	item := &memoryItem{key: key, variants: variants}
+	for _, e := range variants {
+		item.size += e.size()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleteLocked(key)
+	if item.size > m.maxSize {
+		return nil
+	}
+	m.items[key] = m.lru.PushFront(item)
+	m.size += item.size
+	for m.size > m.maxSize {
+		m.deleteLocked(m.lru.Back().Value.(*memoryItem).key)
+	}
+	return nil
+}
+
+func (m *MemoryStore) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleteLocked(key)
+	return nil
+}
+
+func (m *MemoryStore) deleteLocked(key string) {
+	el, ok := m.items[key]
+	if !ok {
+		return
+	}
+	m.lru.Remove(el)
+	delete(m.items, key)
+	m.size -= el.Value.(*memoryItem).size
+}
+
+// Len returns the number of keys stored.
+func (m *MemoryStore) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.items)
+}
+
+// DiskStore is a Store that keeps every key as a JSON file in a directory.
+type DiskStore struct {
+	dir string
+}
+
+type diskFile struct {
+	Key      string   `json:"key"`
+	Variants []*Entry `json:"variants"`
+}
+
+// NewDiskStore creates dir if it does not exist.
+func NewDiskStore(dir string) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &DiskStore{dir: dir}, nil
+}
+
+// path hashes the key so any target maps to a safe file name.
+func (d *DiskStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(d.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (d *DiskStore) Get(key string) ([]*Entry, bool) {
+	data, err := os.ReadFile(d.path(key))
+	if err != nil {
+		return nil, false
+	}
+	var file diskFile
+	if err := json.Unmarshal(data, &file); err != nil || file.Key != key {
+		return nil, false
+	}
+	return file.Variants, true
+}
+
+func (d *DiskStore) Set(key string, variants []*Entry) error {
+	data, err := json.Marshal(diskFile{Key: key, Variants: variants})
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so a concurrent Get never sees a
+	// partial entry.
+	tmp, err := os.CreateTemp(d.dir, "*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), d.path(key)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+func (d *DiskStore) Delete(key string) error {
+	err := os.Remove(d.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,458 @@
+package config
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/accesslog"
+	"github.com/ohrelaxo/httpfromtcp/internal/auth"
+	"github.com/ohrelaxo/httpfromtcp/internal/cache"
+	"github.com/ohrelaxo/httpfromtcp/internal/cors"
+	"github.com/ohrelaxo/httpfromtcp/internal/proxy"
+	"github.com/ohrelaxo/httpfromtcp/internal/ratelimit"
+	"github.com/ohrelaxo/httpfromtcp/internal/request"
+	"github.com/ohrelaxo/httpfromtcp/internal/response"
+	"github.com/ohrelaxo/httpfromtcp/internal/server"
+	"github.com/ohrelaxo/httpfromtcp/internal/sse"
+	"github.com/ohrelaxo/httpfromtcp/internal/static"
+)
+
+// App is a configuration with the files it names loaded and its routes and
+// middleware assembled, ready to listen.
+type App struct {
+	config  *Config
+	handler server.Handler
+	options []server.Option
+	// tls holds the TLS configuration of each listener, nil for plain HTTP.
+	tls      []*tls.Config
+	errorLog io.Writer
+	closers  []io.Closer
+	brokers  map[string]*sse.Broker
+	// check only verifies the paths of the files and directories that
+	// would be created.
+	check bool
+}
+
+// Build loads the certificates, credentials and directories c names and
+// opens its log files. Errors name the field that failed.
+func (c *Config) Build() (*App, error) {
+	a := &App{config: c, brokers: map[string]*sse.Broker{}}
+	if err := a.build(); err != nil {
+		a.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// Check verifies c like Build without creating anything: log files are not
+// opened, only their directories must exist, and the cache directory or the
+// nearest of its parents that exists must be a directory.
+func (c *Config) Check() error {
+	a := &App{config: c, brokers: map[string]*sse.Broker{}, check: true}
+	defer a.Close()
+	return a.build()
+}
+
+func (a *App) build() error {
+	c := a.config
+	for i, l := range c.Listeners {
+		if l.TLS == nil {
+			a.tls = append(a.tls, nil)
+			continue
+		}
+		cert, err := tls.LoadX509KeyPair(l.TLS.Cert, l.TLS.Key)
+		if err != nil {
+			return fmt.Errorf("listeners[%d].tls: %w", i, err)
+		}
+		a.tls = append(a.tls, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12})
+	}
+
+	if err := a.buildRoutes(); err != nil {
+		return err
+	}
+	middleware, err := a.buildMiddleware()
+	if err != nil {
+		return err
+	}
+	if len(middleware) > 0 {
+		a.options = append(a.options, server.WithMiddleware(middleware...))
+	}
+	if c.MetricsPath != "" {
+		a.options = append(a.options, server.WithMetrics(c.MetricsPath))
+	}
+
+	parser := request.Parser{
+		MaxTargetLength: c.Parser.MaxTargetLength,
+		MaxHeaderBytes:  c.Parser.MaxHeaderBytes,
+		MaxBodyBytes:    c.Parser.MaxBodyBytes,
+	}
+	if c.Parser.Strict {
+		parser.Mode = request.Strict
+	}
+	a.options = append(a.options, server.WithParser(parser))
+	if c.Timeouts.Request > 0 {
+		a.options = append(a.options, server.WithRequestTimeout(time.Duration(c.Timeouts.Request)))
+	}
+	if c.Timeouts.Idle > 0 {
+		a.options = append(a.options, server.WithIdleTimeout(time.Duration(c.Timeouts.Idle)))
+	}
+	if c.Limits.MaxConnections > 0 {
+		whenFull := server.QueueWhenFull
+		if c.Limits.WhenFull == "reject" {
+			whenFull = server.RejectWhenFull
+		}
+		a.options = append(a.options, server.WithMaxConnections(c.Limits.MaxConnections, whenFull))
+	}
+	if c.Limits.MaxConnectionsPerIP > 0 {
+		a.options = append(a.options, server.WithMaxConnectionsPerIP(c.Limits.MaxConnectionsPerIP))
+	}
+	if c.Limits.PipelineDepth > 0 {
+		a.options = append(a.options, server.WithPipelining(c.Limits.PipelineDepth))
+	}
+
+	if c.Logging.Error != "" && a.check {
+		if err := checkFile(c.Logging.Error); err != nil {
+			return fmt.Errorf("logging.error: %w", err)
+		}
+	} else if c.Logging.Error != "" {
+		f, err := os.OpenFile(c.Logging.Error, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600) // #nosec G304 -- the path is given by the operator
+		if err != nil {
+			return fmt.Errorf("logging.error: %w", err)
+		}
+		a.closers = append(a.closers, f)
+		a.errorLog = f
+	}
+	return nil
+}
+
+// buildRoutes registers every route on a router per host. Routes without a
+// host serve the hosts no other route names.
+func (a *App) buildRoutes() error {
+	routers := map[string]*server.Router{}
+	vhosts := server.NewVirtualHosts()
+	for i, r := range a.config.Routes {
+		handler, err := a.route(r)
+		if err != nil {
+			return fmt.Errorf("routes[%d].%w", i, err)
+		}
+		router, ok := routers[r.Host]
+		if !ok {
+			router = server.NewRouter()
+			routers[r.Host] = router
+			if r.Host == "" {
+				vhosts.Default(router.Serve)
+			} else {
+				vhosts.Handle(r.Host, router.Serve)
+			}
+		}
+		for _, method := range r.methods() {
+			router.Handle(method, r.Path, handler)
+		}
+	}
+	a.handler = vhosts.Serve
+	return nil
+}
+
+// route returns the handler of the action r names.
+func (a *App) route(r Route) (server.Handler, error) {
+	// prefix is what the route matches of the path, without the slash that
+	// starts the rest.
+	prefix := strings.TrimSuffix(r.Path, "/")
+	switch {
+	case r.Static != nil && r.Static.Dir != "":
+		handler, err := static.Dir(r.Static.Dir, static.Options{StripPrefix: prefix, Index: r.Static.Index})
+		if err != nil {
+			return nil, fmt.Errorf("static.dir: %w", err)
+		}
+		return handler, nil
+	case r.Static != nil:
+		// A file that does not exist yet is answered with 404 until it does.
+		info, err := os.Stat(r.Static.File)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("static.file: %w", err)
+		}
+		if err == nil && !info.Mode().IsRegular() {
+			return nil, fmt.Errorf("static.file: %s is not a regular file", r.Static.File)
+		}
+		return static.File(r.Static.File), nil
+	case r.Proxy != nil:
+		handler, err := proxy.New(r.Proxy.Upstream, proxy.Options{StripPrefix: r.Proxy.StripPrefix})
+		if err != nil {
+			return nil, fmt.Errorf("proxy.upstream: %w", err)
+		}
+		return handler, nil
+	case r.Redirect != nil:
+		return redirect(*r.Redirect, prefix), nil
+	case r.Respond != nil:
+		return respond(*r.Respond), nil
+	case r.Events != nil:
+		broker, ok := a.brokers[r.Events.Stream]
+		if !ok {
+			broker = sse.NewBroker(sse.NewMemoryReplay(r.Events.Replay))
+			a.brokers[r.Events.Stream] = broker
+		}
+		return broker.Handler(sse.Options{Heartbeat: time.Duration(r.Events.Heartbeat)}), nil
+	default:
+		return nil, errors.New("action: none is set")
+	}
+}
+
+func redirect(r Redirect, prefix string) server.Handler {
+	status := response.StatusCode(r.Status)
+	if status == 0 {
+		status = response.Found
+	}
+	return func(w *response.Writer, req *request.Request) {
+		location := r.To
+		if r.KeepPath {
+			location += strings.TrimPrefix(req.RequestLine.RequestTarget, prefix)
+		}
+		w.Header().Set("Location", location)
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(status)
+	}
+}
+
+func respond(r Respond) server.Handler {
+	status := response.StatusCode(r.Status)
+	if status == 0 {
+		status = response.Ok
+	}
+	contentType := r.ContentType
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	return func(w *response.Writer, req *request.Request) {
+		h := w.Header()
+		for name, value := range r.Headers {
+			h.Set(name, value)
+		}
+		if r.ContentType != "" || h.Get("Content-Type") == "" {
+			h.Set("Content-Type", contentType)
+		}
+		h.Set("Content-Length", strconv.Itoa(len(r.Body)))
+		if err := w.WriteHeader(status); err != nil {
+			log.Println(err)
+			return
+		}
+		if _, err := io.WriteString(w, r.Body); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// buildMiddleware returns the enabled middleware in the order they run:
+// access log, CORS, rate limit, authentication and cache.
+func (a *App) buildMiddleware() ([]server.Middleware, error) {
+	var middleware []server.Middleware
+	m := a.config.Middleware
+
+	if access := a.config.Logging.Access; access != nil {
+		format, _ := accessFormat(access.Format)
+		var out io.Writer = os.Stdout
+		if access.Path != "" && access.Path != "-" && a.check {
+			if err := checkFile(access.Path); err != nil {
+				return nil, fmt.Errorf("logging.access.path: %w", err)
+			}
+		} else if access.Path != "" && access.Path != "-" {
+			file, err := accesslog.OpenRotatingFile(access.Path, access.MaxSize, access.MaxBackups)
+			if err != nil {
+				return nil, fmt.Errorf("logging.access.path: %w", err)
+			}
+			a.closers = append(a.closers, file)
+			out = file
+		}
+		middleware = append(middleware, accesslog.Middleware(slog.New(accesslog.NewHandler(out, format))))
+	}
+
+	if m.CORS != nil {
+		opts := cors.Options{
+			AllowedOrigins:   m.CORS.AllowedOrigins,
+			AllowedMethods:   m.CORS.AllowedMethods,
+			AllowedHeaders:   m.CORS.AllowedHeaders,
+			ExposedHeaders:   m.CORS.ExposedHeaders,
+			AllowCredentials: m.CORS.AllowCredentials,
+			MaxAge:           time.Duration(m.CORS.MaxAge),
+		}
+		for _, pattern := range m.CORS.AllowedOriginPatterns {
+			opts.AllowedOriginPatterns = append(opts.AllowedOriginPatterns, regexp.MustCompile(pattern))
+		}
+		middleware = append(middleware, cors.Middleware(opts))
+	}
+
+	if m.RateLimit != nil {
+		burst := m.RateLimit.Burst
+		if burst == 0 {
+			burst = max(1, int(math.Ceil(m.RateLimit.Rate)))
+		}
+		key := ratelimit.ByIP
+		if m.RateLimit.Header != "" {
+			key = ratelimit.ByHeader(m.RateLimit.Header)
+		}
+		middleware = append(middleware, ratelimit.Middleware(ratelimit.NewLimiter(m.RateLimit.Rate, burst), key))
+	}
+
+	if m.Auth != nil {
+		mw, err := m.Auth.middleware()
+		if err != nil {
+			return nil, err
+		}
+		middleware = append(middleware, mw)
+	}
+
+	if m.Cache != nil && a.check {
+		if m.Cache.Dir != "" {
+			if err := checkDir(m.Cache.Dir); err != nil {
+				return nil, fmt.Errorf("middleware.cache.dir: %w", err)
+			}
+		}
+	} else if m.Cache != nil {
+		responses, err := cache.New(cache.Options{MaxMemory: m.Cache.MaxMemory, MaxEntrySize: m.Cache.MaxEntrySize, Dir: m.Cache.Dir})
+		if err != nil {
+			return nil, fmt.Errorf("middleware.cache: %w", err)
+		}
+		middleware = append(middleware, responses.Middleware())
+	}
+	return middleware, nil
+}
+
+func (c *Auth) middleware() (server.Middleware, error) {
+	realm := c.Realm
+	if realm == "" {
+		realm = "httpfromtcp"
+	}
+	if c.Htpasswd != "" {
+		users, err := auth.LoadHtpasswd(c.Htpasswd)
+		if err != nil {
+			return nil, fmt.Errorf("middleware.auth.htpasswd: %w", err)
+		}
+		return auth.Basic(realm, users.Verify), nil
+	}
+
+	opts := auth.JWTOptions{Issuer: c.JWT.Issuer, Audience: c.JWT.Audience, Leeway: time.Duration(c.JWT.Leeway)}
+	if c.JWT.SecretFile != "" {
+		secret, err := os.ReadFile(c.JWT.SecretFile) // #nosec G304 -- the path is given by the operator
+		if err != nil {
+			return nil, fmt.Errorf("middleware.auth.jwt.secret_file: %w", err)
+		}
+		// A line break at the end of the file is not part of the secret.
+		secret = bytes.TrimRight(secret, "\r\n")
+		if len(secret) == 0 {
+			return nil, errors.New("middleware.auth.jwt.secret_file: the secret is empty")
+		}
+		return auth.Bearer(realm, auth.NewHS256Verifier(secret, opts)), nil
+	}
+	data, err := os.ReadFile(c.JWT.PublicKeyFile) // #nosec G304 -- the path is given by the operator
+	if err != nil {
+		return nil, fmt.Errorf("middleware.auth.jwt.public_key_file: %w", err)
+	}
+	key, err := auth.ParseRSAPublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("middleware.auth.jwt.public_key_file: %w", err)
+	}
+	return auth.Bearer(realm, auth.NewRS256Verifier(key, opts)), nil
+}
+
+// checkFile reports whether path is a file that opens for appending, or
+// could be created in an existing directory.
+func checkFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0) // #nosec G304 -- the path is given by the operator
+	if err == nil {
+		return f.Close()
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	info, err := os.Stat(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", filepath.Dir(path))
+	}
+	return nil
+}
+
+// checkDir reports whether dir is a directory, or the nearest of its
+// parents that exists is one so it can be created.
+func checkDir(dir string) error {
+	for {
+		info, err := os.Stat(dir)
+		switch {
+		case err == nil && info.IsDir():
+			return nil
+		case err == nil:
+			return fmt.Errorf("%s is not a directory", dir)
+		case !errors.Is(err, fs.ErrNotExist):
+			return err
+		case filepath.Dir(dir) == dir:
+			return err
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// accessFormat parses an access log format, combined if empty.
+func accessFormat(name string) (accesslog.Format, error) {
+	if name == "" {
+		return accesslog.Combined, nil
+	}
+	return accesslog.ParseFormat(name)
+}
+
+// Broker returns the broker of the event stream name, nil if no route
+// streams it. Events published to it reach every client of those routes.
+func (a *App) Broker(name string) *sse.Broker {
+	return a.brokers[name]
+}
+
+// Listen starts a server on every listener. If one cannot start, the ones
+// already started are closed again.
+func (a *App) Listen() ([]*server.Server, error) {
+	if a.errorLog != nil {
+		log.SetOutput(a.errorLog)
+	}
+	var servers []*server.Server
+	for i, l := range a.config.Listeners {
+		opts := a.options
+		if a.tls[i] != nil {
+			opts = append(slices.Clip(opts), server.WithTLS(a.tls[i]))
+		}
+		s, err := server.Listen(l.Address, a.handler, opts...)
+		if err != nil {
+			for _, s := range servers {
+				s.Close()
+			}
+			return nil, err
+		}
+		servers = append(servers, s)
+	}
+	return servers, nil
+}
+
+// Close closes the log files. Call it once the servers are closed.
+func (a *App) Close() error {
+	if a.errorLog != nil {
+		log.SetOutput(os.Stderr)
+	}
+	var errs []error
+	for _, c := range a.closers {
+		errs = append(errs, c.Close())
+	}
+	a.closers = nil
+	return errors.Join(errs...)
+}
@@ -0,0 +1,273 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Config describes a server: where it listens, how requests are limited and
+// routed, the middleware they pass and where it logs. It is read from JSON
+// with the field names given in the tags.
+type Config struct {
+	Listeners   []Listener `json:"listeners"`
+	Timeouts    Timeouts   `json:"timeouts"`
+	Limits      Limits     `json:"limits"`
+	Parser      Parser     `json:"parser"`
+	Routes      []Route    `json:"routes"`
+	Middleware  Middleware `json:"middleware"`
+	MetricsPath string     `json:"metrics_path"`
+	Logging     Logging    `json:"logging"`
+}
+
+// Listener is an address to accept connections on, such as ":8080" or
+// "127.0.0.1:8443". With TLS set it serves HTTPS.
+type Listener struct {
+	Address string `json:"address"`
+	TLS     *TLS   `json:"tls"`
+}
+
+// TLS names the PEM files of the certificate chain and its private key.
+type TLS struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+type Timeouts struct {
+	// Request bounds the context of every request.
+	Request Duration `json:"request"`
+	// Idle closes persistent connections that wait this long for the next
+	// request.
+	Idle Duration `json:"idle"`
+}
+
+type Limits struct {
+	MaxConnections int `json:"max_connections"`
+	// WhenFull is "queue", the default, or "reject".
+	WhenFull            string `json:"when_full"`
+	MaxConnectionsPerIP int    `json:"max_connections_per_ip"`
+	// PipelineDepth enables persistent connections with up to this many
+	// requests read ahead.
+	PipelineDepth int `json:"pipeline_depth"`
+}
+
+// Parser sets how requests are read, zero values select the defaults of
+// the request package.
+type Parser struct {
+	Strict          bool `json:"strict"`
+	MaxTargetLength int  `json:"max_target_length"`
+	MaxHeaderBytes  int  `json:"max_header_bytes"`
+	MaxBodyBytes    int  `json:"max_body_bytes"`
+}
+
+// Route maps requests for a host and path to one of the actions. Path is
+// matched like a server.Router pattern, Host like a server.VirtualHosts
+// pattern and an empty Host matches hosts that no other route names.
+type Route struct {
+	Host string `json:"host"`
+	Path string `json:"path"`
+	// Methods defaults to GET for static files, event streams, redirects and
+	// responses and to GET, POST, PUT, PATCH and DELETE for proxies. HEAD is
+	// answered wherever GET is.
+	Methods []string `json:"methods"`
+
+	Static   *Static   `json:"static"`
+	Proxy    *Proxy    `json:"proxy"`
+	Redirect *Redirect `json:"redirect"`
+	Respond  *Respond  `json:"respond"`
+	Events   *Events   `json:"events"`
+}
+
+// Static serves the files below Dir, with the route path removed from the
+// request path, or the single File for every request. Dir must exist, File
+// is answered with 404 while it does not.
+type Static struct {
+	Dir   string `json:"dir"`
+	File  string `json:"file"`
+	Index string `json:"index"`
+}
+
+// Proxy forwards requests to Upstream.
+type Proxy struct {
+	Upstream    string `json:"upstream"`
+	StripPrefix string `json:"strip_prefix"`
+}
+
+// Redirect sends clients to To with Status, 302 by default. KeepPath
+// appends the rest of the request path and the query to To.
+type Redirect struct {
+	To       string `json:"to"`
+	Status   int    `json:"status"`
+	KeepPath bool   `json:"keep_path"`
+}
+
+// Respond answers with a fixed response.
+type Respond struct {
+	Status      int               `json:"status"`
+	ContentType string            `json:"content_type"`
+	Headers     map[string]string `json:"headers"`
+	Body        string            `json:"body"`
+}
+
+// Events streams what the program publishes to Stream, see App.Broker, as
+// Server-Sent Events. The last Replay events are kept for clients that
+// reconnect, and Heartbeat comments keep idle streams open.
+type Events struct {
+	Stream    string   `json:"stream"`
+	Replay    int      `json:"replay"`
+	Heartbeat Duration `json:"heartbeat"`
+}
+
+// Middleware enables the middleware that wraps every route. They run in the
+// order access log, CORS, rate limit, authentication and cache.
+type Middleware struct {
+	CORS      *CORS      `json:"cors"`
+	RateLimit *RateLimit `json:"rate_limit"`
+	Auth      *Auth      `json:"auth"`
+	Cache     *Cache     `json:"cache"`
+}
+
+type CORS struct {
+	AllowedOrigins        []string `json:"allowed_origins"`
+	AllowedOriginPatterns []string `json:"allowed_origin_patterns"`
+	AllowedMethods        []string `json:"allowed_methods"`
+	AllowedHeaders        []string `json:"allowed_headers"`
+	ExposedHeaders        []string `json:"exposed_headers"`
+	AllowCredentials      bool     `json:"allow_credentials"`
+	MaxAge                Duration `json:"max_age"`
+}
+
+// RateLimit allows Rate requests per second with bursts of Burst per client
+// address, or per value of Header if set.
+type RateLimit struct {
+	Rate   float64 `json:"rate"`
+	Burst  int     `json:"burst"`
+	Header string  `json:"header"`
+}
+
+// Auth requires Basic authentication against an htpasswd file or a bearer
+// JWT, exactly one of them must be set.
+type Auth struct {
+	Realm    string `json:"realm"`
+	Htpasswd string `json:"htpasswd"`
+	JWT      *JWT   `json:"jwt"`
+}
+
+// JWT verifies tokens with the HS256 secret or the RS256 public key in one
+// of the files.
+type JWT struct {
+	SecretFile    string   `json:"secret_file"`
+	PublicKeyFile string   `json:"public_key_file"`
+	Issuer        string   `json:"issuer"`
+	Audience      string   `json:"audience"`
+	Leeway        Duration `json:"leeway"`
+}
+
+type Cache struct {
+	MaxMemory    int64  `json:"max_memory"`
+	MaxEntrySize int64  `json:"max_entry_size"`
+	Dir          string `json:"dir"`
+}
+
+type Logging struct {
+	Access *AccessLog `json:"access"`
+	// Error is the file the server logs errors to, standard error if empty.
+	Error string `json:"error"`
+}
+
+// AccessLog writes one line per request in Format, "common", "combined" or
+// "json", to Path or standard output if it is empty or "-". Files rotate
+// once they reach MaxSize bytes.
+type AccessLog struct {
+	Format     string `json:"format"`
+	Path       string `json:"path"`
+	MaxSize    int64  `json:"max_size"`
+	MaxBackups int    `json:"max_backups"`
+}
+
+// Duration is a time.Duration written as a string such as "30s" or "1m".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("invalid duration %s, use a string such as \"30s\"", data)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Load reads and validates the configuration file at path.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path) // #nosec G304 -- the path is given by the operator
+	if err != nil {
+		return nil, err
+	}
+	c, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Parse decodes and validates a configuration. Unknown fields are errors,
+// so misspelled settings are not silently ignored.
+func Parse(data []byte) (*Config, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var c Config
+	if err := decoder.Decode(&c); err != nil {
+		return nil, decodeError(data, decoder.InputOffset(), err)
+	}
+	if decoder.More() {
+		return nil, decodeError(data, decoder.InputOffset(), errors.New("unexpected data after the configuration"))
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// decodeError adds the line and column of the problem to err where the
+// decoder tells it, or the field name can be found.
+func decodeError(data []byte, offset int64, err error) error {
+	var syntax *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	message := strings.TrimPrefix(err.Error(), "json: ")
+	switch {
+	case errors.As(err, &syntax):
+		offset = syntax.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+		message = fmt.Sprintf("%s: cannot use %s as %s", typeErr.Field, typeErr.Value, typeErr.Type)
+	case strings.HasPrefix(message, "unknown field "):
+		// The decoder reports unknown fields once the whole value is read.
+		key := regexp.MustCompile(regexp.QuoteMeta(strings.TrimPrefix(message, "unknown field ")) + `\s*:`)
+		loc := key.FindIndex(data)
+		if loc == nil {
+			return errors.New(message)
+		}
+		offset = int64(loc[0]) + 1
+	case offset >= int64(len(data)):
+		return errors.New(message)
+	}
+	// offset is just past the byte that was the problem.
+	offset = min(max(offset-1, 0), int64(len(data)))
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n')
+	return fmt.Errorf("line %d, column %d: %s", line, column, message)
+}
@@ -0,0 +1,347 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/servertest"
+	"github.com/ohrelaxo/httpfromtcp/internal/sse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	// Test: A valid configuration is decoded, durations from strings
+	c, err := Parse([]byte(`{
+		"listeners": [{"address": ":8080"}],
+		"timeouts": {"idle": "90s"},
+		"routes": [{"path": "/", "respond": {"body": "hi"}}]
+	}`))
+	require.NoError(t, err)
+	assert.Equal(t, ":8080", c.Listeners[0].Address)
+	assert.Equal(t, Duration(90*time.Second), c.Timeouts.Idle)
+
+	// Test: Syntax errors and unknown fields give their position
+	_, err = Parse([]byte("{\n  \"listeners\": [,]\n}"))
+	assert.ErrorContains(t, err, "line 2, column 17: ")
+	_, err = Parse([]byte("{\n  \"listners\": []\n}"))
+	assert.ErrorContains(t, err, `line 2, column 3: unknown field "listners"`)
+	_, err = Parse([]byte("{\n  \"listeners\": [{\"address\": \":80\", \"tls\": {\"certificate\": \"\"}}]\n}"))
+	assert.ErrorContains(t, err, `line 2, column 44: unknown field "certificate"`)
+	_, err = Parse([]byte("{\n  \"timeouts\": {\"idle\": 5}\n}"))
+	assert.ErrorContains(t, err, `invalid duration 5, use a string such as "30s"`)
+	_, err = Parse([]byte("{\n  \"limits\": {\"pipeline_depth\": \"2\"}\n}"))
+	assert.ErrorContains(t, err, "limits.pipeline_depth: cannot use string as int")
+
+	// Test: Every problem is reported with the field it is in
+	_, err = Parse([]byte(`{
+		"listeners": [{"address": "localhost"}, {"address": ":443", "tls": {"cert": "cert.pem"}}],
+		"limits": {"when_full": "drop"},
+		"routes": [
+			{"path": "docs", "static": {"dir": "docs", "file": "x"}},
+			{"host": "bad host", "path": "/a", "redirect": {"to": "/b", "status": 200}},
+			{"path": "/a", "methods": ["get"], "respond": {"status": 99}},
+			{"path": "/p", "proxy": {"upstream": "localhost:80"}, "respond": {}},
+			{"path": "/p", "methods": ["POST"], "respond": {}},
+			{"path": "/e", "methods": ["POST"], "events": {"replay": -1}},
+			{"path": "/f", "events": {"stream": "clock", "replay": 10}},
+			{"path": "/g", "events": {"stream": "clock"}}
+		],
+		"middleware": {"auth": {}, "rate_limit": {"rate": 0}, "cors": {"allowed_origins": ["*"], "allow_credentials": true}},
+		"logging": {"access": {"format": "xml"}}
+	}`))
+	require.ErrorIs(t, err, ErrInvalid)
+	for _, problem := range []string{
+		`listeners[0].address: "localhost" is not a host:port address`,
+		"listeners[1].tls.key: is required",
+		`limits.when_full: must be "queue" or "reject", not "drop"`,
+		"routes[0].path: must start with /",
+		"routes[0].static: needs exactly one of dir or file",
+		`routes[1].host: "bad host" is not a host name or *.domain pattern`,
+		"routes[1].redirect.status: must be one of 301, 302, 303, 307 or 308, not 200",
+		`routes[2].methods: "get" is not an uppercase method name`,
+		"routes[2].respond.status: must be between 200 and 599, not 99",
+		"routes[3].proxy.upstream: ",
+		"routes[3]: needs exactly one of static, proxy, redirect, respond or events, found 2",
+		"routes[4]: POST /p is already served by routes[3]",
+		"routes[5].events.stream: is required",
+		"routes[5].events.replay: must not be negative",
+		"routes[5].methods: event streams are only served to GET and HEAD, not POST",
+		`routes[7].events.replay: is 0 for stream "clock", another route sets 10`,
+		`middleware.cors: allow_credentials cannot be used with "*"`,
+		"middleware.auth: needs exactly one of htpasswd or jwt",
+		"middleware.rate_limit.rate: must be positive",
+		`logging.access.format: unknown access log format "xml"`,
+	} {
+		assert.ErrorContains(t, err, problem)
+	}
+
+	// Test: Listeners and routes are required
+	_, err = Parse([]byte(`{}`))
+	assert.ErrorContains(t, err, "listeners: at least one listener is required")
+	assert.ErrorContains(t, err, "routes: at least one route is required")
+}
+
+func TestBuild(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "app.js"), []byte("run()"), 0o600))
+	accessLog := filepath.Join(t.TempDir(), "access.log")
+	c, err := Parse([]byte(`{
+		"listeners": [{"address": "127.0.0.1:0"}],
+		"limits": {"pipeline_depth": 4},
+		"metrics_path": "/metrics",
+		"routes": [
+			{"path": "/assets/", "static": {"dir": ` + quote(dir) + `}},
+			{"path": "/old/", "redirect": {"to": "https://example.com/new", "status": 301, "keep_path": true}},
+			{"path": "/teapot", "methods": ["GET", "POST"], "respond": {"status": 418, "headers": {"X-Kind": "teapot"}, "body": "short and stout"}},
+			{"path": "/events", "events": {"stream": "clock", "replay": 10, "heartbeat": "-1s"}},
+			{"host": "*.example.com", "path": "/", "respond": {"body": "example"}}
+		],
+		"middleware": {"cors": {"allowed_origins": ["https://app.example"]}},
+		"logging": {"access": {"format": "common", "path": ` + quote(accessLog) + `}}
+	}`))
+	require.NoError(t, err)
+	app, err := c.Build()
+	require.NoError(t, err)
+	servers, err := app.Listen()
+	require.NoError(t, err)
+	require.Len(t, servers, 1)
+	addr := servers[0].Addr().String()
+
+	// Test: Static directories are served below the route path
+	resp := servertest.RoundTrip(t, addr, "GET /assets/app.js HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"), resp)
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\nrun()"), resp)
+
+	// Test: Redirects keep the rest of the path and the query
+	resp = servertest.RoundTrip(t, addr, "GET /old/a/b?c=d HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 301 Moved Permanently\r\n"), resp)
+	assert.Contains(t, resp, "location: https://example.com/new/a/b?c=d\r\n")
+
+	// Test: Canned responses have their status, fields and body, for the
+	// listed methods only
+	resp = servertest.RoundTrip(t, addr, "POST /teapot HTTP/1.1\r\nHost: localhost\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 418 "), resp)
+	assert.Contains(t, resp, "x-kind: teapot\r\n")
+	assert.Contains(t, resp, "content-type: text/plain\r\n")
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\nshort and stout"), resp)
+	resp = servertest.RoundTrip(t, addr, "DELETE /teapot HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 405 "), resp)
+
+	// Test: Routes with a host only serve that host
+	resp = servertest.RoundTrip(t, addr, "GET /teapot HTTP/1.1\r\nHost: www.example.com\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\nexample"), resp)
+	resp = servertest.RoundTrip(t, addr, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 404 "), resp)
+
+	// Test: Event routes stream what is published to their broker
+	assert.Nil(t, app.Broker("news"))
+	clock := app.Broker("clock")
+	require.NotNil(t, clock)
+	conn := servertest.Dial(t, addr, "GET /events HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.Eventually(t, func() bool { return clock.Len() == 1 }, time.Second, time.Millisecond)
+	require.NoError(t, clock.Publish(sse.Event{Type: "time", Data: "one"}))
+	stream := servertest.ReadUntil(t, conn, "data: one\n\n")
+	conn.Close()
+	assert.Contains(t, stream, "content-type: text/event-stream\r\n")
+	assert.Contains(t, stream, "id: 1\nevent: time\ndata: one\n\n")
+
+	// Test: Limits, metrics and middleware are applied
+	resp = servertest.RoundTrip(t, addr, "GET /teapot HTTP/1.1\r\nHost: localhost\r\nOrigin: https://app.example\r\n\r\nGET /metrics HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, 2, strings.Count(resp, "HTTP/1.1 "), resp)
+	assert.Contains(t, resp, "access-control-allow-origin: https://app.example\r\n")
+	assert.Contains(t, resp, "httpserver_requests_total")
+
+	for _, s := range servers {
+		s.Close()
+	}
+	require.NoError(t, app.Close())
+	logged, err := os.ReadFile(accessLog)
+	require.NoError(t, err)
+	assert.Contains(t, string(logged), `"GET /assets/app.js HTTP/1.1" 200 5`)
+
+	// Test: Files the configuration names must exist
+	for _, missing := range []string{
+		`{"path": "/", "static": {"dir": ` + quote(filepath.Join(dir, "nope")) + `}}`,
+		`{"path": "/", "static": {"file": ` + quote(dir) + `}}`,
+	} {
+		c, err := Parse([]byte(`{"listeners": [{"address": ":0"}], "routes": [` + missing + `]}`))
+		require.NoError(t, err)
+		_, err = c.Build()
+		assert.ErrorContains(t, err, "routes[0].static.")
+	}
+	c, err = Parse([]byte(`{"listeners": [{"address": ":0"}], "routes": [{"path": "/", "respond": {}}],
+		"middleware": {"auth": {"htpasswd": ` + quote(filepath.Join(dir, "users")) + `}}}`))
+	require.NoError(t, err)
+	_, err = c.Build()
+	assert.ErrorContains(t, err, "middleware.auth.htpasswd: ")
+}
+
+func TestShippedConfig(t *testing.T) {
+	c, err := Load(filepath.Join("..", "..", "httpserver.json"))
+	require.NoError(t, err)
+	c.Listeners = []Listener{{Address: "127.0.0.1:0"}}
+	app, err := c.Build()
+	require.NoError(t, err)
+	defer app.Close()
+	servers, err := app.Listen()
+	require.NoError(t, err)
+	defer servers[0].Close()
+	addr := servers[0].Addr().String()
+	clock := app.Broker("clock")
+	require.NotNil(t, clock)
+
+	// Test: Every method gets the pages, as before the configuration file
+	resp := servertest.RoundTrip(t, addr, "POST /anything HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"), resp)
+	assert.Contains(t, resp, "<h1>Success!</h1>")
+	resp = servertest.RoundTrip(t, addr, "PUT /yourproblem HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 400 "), resp)
+
+	// Test: The video is not found while its file is missing
+	resp = servertest.RoundTrip(t, addr, "GET /video HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 404 "), resp)
+
+	// Test: Clients that come one after the other all get the events
+	for i := range 2 {
+		conn := servertest.Dial(t, addr, "GET /events HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		require.Eventually(t, func() bool { return clock.Len() == 1 }, time.Second, time.Millisecond)
+		data := fmt.Sprintf("tick %d", i)
+		require.NoError(t, clock.Publish(sse.Event{Type: "time", Data: data}))
+		stream := servertest.ReadUntil(t, conn, "data: "+data+"\n\n")
+		assert.True(t, strings.HasPrefix(stream, "HTTP/1.1 200 OK\r\n"), stream)
+		conn.Close()
+		require.Eventually(t, func() bool { return clock.Len() == 0 }, 2*time.Second, time.Millisecond)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+	errorLog := filepath.Join(dir, "error.log")
+	accessLog := filepath.Join(dir, "logs", "access.log")
+	cacheDir := filepath.Join(dir, "cache", "responses")
+	config := func(errorLog, accessLog, cacheDir string) *Config {
+		c, err := Parse([]byte(`{
+			"listeners": [{"address": ":0"}],
+			"routes": [{"path": "/", "respond": {}}],
+			"middleware": {"cache": {"dir": ` + quote(cacheDir) + `}},
+			"logging": {"error": ` + quote(errorLog) + `, "access": {"path": ` + quote(accessLog) + `}}
+		}`))
+		require.NoError(t, err)
+		return c
+	}
+
+	// Test: Log files need an existing directory, which is not created
+	err := config(errorLog, accessLog, cacheDir).Check()
+	assert.ErrorContains(t, err, "logging.access.path: ")
+	require.NoError(t, os.Mkdir(filepath.Dir(accessLog), 0o700))
+
+	// Test: Nothing the configuration names is created
+	require.NoError(t, config(errorLog, accessLog, cacheDir).Check())
+	for _, path := range []string{errorLog, accessLog, filepath.Dir(cacheDir)} {
+		_, err := os.Stat(path)
+		assert.ErrorIs(t, err, os.ErrNotExist, path)
+	}
+
+	// Test: Existing paths must be of the right kind
+	err = config(dir, accessLog, cacheDir).Check()
+	assert.ErrorContains(t, err, "logging.error: ")
+	require.NoError(t, os.WriteFile(errorLog, nil, 0o600))
+	err = config(errorLog, accessLog, filepath.Join(errorLog, "cache")).Check()
+	assert.ErrorContains(t, err, "middleware.cache.dir: ")
+	assert.ErrorContains(t, err, "not a directory")
+
+	// Test: Build does create them
+	app, err := config(errorLog, accessLog, cacheDir).Build()
+	require.NoError(t, err)
+	require.NoError(t, app.Close())
+	for _, path := range []string{accessLog, cacheDir} {
+		_, err := os.Stat(path)
+		assert.NoError(t, err, path)
+	}
+}
+
+func TestTLSListener(t *testing.T) {
+	dir := t.TempDir()
+	pool := writeCertificate(t, filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	c, err := Parse([]byte(`{
+		"listeners": [{"address": "127.0.0.1:0", "tls": {"cert": ` + quote(filepath.Join(dir, "cert.pem")) + `, "key": ` + quote(filepath.Join(dir, "key.pem")) + `}}],
+		"routes": [{"path": "/", "respond": {"body": "secure"}}]
+	}`))
+	require.NoError(t, err)
+	app, err := c.Build()
+	require.NoError(t, err)
+	defer app.Close()
+	servers, err := app.Listen()
+	require.NoError(t, err)
+	defer servers[0].Close()
+
+	// Test: The listener speaks TLS with the configured certificate
+	conn, err := tls.Dial("tcp", servers[0].Addr().String(), &tls.Config{RootCAs: pool, ServerName: "localhost", NextProtos: []string{"http/1.1"}})
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(string(resp), "\r\n\r\nsecure"), string(resp))
+
+	// Test: A key that does not match is reported
+	c.Listeners[0].TLS.Key = filepath.Join(dir, "cert.pem")
+	_, err = c.Build()
+	assert.ErrorContains(t, err, "listeners[0].tls: ")
+
+	// Test: A port in use is an error and no server is left running
+	c.Listeners = []Listener{{Address: "127.0.0.1:0"}, {Address: servers[0].Addr().String()}}
+	other, err := c.Build()
+	require.NoError(t, err)
+	_, err = other.Listen()
+	assert.Error(t, err)
+}
+
+// writeCertificate writes a self-signed certificate for localhost and its
+// key, and returns a pool that trusts it.
+func writeCertificate(t *testing.T, certFile, keyFile string) *x509.CertPool {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return pool
+}
+
+// quote returns s as a JSON string.
+func quote(s string) string {
+	return `"` + strings.ReplaceAll(strings.ReplaceAll(s, `\`, `\\`), `"`, `\"`) + `"`
+}
@@ -0,0 +1,328 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/headers"
+)
+
+var ErrInvalid = errors.New("invalid configuration")
+
+var (
+	defaultMethods      = []string{"GET"}
+	defaultProxyMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+)
+
+// redirectStatuses are the codes a redirect route may use.
+var redirectStatuses = []int{301, 302, 303, 307, 308}
+
+// problems collects the errors found in a configuration, each prefixed with
+// the path of the field, as in "routes[1].path: must start with /".
+type problems []error
+
+func (p *problems) add(field, format string, args ...any) {
+	*p = append(*p, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+}
+
+// Validate reports every problem in c at once, wrapped in ErrInvalid. It
+// does not touch the files the configuration names, Build does.
+func (c *Config) Validate() error {
+	var p problems
+	c.validateListeners(&p)
+	if c.Timeouts.Request < 0 {
+		p.add("timeouts.request", "must not be negative")
+	}
+	if c.Timeouts.Idle < 0 {
+		p.add("timeouts.idle", "must not be negative")
+	}
+	c.validateLimits(&p)
+	if c.MetricsPath != "" && !strings.HasPrefix(c.MetricsPath, "/") {
+		p.add("metrics_path", "must start with /")
+	}
+	c.validateRoutes(&p)
+	c.validateMiddleware(&p)
+	c.validateLogging(&p)
+	if len(p) > 0 {
+		return fmt.Errorf("%w\n%w", ErrInvalid, errors.Join(p...))
+	}
+	return nil
+}
+
+func (c *Config) validateListeners(p *problems) {
+	if len(c.Listeners) == 0 {
+		p.add("listeners", "at least one listener is required")
+	}
+	seen := map[string]bool{}
+	for i, l := range c.Listeners {
+		field := fmt.Sprintf("listeners[%d]", i)
+		_, port, err := net.SplitHostPort(l.Address)
+		if n, perr := strconv.Atoi(port); err != nil || perr != nil || n < 0 || n > 65535 {
+			p.add(field+".address", "%q is not a host:port address", l.Address)
+		}
+		if seen[l.Address] {
+			p.add(field+".address", "%q is used by another listener", l.Address)
+		}
+		seen[l.Address] = true
+		if l.TLS != nil {
+			if l.TLS.Cert == "" {
+				p.add(field+".tls.cert", "is required")
+			}
+			if l.TLS.Key == "" {
+				p.add(field+".tls.key", "is required")
+			}
+		}
+	}
+}
+
+func (c *Config) validateLimits(p *problems) {
+	l := c.Limits
+	for _, limit := range []struct {
+		field string
+		n     int
+	}{
+		{"limits.max_connections", l.MaxConnections},
+		{"limits.max_connections_per_ip", l.MaxConnectionsPerIP},
+		{"limits.pipeline_depth", l.PipelineDepth},
+		{"parser.max_target_length", c.Parser.MaxTargetLength},
+		{"parser.max_header_bytes", c.Parser.MaxHeaderBytes},
+		{"parser.max_body_bytes", c.Parser.MaxBodyBytes},
+	} {
+		if limit.n < 0 {
+			p.add(limit.field, "must not be negative")
+		}
+	}
+	if l.WhenFull != "" && l.WhenFull != "queue" && l.WhenFull != "reject" {
+		p.add("limits.when_full", "must be \"queue\" or \"reject\", not %q", l.WhenFull)
+	}
+}
+
+func (c *Config) validateRoutes(p *problems) {
+	if len(c.Routes) == 0 {
+		p.add("routes", "at least one route is required")
+	}
+	// seen maps host, path and method to the route that serves them.
+	seen := map[string]int{}
+	streams := map[string]*Events{}
+	for i, r := range c.Routes {
+		field := fmt.Sprintf("routes[%d]", i)
+		if !validHostPattern(r.Host) {
+			p.add(field+".host", "%q is not a host name or *.domain pattern", r.Host)
+		}
+		if !strings.HasPrefix(r.Path, "/") {
+			p.add(field+".path", "must start with /")
+		}
+		for _, method := range r.methods() {
+			if !headers.IsToken(method) || method != strings.ToUpper(method) {
+				p.add(field+".methods", "%q is not an uppercase method name", method)
+				continue
+			}
+			key := strings.ToLower(strings.TrimSuffix(r.Host, ".")) + " " + r.Path + " " + method
+			if prior, ok := seen[key]; ok {
+				p.add(field, "%s %s is already served by routes[%d]", method, r.Path, prior)
+			}
+			seen[key] = i
+		}
+
+		actions := 0
+		if r.Static != nil {
+			actions++
+			r.Static.validate(p, field+".static")
+			for _, method := range r.Methods {
+				if method != "GET" && method != "HEAD" {
+					p.add(field+".methods", "static files are only served to GET and HEAD, not %s", method)
+				}
+			}
+		}
+		if r.Proxy != nil {
+			actions++
+			if err := checkUpstream(r.Proxy.Upstream); err != nil {
+				p.add(field+".proxy.upstream", "%v", err)
+			}
+		}
+		if r.Redirect != nil {
+			actions++
+			if r.Redirect.To == "" {
+				p.add(field+".redirect.to", "is required")
+			} else if _, err := url.Parse(r.Redirect.To); err != nil {
+				p.add(field+".redirect.to", "%v", err)
+			}
+			if r.Redirect.Status != 0 && !slices.Contains(redirectStatuses, r.Redirect.Status) {
+				p.add(field+".redirect.status", "must be one of 301, 302, 303, 307 or 308, not %d", r.Redirect.Status)
+			}
+		}
+		if r.Respond != nil {
+			actions++
+			r.Respond.validate(p, field+".respond")
+		}
+		if r.Events != nil {
+			actions++
+			r.Events.validate(p, field+".events", streams)
+			for _, method := range r.Methods {
+				if method != "GET" && method != "HEAD" {
+					p.add(field+".methods", "event streams are only served to GET and HEAD, not %s", method)
+				}
+			}
+		}
+		if actions != 1 {
+			p.add(field, "needs exactly one of static, proxy, redirect, respond or events, found %d", actions)
+		}
+	}
+}
+
+// methods returns the methods the route is served for.
+func (r Route) methods() []string {
+	switch {
+	case len(r.Methods) > 0:
+		return r.Methods
+	case r.Proxy != nil:
+		return defaultProxyMethods
+	default:
+		return defaultMethods
+	}
+}
+
+func (s *Static) validate(p *problems, field string) {
+	if (s.Dir == "") == (s.File == "") {
+		p.add(field, "needs exactly one of dir or file")
+	}
+	if s.File != "" && s.Index != "" {
+		p.add(field+".index", "only applies to dir")
+	}
+	if strings.ContainsAny(s.Index, `/\`) {
+		p.add(field+".index", "must be a file name, not a path")
+	}
+}
+
+func (e *Events) validate(p *problems, field string, streams map[string]*Events) {
+	if e.Stream == "" {
+		p.add(field+".stream", "is required")
+	}
+	if e.Replay < 0 {
+		p.add(field+".replay", "must not be negative")
+	}
+	// Routes naming the same stream share one broker and its replay buffer.
+	if prior, ok := streams[e.Stream]; ok && prior.Replay != e.Replay {
+		p.add(field+".replay", "is %d for stream %q, another route sets %d", e.Replay, e.Stream, prior.Replay)
+	} else if !ok {
+		streams[e.Stream] = e
+	}
+}
+
+func (r *Respond) validate(p *problems, field string) {
+	if r.Status != 0 && (r.Status < 200 || r.Status > 599) {
+		p.add(field+".status", "must be between 200 and 599, not %d", r.Status)
+	}
+	for _, name := range slices.Sorted(maps.Keys(r.Headers)) {
+		value := r.Headers[name]
+		if !headers.IsToken(name) {
+			p.add(field+".headers", "%q is not a valid field name", name)
+		}
+		if strings.ContainsAny(value, "\r\n\x00") {
+			p.add(field+".headers", "the value of %s contains a line break", name)
+		}
+	}
+	if (r.Status == 204 || r.Status == 304) && r.Body != "" {
+		p.add(field+".body", "must be empty for status %d", r.Status)
+	}
+	if strings.ContainsAny(r.ContentType, "\r\n\x00") {
+		p.add(field+".content_type", "contains a line break")
+	}
+}
+
+func (c *Config) validateMiddleware(p *problems) {
+	m := c.Middleware
+	if m.CORS != nil {
+		if len(m.CORS.AllowedOrigins) == 0 && len(m.CORS.AllowedOriginPatterns) == 0 {
+			p.add("middleware.cors", "needs allowed_origins or allowed_origin_patterns")
+		}
+		if m.CORS.AllowCredentials && slices.Contains(m.CORS.AllowedOrigins, "*") {
+			p.add("middleware.cors", "allow_credentials cannot be used with \"*\"")
+		}
+		for _, pattern := range m.CORS.AllowedOriginPatterns {
+			if _, err := regexp.Compile(pattern); err != nil {
+				p.add("middleware.cors.allowed_origin_patterns", "%v", err)
+			}
+		}
+		if m.CORS.MaxAge < 0 {
+			p.add("middleware.cors.max_age", "must not be negative")
+		}
+	}
+	if m.RateLimit != nil {
+		if m.RateLimit.Rate <= 0 {
+			p.add("middleware.rate_limit.rate", "must be positive")
+		}
+		if m.RateLimit.Burst < 0 {
+			p.add("middleware.rate_limit.burst", "must not be negative")
+		}
+		if m.RateLimit.Header != "" && !headers.IsToken(m.RateLimit.Header) {
+			p.add("middleware.rate_limit.header", "%q is not a valid field name", m.RateLimit.Header)
+		}
+	}
+	if m.Auth != nil {
+		if (m.Auth.Htpasswd == "") == (m.Auth.JWT == nil) {
+			p.add("middleware.auth", "needs exactly one of htpasswd or jwt")
+		}
+		if m.Auth.JWT != nil && (m.Auth.JWT.SecretFile == "") == (m.Auth.JWT.PublicKeyFile == "") {
+			p.add("middleware.auth.jwt", "needs exactly one of secret_file or public_key_file")
+		}
+		if strings.ContainsAny(m.Auth.Realm, "\"\\\r\n") {
+			p.add("middleware.auth.realm", "must not contain quotes, backslashes or line breaks")
+		}
+	}
+	if m.Cache != nil && (m.Cache.MaxMemory < 0 || m.Cache.MaxEntrySize < 0) {
+		p.add("middleware.cache", "sizes must not be negative")
+	}
+}
+
+func (c *Config) validateLogging(p *problems) {
+	a := c.Logging.Access
+	if a == nil {
+		return
+	}
+	if _, err := accessFormat(a.Format); err != nil {
+		p.add("logging.access.format", "%v", err)
+	}
+	if a.MaxSize < 0 || a.MaxBackups < 0 {
+		p.add("logging.access", "max_size and max_backups must not be negative")
+	}
+	if (a.Path == "" || a.Path == "-") && (a.MaxSize > 0 || a.MaxBackups > 0) {
+		p.add("logging.access", "max_size and max_backups need a path")
+	}
+}
+
+func checkUpstream(upstream string) error {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("%q is not an absolute http or https URL", upstream)
+	}
+	return nil
+}
+
+// validHostPattern accepts an empty host, a host name or IP address and a
+// "*." wildcard in front of a domain.
+func validHostPattern(host string) bool {
+	if host == "" {
+		return true
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(strings.ToLower(host), "*."), ".")
+	if net.ParseIP(strings.Trim(host, "[]")) != nil {
+		return true
+	}
+	for label := range strings.SplitSeq(host, ".") {
+		if label == "" || strings.Trim(label, "abcdefghijklmnopqrstuvwxyz0123456789-") != "" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,177 @@
+package cookie
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/headers"
+	"github.com/ohrelaxo/httpfromtcp/internal/request"
+	"github.com/ohrelaxo/httpfromtcp/internal/response"
+)
+
+var (
+	ErrInvalidName   = errors.New("invalid cookie name")
+	ErrInvalidValue  = errors.New("invalid cookie value")
+	ErrInvalidDomain = errors.New("invalid cookie domain")
+	ErrInvalidPath   = errors.New("invalid cookie path")
+	ErrInsecure      = errors.New("cookie attribute requires Secure")
+)
+
+type SameSite int
+
+const (
+	// SameSiteDefault leaves the attribute out and the browser decides.
+	SameSiteDefault SameSite = iota
+	SameSiteLax
+	SameSiteStrict
+	SameSiteNone
+)
+
+// Cookie is a cookie sent with Set-Cookie, see RFC 6265 section 4.1.
+type Cookie struct {
+	Name  string
+	Value string
+
+	// Expires is left out when zero. MaxAge is left out when zero, a
+	// negative value deletes the cookie with Max-Age=0.
+	Expires time.Time
+	MaxAge  int
+
+	Domain      string
+	Path        string
+	Secure      bool
+	HttpOnly    bool
+	SameSite    SameSite
+	Partitioned bool
+}
+
+// expiresFormat is the IMF-fixdate format of RFC 9110 section 5.6.7.
+const expiresFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// Validate reports why c cannot be sent as a Set-Cookie value.
+func (c *Cookie) Validate() error {
+	if !headers.IsToken(c.Name) {
+		return fmt.Errorf("%w: %q", ErrInvalidName, c.Name)
+	}
+	if !validValue(c.Value) {
+		return fmt.Errorf("%w: %q", ErrInvalidValue, c.Value)
+	}
+	domain := strings.TrimPrefix(c.Domain, ".")
+	for i := 0; i < len(domain); i++ {
+		ch := domain[i]
+		if !(ch >= 'a' && ch <= 'z') && !(ch >= 'A' && ch <= 'Z') && !(ch >= '0' && ch <= '9') && ch != '-' && ch != '.' {
+			return fmt.Errorf("%w: %q", ErrInvalidDomain, c.Domain)
+		}
+	}
+	for i := 0; i < len(c.Path); i++ {
+		if ch := c.Path[i]; ch < 0x20 || ch == 0x7f || ch == ';' {
+			return fmt.Errorf("%w: %q", ErrInvalidPath, c.Path)
+		}
+	}
+	if c.SameSite == SameSiteNone && !c.Secure {
+		return fmt.Errorf("%w: SameSite=None", ErrInsecure)
+	}
+	if c.Partitioned && !c.Secure {
+		return fmt.Errorf("%w: Partitioned", ErrInsecure)
+	}
+	return nil
+}
+
+// String returns the Set-Cookie value of c. It does not validate c, use
+// Validate or Set for cookies built from untrusted input.
+func (c *Cookie) String() string {
+	var b strings.Builder
+	b.WriteString(c.Name + "=" + c.Value)
+	if !c.Expires.IsZero() {
+		b.WriteString("; Expires=" + c.Expires.UTC().Format(expiresFormat))
+	}
+	switch {
+	case c.MaxAge > 0:
+		b.WriteString("; Max-Age=" + strconv.Itoa(c.MaxAge))
+	case c.MaxAge < 0:
+		b.WriteString("; Max-Age=0")
+	}
+	if c.Domain != "" {
+		b.WriteString("; Domain=" + strings.TrimPrefix(c.Domain, "."))
+	}
+	if c.Path != "" {
+		b.WriteString("; Path=" + c.Path)
+	}
+	if c.Secure {
+		b.WriteString("; Secure")
+	}
+	if c.HttpOnly {
+		b.WriteString("; HttpOnly")
+	}
+	switch c.SameSite {
+	case SameSiteLax:
+		b.WriteString("; SameSite=Lax")
+	case SameSiteStrict:
+		b.WriteString("; SameSite=Strict")
+	case SameSiteNone:
+		b.WriteString("; SameSite=None")
+	}
+	if c.Partitioned {
+		b.WriteString("; Partitioned")
+	}
+	return b.String()
+}
+
+// Set validates c and adds it to the response as its own Set-Cookie line.
+func Set(w *response.Writer, c *Cookie) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	return w.AddHeaderLine("Set-Cookie", c.String())
+}
+
+// Cookies holds the cookies of a request by name. When a name repeats the
+// first one is kept, browsers send the one with the most specific path
+// first.
+type Cookies map[string]string
+
+// Get returns the value of the named cookie and whether it was sent.
+func (c Cookies) Get(name string) (string, bool) {
+	value, ok := c[name]
+	return value, ok
+}
+
+// Parse reads the cookie-pairs of a Cookie header. Pairs that do not match
+// the grammar are skipped. Commas separate pairs as well, since repeated
+// Cookie lines are joined with them.
+func Parse(header string) Cookies {
+	cookies := Cookies{}
+	for _, pair := range strings.FieldsFunc(header, func(r rune) bool { return r == ';' || r == ',' }) {
+		name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || !headers.IsToken(name) || !validValue(value) {
+			continue
+		}
+		if _, seen := cookies[name]; !seen {
+			cookies[name] = strings.Trim(value, `"`)
+		}
+	}
+	return cookies
+}
+
+// FromRequest parses the Cookie header of req.
+func FromRequest(req *request.Request) Cookies {
+	return Parse(req.Headers.Get("Cookie"))
+}
+
+// validValue checks the cookie-value production, cookie-octets that may be
+// wrapped in double quotes.
+func validValue(value string) bool {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c < 0x21 || c > 0x7e || c == '"' || c == ',' || c == ';' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
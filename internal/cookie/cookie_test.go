@@ -0,0 +1,74 @@
+package cookie
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	// Test: Several pairs in one header
+	cookies := Parse("session=abc123; theme=dark;lang=\"en\"")
+	assert.Equal(t, Cookies{"session": "abc123", "theme": "dark", "lang": "en"}, cookies)
+	value, ok := cookies.Get("theme")
+	assert.True(t, ok)
+	assert.Equal(t, "dark", value)
+	_, ok = cookies.Get("missing")
+	assert.False(t, ok)
+
+	// Test: Repeated names keep the first value
+	assert.Equal(t, "first", Parse("id=first; id=second")["id"])
+
+	// Test: Cookie lines joined with a comma
+	assert.Equal(t, Cookies{"a": "1", "b": "2"}, Parse("a=1, b=2"))
+
+	// Test: Malformed pairs are skipped
+	assert.Equal(t, Cookies{"ok": "1"}, Parse("novalue; bad name=1; ok=1; x=a b; =empty"))
+}
+
+func TestSetCookie(t *testing.T) {
+	// Test: Every attribute
+	c := &Cookie{
+		Name:        "session",
+		Value:       "abc123",
+		Expires:     time.Date(2026, 1, 2, 15, 4, 5, 0, time.FixedZone("CET", 3600)),
+		MaxAge:      3600,
+		Domain:      ".example.com",
+		Path:        "/app",
+		Secure:      true,
+		HttpOnly:    true,
+		SameSite:    SameSiteNone,
+		Partitioned: true,
+	}
+	require.NoError(t, c.Validate())
+	assert.Equal(t, "session=abc123; Expires=Fri, 02 Jan 2026 14:04:05 GMT; Max-Age=3600; Domain=example.com; Path=/app; Secure; HttpOnly; SameSite=None; Partitioned", c.String())
+
+	// Test: Negative MaxAge deletes the cookie
+	assert.Equal(t, "id=; Max-Age=0", (&Cookie{Name: "id", MaxAge: -1}).String())
+
+	// Test: Invalid cookies
+	require.ErrorIs(t, (&Cookie{Name: "bad name", Value: "1"}).Validate(), ErrInvalidName)
+	require.ErrorIs(t, (&Cookie{Name: "id", Value: "a;b"}).Validate(), ErrInvalidValue)
+	require.ErrorIs(t, (&Cookie{Name: "id", Domain: "exa mple.com"}).Validate(), ErrInvalidDomain)
+	require.ErrorIs(t, (&Cookie{Name: "id", Path: "/a;b"}).Validate(), ErrInvalidPath)
+	require.ErrorIs(t, (&Cookie{Name: "id", SameSite: SameSiteNone}).Validate(), ErrInsecure)
+	require.ErrorIs(t, (&Cookie{Name: "id", Partitioned: true}).Validate(), ErrInsecure)
+
+	// Test: Each cookie gets its own header line
+	var out bytes.Buffer
+	w := response.NewBufferedWriter(&out, 256)
+	require.NoError(t, Set(w, &Cookie{Name: "a", Value: "1", Path: "/"}))
+	require.NoError(t, Set(w, &Cookie{Name: "b", Value: "2", HttpOnly: true}))
+	require.Error(t, Set(w, &Cookie{Name: "c", Value: "a b"}))
+	_, err := w.Write([]byte("ok"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	assert.Contains(t, out.String(), "\r\nset-cookie: a=1; Path=/\r\nset-cookie: b=2; HttpOnly\r\n")
+	assert.Equal(t, 2, strings.Count(out.String(), "set-cookie"))
+	require.Error(t, w.AddHeaderLine("Set-Cookie", "late=1"))
+}
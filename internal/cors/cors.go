@@ -0,0 +1,155 @@
+package cors
+
+import (
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/request"
+	"github.com/ohrelaxo/httpfromtcp/internal/response"
+	"github.com/ohrelaxo/httpfromtcp/internal/server"
+)
+
+// Options configures which cross-origin requests browsers may make.
+type Options struct {
+	// AllowedOrigins lists origins such as "https://example.com". "*"
+	// allows every origin and one "*" inside an entry matches any
+	// subdomains, as in "https://*.example.com".
+	AllowedOrigins []string
+	// AllowedOriginPatterns are matched against the origin, anchor them
+	// with ^ and $ to match it as a whole.
+	AllowedOriginPatterns []*regexp.Regexp
+	// AllowedMethods defaults to GET, HEAD and POST.
+	AllowedMethods []string
+	// AllowedHeaders lists the request headers a preflight may ask for, "*"
+	// allows any.
+	AllowedHeaders []string
+	// ExposedHeaders lists the response headers scripts may read.
+	ExposedHeaders []string
+	// AllowCredentials lets requests carry cookies and Authorization. It
+	// cannot be combined with "*" in AllowedOrigins, that would let every
+	// site read credentialed responses.
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache a preflight result.
+	MaxAge time.Duration
+}
+
+// Middleware adds the CORS headers to responses for allowed origins and
+// answers preflight requests itself. It panics if AllowCredentials is set
+// with "*" in AllowedOrigins.
+func Middleware(opts Options) server.Middleware {
+	if len(opts.AllowedMethods) == 0 {
+		opts.AllowedMethods = []string{"GET", "HEAD", "POST"}
+	}
+	anyOrigin := slices.Contains(opts.AllowedOrigins, "*")
+	if anyOrigin && opts.AllowCredentials {
+		panic(`cors: AllowCredentials cannot be used with "*" in AllowedOrigins`)
+	}
+	anyHeader := slices.Contains(opts.AllowedHeaders, "*")
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			origin := req.Headers.Get("Origin")
+			requestMethod := req.Headers.Get("Access-Control-Request-Method")
+			preflight := req.RequestLine.Method == "OPTIONS" && requestMethod != ""
+
+			// Unless every origin gets "*", the response depends on the
+			// origin and caches must not serve it to another one.
+			if !anyOrigin {
+				w.AddHeaderLine("Vary", "Origin")
+			}
+			if preflight {
+				w.AddHeaderLine("Vary", "Access-Control-Request-Method, Access-Control-Request-Headers")
+			}
+			allowed := origin != "" && (anyOrigin || allowedOrigin(opts, origin))
+			if !allowed {
+				if preflight {
+					w.WriteHeader(response.NoContent)
+					return
+				}
+				next(w, req)
+				return
+			}
+
+			allowOrigin := origin
+			if anyOrigin {
+				allowOrigin = "*"
+			}
+			if !preflight {
+				w.AddHeaderLine("Access-Control-Allow-Origin", allowOrigin)
+				if opts.AllowCredentials {
+					w.AddHeaderLine("Access-Control-Allow-Credentials", "true")
+				}
+				if len(opts.ExposedHeaders) > 0 {
+					w.AddHeaderLine("Access-Control-Expose-Headers", strings.Join(opts.ExposedHeaders, ", "))
+				}
+				next(w, req)
+				return
+			}
+
+			requestHeaders := splitList(req.Headers.Get("Access-Control-Request-Headers"))
+			if !slices.Contains(opts.AllowedMethods, requestMethod) || !anyHeader && !allowedHeaders(opts.AllowedHeaders, requestHeaders) {
+				w.WriteHeader(response.NoContent)
+				return
+			}
+			w.AddHeaderLine("Access-Control-Allow-Origin", allowOrigin)
+			if opts.AllowCredentials {
+				w.AddHeaderLine("Access-Control-Allow-Credentials", "true")
+			}
+			w.AddHeaderLine("Access-Control-Allow-Methods", strings.Join(opts.AllowedMethods, ", "))
+			if len(requestHeaders) > 0 {
+				w.AddHeaderLine("Access-Control-Allow-Headers", strings.Join(requestHeaders, ", "))
+			}
+			if opts.MaxAge > 0 {
+				w.AddHeaderLine("Access-Control-Max-Age", strconv.Itoa(int(opts.MaxAge/time.Second)))
+			}
+			w.WriteHeader(response.NoContent)
+		}
+	}
+}
+
+func allowedOrigin(opts Options, origin string) bool {
+	for _, allowed := range opts.AllowedOrigins {
+		prefix, suffix, wildcard := strings.Cut(allowed, "*")
+		if !wildcard {
+			if strings.EqualFold(allowed, origin) {
+				return true
+			}
+			continue
+		}
+		lower := strings.ToLower(origin)
+		if len(lower) > len(prefix)+len(suffix) &&
+			strings.HasPrefix(lower, strings.ToLower(prefix)) &&
+			strings.HasSuffix(lower, strings.ToLower(suffix)) &&
+			!strings.Contains(lower[len(prefix):len(lower)-len(suffix)], "/") {
+			return true
+		}
+	}
+	for _, pattern := range opts.AllowedOriginPatterns {
+		if pattern.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func allowedHeaders(allowed, requested []string) bool {
+	for _, name := range requested {
+		if !slices.ContainsFunc(allowed, func(a string) bool { return strings.EqualFold(a, name) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// splitList splits a comma separated header value into lowercase elements.
+func splitList(value string) []string {
+	var list []string
+	for element := range strings.SplitSeq(value, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			list = append(list, strings.ToLower(element))
+		}
+	}
+	return list
+}
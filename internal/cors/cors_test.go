@@ -0,0 +1,86 @@
+package cors
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/request"
+	"github.com/ohrelaxo/httpfromtcp/internal/response"
+	"github.com/ohrelaxo/httpfromtcp/internal/server"
+	"github.com/ohrelaxo/httpfromtcp/internal/servertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func send(t *testing.T, opts Options, raw string) string {
+	t.Helper()
+	handler := func(w *response.Writer, req *request.Request) {
+		w.Write([]byte("handler"))
+	}
+	return servertest.Send(t, handler, raw, server.WithMiddleware(Middleware(opts)))
+}
+
+func TestMiddleware(t *testing.T) {
+	opts := Options{
+		AllowedOrigins:        []string{"https://app.example.com", "https://*.preview.example.com"},
+		AllowedOriginPatterns: []*regexp.Regexp{regexp.MustCompile(`^http://localhost:\d+$`)},
+		AllowedMethods:        []string{"GET", "PUT"},
+		AllowedHeaders:        []string{"Content-Type", "X-Request-Id"},
+		ExposedHeaders:        []string{"X-Total"},
+		AllowCredentials:      true,
+		MaxAge:                10 * time.Minute,
+	}
+	get := func(origin string) string {
+		return send(t, opts, "GET / HTTP/1.1\r\nHost: localhost\r\nOrigin: "+origin+"\r\n\r\n")
+	}
+
+	// Test: Exact, wildcard and pattern origins are echoed
+	for _, origin := range []string{"https://app.example.com", "https://pr-7.preview.example.com", "http://localhost:5173"} {
+		resp := get(origin)
+		assert.Contains(t, resp, "access-control-allow-origin: "+origin+"\r\n")
+		assert.Contains(t, resp, "access-control-allow-credentials: true\r\n")
+		assert.Contains(t, resp, "access-control-expose-headers: X-Total\r\n")
+		assert.Contains(t, resp, "vary: Origin\r\n")
+		assert.True(t, strings.HasSuffix(resp, "handler"), resp)
+	}
+
+	// Test: Other origins reach the handler without CORS headers
+	for _, origin := range []string{"https://evil.com", "https://preview.example.com", "https://x/.preview.example.com", "http://localhost:5173.evil.com"} {
+		resp := get(origin)
+		assert.NotContains(t, resp, "access-control-", origin)
+		assert.Contains(t, resp, "vary: Origin\r\n")
+		assert.True(t, strings.HasSuffix(resp, "handler"), resp)
+	}
+
+	// Test: A preflight is answered without running the handler
+	resp := send(t, opts, "OPTIONS /items HTTP/1.1\r\nHost: localhost\r\nOrigin: https://app.example.com\r\n"+
+		"Access-Control-Request-Method: PUT\r\nAccess-Control-Request-Headers: content-type, x-request-id\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 204 No Content\r\n"), resp)
+	assert.Contains(t, resp, "access-control-allow-origin: https://app.example.com\r\n")
+	assert.Contains(t, resp, "access-control-allow-methods: GET, PUT\r\n")
+	assert.Contains(t, resp, "access-control-allow-headers: content-type, x-request-id\r\n")
+	assert.Contains(t, resp, "access-control-max-age: 600\r\n")
+	assert.Contains(t, resp, "vary: Access-Control-Request-Method, Access-Control-Request-Headers\r\n")
+	assert.NotContains(t, resp, "handler")
+
+	// Test: Preflights for other methods or headers get no permission
+	for _, ask := range []string{"DELETE\r\n", "PUT\r\nAccess-Control-Request-Headers: x-secret\r\n"} {
+		resp = send(t, opts, "OPTIONS /items HTTP/1.1\r\nHost: localhost\r\nOrigin: https://app.example.com\r\nAccess-Control-Request-Method: "+ask+"\r\n")
+		assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 204 No Content\r\n"), resp)
+		assert.NotContains(t, resp, "access-control-allow-origin")
+	}
+
+	// Test: Any origin without credentials is answered with *
+	resp = send(t, Options{AllowedOrigins: []string{"*"}}, "GET / HTTP/1.1\r\nHost: localhost\r\nOrigin: https://a.test\r\n\r\n")
+	assert.Contains(t, resp, "access-control-allow-origin: *\r\n")
+	assert.NotContains(t, resp, "vary")
+
+	// Test: Any origin cannot be combined with credentials
+	assert.Panics(t, func() { Middleware(Options{AllowedOrigins: []string{"*"}, AllowCredentials: true}) })
+
+	// Test: Requests without Origin are untouched
+	resp = send(t, opts, "OPTIONS / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasSuffix(resp, "handler"), resp)
+	assert.NotContains(t, resp, "access-control-")
+}
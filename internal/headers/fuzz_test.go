@@ -0,0 +1,54 @@
+package headers
+
+import (
+	"testing"
+)
+
+func FuzzHeadersParse(f *testing.F) {
+	f.Add("Host: localhost:42069\r\n\r\n")
+	f.Add("       Host: localhost:42069                           \r\n\r\n")
+	f.Add("Content-Type:\t text/html \t\r\n")
+	f.Add("X-Obs: caf\xe9\n")
+	f.Add(" folded: value\r\n")
+	f.Add("Host : localhost\r\n")
+	f.Add("H©st: localhost\r\n")
+	f.Add("\r\n")
+	f.Add("a: b\rc\r\n")
+	f.Fuzz(func(t *testing.T, data string) {
+		for _, strict := range []bool{false, true} {
+			h := NewHeaders()
+			n, done, err := h.parse([]byte(data), strict)
+			if n < 0 || n > len(data) {
+				t.Fatalf("consumed %d of %d bytes", n, len(data))
+			}
+			if err != nil || n == 0 {
+				if n != 0 || done || len(h) != 0 {
+					t.Fatalf("incomplete parse returned n=%d done=%v headers=%v", n, done, h)
+				}
+				continue
+			}
+			if done {
+				if len(h) != 0 {
+					t.Fatalf("end of section added headers %v", h)
+				}
+				continue
+			}
+			if len(h) != 1 {
+				t.Fatalf("one field line produced %d headers", len(h))
+			}
+
+			// A parsed field must read back the same once written out.
+			for key, value := range h {
+				again := NewHeaders()
+				line := key + ": " + value + "\r\n"
+				m, _, err := again.parse([]byte(line), strict)
+				if err != nil || m != len(line) {
+					t.Fatalf("serialized field %q does not parse: n=%d err=%v", line, m, err)
+				}
+				if again[key] != value {
+					t.Fatalf("field %s changed: %q != %q", key, again[key], value)
+				}
+			}
+		}
+	})
+}
@@ -2,6 +2,7 @@ package headers
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"strings"
 )
@@ -12,36 +13,136 @@ func NewHeaders() Headers {
 
 type Headers map[string]string
 
-const crlf = "\r\n"
+var (
+	ErrLineEnding          = errors.New("bare CR or LF line ending")
+	ErrMalformedFieldLine  = errors.New("malformed field line")
+	ErrInvalidFieldName    = errors.New("invalid field name")
+	ErrInvalidFieldValue   = errors.New("invalid field value")
+	ErrObsoleteLineFolding = errors.New("obsolete line folding")
+)
 
-func (h Headers) Parse(data []byte) (n int, done bool, err error) {
-	idx := bytes.Index(data, []byte(crlf))
+// SplitLine returns the first line of data without its line ending and the
+// number of bytes used including the ending, n is 0 while the line is still
+// incomplete. In strict mode only CRLF ends a line, otherwise a bare LF is
+// accepted as well. A CR that does not end the line is always rejected.
+func SplitLine(data []byte, strict bool) (line []byte, n int, err error) {
+	idx := bytes.IndexByte(data, '\n')
 	if idx == -1 {
-		return 0, false, nil
+		if cr := bytes.IndexByte(data, '\r'); cr != -1 && cr < len(data)-1 {
+			return nil, 0, ErrLineEnding
+		}
+		return nil, 0, nil
 	}
-	if idx == 0 {
-		return 2, true, nil
+	line = data[:idx]
+	if bytes.HasSuffix(line, []byte("\r")) {
+		line = line[:len(line)-1]
+	} else if strict {
+		return nil, 0, ErrLineEnding
 	}
-	header := string(data[:idx])
+	if bytes.IndexByte(line, '\r') != -1 {
+		return nil, 0, ErrLineEnding
+	}
+	return line, idx + 1, nil
+}
 
-	trim := strings.Trim(header, " ")
-	parts := strings.SplitN(trim, ":", 2)
-	key := parts[0]
-	if ok := strings.HasSuffix(key, " "); ok {
-		return 0, false, fmt.Errorf("invalid header name: %s", key)
+// Parse reads a single field line from data. It is lenient about
+// whitespace around the field line and accepts bare LF line endings.
+func (h Headers) Parse(data []byte) (n int, done bool, err error) {
+	return h.parse(data, false)
+}
+
+// ParseStrict reads a single field line from data and rejects anything
+// that does not match the field-line production of RFC 9112 section 5.
+func (h Headers) ParseStrict(data []byte) (n int, done bool, err error) {
+	return h.parse(data, true)
+}
+
+func (h Headers) parse(data []byte, strict bool) (n int, done bool, err error) {
+	line, n, err := SplitLine(data, strict)
+	if err != nil || n == 0 {
+		return 0, false, err
+	}
+	if len(line) == 0 {
+		return n, true, nil
 	}
-	value, _ := strings.CutPrefix(parts[1], " ")
 
-	if h.Get(key) == "" {
-		err = h.Set(key, value)
-		if err != nil {
-			return 0, false, err
+	if strict && (line[0] == ' ' || line[0] == '\t') {
+		return 0, false, fmt.Errorf("%w: %q", ErrObsoleteLineFolding, line)
+	}
+	trim := bytes.Trim(line, " ")
+	colon := bytes.IndexByte(trim, ':')
+	if colon == -1 {
+		return 0, false, fmt.Errorf("%w: %q", ErrMalformedFieldLine, line)
+	}
+	key, value := trim[:colon], trim[colon+1:]
+	if len(key) == 0 || key[len(key)-1] == ' ' || key[len(key)-1] == '\t' {
+		return 0, false, fmt.Errorf("%w: %q", ErrInvalidFieldName, key)
+	}
+	if strict {
+		value = bytes.Trim(value, " \t")
+		if !isValidFieldValue(value) {
+			return 0, false, fmt.Errorf("%w: %q", ErrInvalidFieldValue, value)
+		}
+	} else {
+		value = bytes.TrimPrefix(value, []byte(" "))
+		if bytes.ContainsAny(value, "\x00\r\n") {
+			return 0, false, fmt.Errorf("%w: %q", ErrInvalidFieldValue, value)
 		}
+	}
+
+	name, ok := fieldName(key)
+	if !ok {
+		return 0, false, fmt.Errorf("%w: invalid header token found: %s", ErrInvalidFieldName, key)
+	}
+	// Empty values stay in the list, so a repeated framing field such as
+	// "Content-Length: 5" and "Content-Length:" is seen as conflicting.
+	if existing, ok := h[name]; ok {
+		h[name] = existing + ", " + string(value)
 	} else {
-		h.Put(key, value)
+		h[name] = string(value)
 	}
 
-	return idx + 2, false, nil
+	return n, false, nil
+}
+
+// commonNames interns the lowercase form of frequent field names so parsing
+// them does not allocate.
+var commonNames = map[string]string{}
+
+func init() {
+	for _, name := range []string{
+		"accept", "accept-encoding", "accept-language", "authorization",
+		"cache-control", "connection", "content-encoding", "content-length",
+		"content-type", "cookie", "expect", "host", "if-match",
+		"if-modified-since", "if-none-match", "origin", "range", "referer",
+		"te", "trailer", "transfer-encoding", "upgrade", "user-agent",
+		"x-forwarded-for", "x-forwarded-proto", "x-request-id",
+	} {
+		commonNames[name] = name
+	}
+}
+
+// fieldName validates a field name and returns its lowercase form, ok is
+// false if the name contains a character outside of tchar.
+func fieldName(key []byte) (string, bool) {
+	var stack [64]byte
+	lower := stack[:0]
+	if len(key) > len(stack) {
+		lower = make([]byte, 0, len(key))
+	}
+	for _, c := range key {
+		if !isValidHeaderChar(rune(c)) {
+			return "", false
+		}
+		if c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		lower = append(lower, c)
+	}
+	if name, ok := commonNames[string(lower)]; ok {
+		return name, true
+	}
+	return string(lower), true
 }
 
 func (h Headers) Set(key, value string) error {
@@ -49,7 +150,7 @@ func (h Headers) Set(key, value string) error {
 	for _, char := range lower {
 		ok := isValidHeaderChar(char)
 		if !ok {
-			return fmt.Errorf("invalid header token found: %s", key)
+			return fmt.Errorf("%w: invalid header token found: %s", ErrInvalidFieldName, key)
 		}
 	}
 	h[lower] = value
@@ -64,12 +165,48 @@ func isValidHeaderChar(c rune) bool {
 	return strings.ContainsRune(specialChars, c)
 }
 
+// IsToken reports whether s is a non-empty token, the grammar used for
+// field names and request methods.
+func IsToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, char := range s {
+		if !isValidHeaderChar(char) {
+			return false
+		}
+	}
+	return true
+}
+
+// isValidFieldValue checks the field-value production: visible characters,
+// obs-text and SP or HTAB between them, but no other control characters.
+func isValidFieldValue(value []byte) bool {
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c == ' ' || c == '\t' || c >= 0x80 {
+			continue
+		}
+		if c < 0x21 || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
 func (h Headers) Get(key string) (value string) {
 	return h[strings.ToLower(key)]
 }
 
+// Put appends value to the field's existing values, or sets it if there
+// are none. An empty value is kept as an empty list member.
 func (h Headers) Put(key, value string) {
-	h[strings.ToLower(key)] = h[strings.ToLower(key)] + ", " + value
+	key = strings.ToLower(key)
+	if existing, ok := h[key]; ok {
+		h[key] = existing + ", " + value
+		return
+	}
+	h[key] = value
 }
 
 func (h Headers) Delete(key string) {
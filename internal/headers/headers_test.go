@@ -76,3 +76,67 @@ func TestHeadersParse(t *testing.T) {
 	assert.Equal(t, 23, n)
 	assert.False(t, done)
 }
+
+func TestHeadersParseStrict(t *testing.T) {
+	// Test: Valid header with optional whitespace around the value
+	headers := NewHeaders()
+	data := []byte("Host: \tlocalhost:42069 \r\n\r\n")
+	n, done, err := headers.ParseStrict(data)
+	require.NoError(t, err)
+	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, 25, n)
+	assert.False(t, done)
+
+	// Test: Missing colon is an error in both modes
+	headers = NewHeaders()
+	data = []byte("Host localhost\r\n\r\n")
+	_, _, err = headers.Parse(data)
+	require.ErrorIs(t, err, ErrMalformedFieldLine)
+	_, _, err = headers.ParseStrict(data)
+	require.ErrorIs(t, err, ErrMalformedFieldLine)
+
+	// Test: Leading whitespace is obsolete line folding
+	headers = NewHeaders()
+	data = []byte("       Host: localhost:42069\r\n\r\n")
+	_, _, err = headers.ParseStrict(data)
+	require.ErrorIs(t, err, ErrObsoleteLineFolding)
+
+	// Test: Control characters in the value
+	headers = NewHeaders()
+	data = []byte("X-Test: a\x00b\r\n\r\n")
+	_, _, err = headers.ParseStrict(data)
+	require.ErrorIs(t, err, ErrInvalidFieldValue)
+	_, _, err = headers.Parse(data)
+	require.ErrorIs(t, err, ErrInvalidFieldValue)
+	data = []byte("X-Test: a\x7fb\r\n\r\n")
+	_, _, err = headers.ParseStrict(data)
+	require.ErrorIs(t, err, ErrInvalidFieldValue)
+
+	// Test: obs-text is allowed in values
+	headers = NewHeaders()
+	data = []byte("X-Test: caf\xe9\r\n\r\n")
+	_, _, err = headers.ParseStrict(data)
+	require.NoError(t, err)
+	assert.Equal(t, "caf\xe9", headers["x-test"])
+
+	// Test: Empty field name
+	headers = NewHeaders()
+	data = []byte(": value\r\n\r\n")
+	_, _, err = headers.ParseStrict(data)
+	require.ErrorIs(t, err, ErrInvalidFieldName)
+
+	// Test: Bare LF
+	headers = NewHeaders()
+	data = []byte("Host: localhost:42069\n\n")
+	_, _, err = headers.ParseStrict(data)
+	require.ErrorIs(t, err, ErrLineEnding)
+	n, _, err = headers.Parse(data)
+	require.NoError(t, err)
+	assert.Equal(t, 22, n)
+
+	// Test: Bare CR inside a line
+	headers = NewHeaders()
+	data = []byte("Host: local\rhost\r\n\r\n")
+	_, _, err = headers.Parse(data)
+	require.ErrorIs(t, err, ErrLineEnding)
+}
@@ -0,0 +1,283 @@
+package http2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ClientPreface is the fixed sequence every client sends before its first
+// frame, see RFC 9113 section 3.4.
+const ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+const (
+	frameHeaderLen      = 9
+	defaultMaxFrameSize = 16384
+	maxAllowedFrameSize = 1<<24 - 1
+	defaultWindowSize   = 65535
+	maxWindowSize       = 1<<31 - 1
+)
+
+type FrameType uint8
+
+const (
+	FrameData         FrameType = 0x0
+	FrameHeaders      FrameType = 0x1
+	FramePriority     FrameType = 0x2
+	FrameRSTStream    FrameType = 0x3
+	FrameSettings     FrameType = 0x4
+	FramePushPromise  FrameType = 0x5
+	FramePing         FrameType = 0x6
+	FrameGoAway       FrameType = 0x7
+	FrameWindowUpdate FrameType = 0x8
+	FrameContinuation FrameType = 0x9
+)
+
+func (t FrameType) String() string {
+	names := map[FrameType]string{
+		FrameData:         "DATA",
+		FrameHeaders:      "HEADERS",
+		FramePriority:     "PRIORITY",
+		FrameRSTStream:    "RST_STREAM",
+		FrameSettings:     "SETTINGS",
+		FramePushPromise:  "PUSH_PROMISE",
+		FramePing:         "PING",
+		FrameGoAway:       "GOAWAY",
+		FrameWindowUpdate: "WINDOW_UPDATE",
+		FrameContinuation: "CONTINUATION",
+	}
+	if name, ok := names[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN_FRAME_TYPE_%d", uint8(t))
+}
+
+type Flags uint8
+
+const (
+	FlagEndStream  Flags = 0x1
+	FlagAck        Flags = 0x1
+	FlagEndHeaders Flags = 0x4
+	FlagPadded     Flags = 0x8
+	FlagPriority   Flags = 0x20
+)
+
+func (f Flags) Has(flag Flags) bool {
+	return f&flag == flag
+}
+
+type ErrCode uint32
+
+const (
+	ErrCodeNo                 ErrCode = 0x0
+	ErrCodeProtocol           ErrCode = 0x1
+	ErrCodeInternal           ErrCode = 0x2
+	ErrCodeFlowControl        ErrCode = 0x3
+	ErrCodeSettingsTimeout    ErrCode = 0x4
+	ErrCodeStreamClosed       ErrCode = 0x5
+	ErrCodeFrameSize          ErrCode = 0x6
+	ErrCodeRefusedStream      ErrCode = 0x7
+	ErrCodeCancel             ErrCode = 0x8
+	ErrCodeCompression        ErrCode = 0x9
+	ErrCodeConnect            ErrCode = 0xa
+	ErrCodeEnhanceYourCalm    ErrCode = 0xb
+	ErrCodeInadequateSecurity ErrCode = 0xc
+	ErrCodeHTTP11Required     ErrCode = 0xd
+)
+
+func (c ErrCode) String() string {
+	names := []string{
+		"NO_ERROR", "PROTOCOL_ERROR", "INTERNAL_ERROR", "FLOW_CONTROL_ERROR",
+		"SETTINGS_TIMEOUT", "STREAM_CLOSED", "FRAME_SIZE_ERROR", "REFUSED_STREAM",
+		"CANCEL", "COMPRESSION_ERROR", "CONNECT_ERROR", "ENHANCE_YOUR_CALM",
+		"INADEQUATE_SECURITY", "HTTP_1_1_REQUIRED",
+	}
+	if int(c) < len(names) {
+		return names[c]
+	}
+	return fmt.Sprintf("UNKNOWN_ERROR_%d", uint32(c))
+}
+
+// ConnError is a connection error, it ends the connection with a GOAWAY.
+type ConnError struct {
+	Code   ErrCode
+	Reason string
+}
+
+func (e ConnError) Error() string {
+	return fmt.Sprintf("http2: connection error %v: %s", e.Code, e.Reason)
+}
+
+// StreamError only ends the stream it occurred on with a RST_STREAM.
+type StreamError struct {
+	StreamID uint32
+	Code     ErrCode
+	Reason   string
+}
+
+func (e StreamError) Error() string {
+	return fmt.Sprintf("http2: stream %d error %v: %s", e.StreamID, e.Code, e.Reason)
+}
+
+type SettingID uint16
+
+const (
+	SettingHeaderTableSize      SettingID = 0x1
+	SettingEnablePush           SettingID = 0x2
+	SettingMaxConcurrentStreams SettingID = 0x3
+	SettingInitialWindowSize    SettingID = 0x4
+	SettingMaxFrameSize         SettingID = 0x5
+	SettingMaxHeaderListSize    SettingID = 0x6
+)
+
+type Setting struct {
+	ID    SettingID
+	Value uint32
+}
+
+// Frame is a raw frame. Payload has padding removed for DATA and HEADERS
+// frames, everything else is left for the typed parse helpers below.
+type Frame struct {
+	// Length is the payload length from the frame header, including any
+	// padding, which is what flow control accounts for.
+	Length   uint32
+	Type     FrameType
+	Flags    Flags
+	StreamID uint32
+	Payload  []byte
+}
+
+var ErrFrameTooLarge = errors.New("http2: frame exceeds the maximum frame size")
+
+// ReadFrame reads a single frame. Frames with a payload over maxSize are
+// rejected before the payload is read.
+func ReadFrame(r io.Reader, maxSize uint32) (Frame, error) {
+	var header [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return Frame{}, err
+	}
+	length := uint32(header[0])<<16 | uint32(header[1])<<8 | uint32(header[2])
+	f := Frame{
+		Length:   length,
+		Type:     FrameType(header[3]),
+		Flags:    Flags(header[4]),
+		StreamID: binary.BigEndian.Uint32(header[5:]) & (1<<31 - 1),
+	}
+	if length > maxSize {
+		return f, ErrFrameTooLarge
+	}
+	f.Payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		return f, err
+	}
+	if f.Type == FrameData || f.Type == FrameHeaders {
+		if err := f.removePadding(); err != nil {
+			return f, err
+		}
+	}
+	return f, nil
+}
+
+func (f *Frame) removePadding() error {
+	if !f.Flags.Has(FlagPadded) {
+		return nil
+	}
+	if len(f.Payload) == 0 {
+		return ConnError{ErrCodeFrameSize, "padded frame without pad length"}
+	}
+	padLen := int(f.Payload[0])
+	if padLen >= len(f.Payload) {
+		return ConnError{ErrCodeProtocol, "padding exceeds frame payload"}
+	}
+	f.Payload = f.Payload[1 : len(f.Payload)-padLen]
+	f.Flags &^= FlagPadded
+	return nil
+}
+
+// WriteFrame writes f in a single Write call.
+func WriteFrame(w io.Writer, f Frame) error {
+	buf := make([]byte, frameHeaderLen+len(f.Payload))
+	length := len(f.Payload)
+	buf[0] = byte(length >> 16)
+	buf[1] = byte(length >> 8)
+	buf[2] = byte(length)
+	buf[3] = byte(f.Type)
+	buf[4] = byte(f.Flags)
+	binary.BigEndian.PutUint32(buf[5:], f.StreamID&(1<<31-1))
+	copy(buf[frameHeaderLen:], f.Payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+// HeaderBlockFragment returns the header block of a HEADERS frame without
+// the optional priority fields.
+func (f Frame) HeaderBlockFragment() ([]byte, error) {
+	if !f.Flags.Has(FlagPriority) {
+		return f.Payload, nil
+	}
+	if len(f.Payload) < 5 {
+		return nil, ConnError{ErrCodeFrameSize, "HEADERS frame too short for priority"}
+	}
+	return f.Payload[5:], nil
+}
+
+func SettingsPayload(settings ...Setting) []byte {
+	payload := make([]byte, 0, 6*len(settings))
+	for _, s := range settings {
+		payload = binary.BigEndian.AppendUint16(payload, uint16(s.ID))
+		payload = binary.BigEndian.AppendUint32(payload, s.Value)
+	}
+	return payload
+}
+
+func ParseSettings(payload []byte) ([]Setting, error) {
+	if len(payload)%6 != 0 {
+		return nil, ConnError{ErrCodeFrameSize, "SETTINGS payload is not a multiple of 6"}
+	}
+	settings := make([]Setting, 0, len(payload)/6)
+	for i := 0; i < len(payload); i += 6 {
+		settings = append(settings, Setting{
+			ID:    SettingID(binary.BigEndian.Uint16(payload[i:])),
+			Value: binary.BigEndian.Uint32(payload[i+2:]),
+		})
+	}
+	return settings, nil
+}
+
+func WindowUpdatePayload(increment uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, increment&(1<<31-1))
+}
+
+func ParseWindowUpdate(payload []byte) (uint32, error) {
+	if len(payload) != 4 {
+		return 0, ConnError{ErrCodeFrameSize, "WINDOW_UPDATE payload must be 4 bytes"}
+	}
+	return binary.BigEndian.Uint32(payload) & (1<<31 - 1), nil
+}
+
+func RSTStreamPayload(code ErrCode) []byte {
+	return binary.BigEndian.AppendUint32(nil, uint32(code))
+}
+
+func ParseRSTStream(payload []byte) (ErrCode, error) {
+	if len(payload) != 4 {
+		return 0, ConnError{ErrCodeFrameSize, "RST_STREAM payload must be 4 bytes"}
+	}
+	return ErrCode(binary.BigEndian.Uint32(payload)), nil
+}
+
+func GoAwayPayload(lastStreamID uint32, code ErrCode, debug string) []byte {
+	payload := binary.BigEndian.AppendUint32(nil, lastStreamID&(1<<31-1))
+	payload = binary.BigEndian.AppendUint32(payload, uint32(code))
+	return append(payload, debug...)
+}
+
+func ParseGoAway(payload []byte) (lastStreamID uint32, code ErrCode, debug string, err error) {
+	if len(payload) < 8 {
+		return 0, 0, "", ConnError{ErrCodeFrameSize, "GOAWAY payload too short"}
+	}
+	lastStreamID = binary.BigEndian.Uint32(payload) & (1<<31 - 1)
+	code = ErrCode(binary.BigEndian.Uint32(payload[4:]))
+	return lastStreamID, code, string(payload[8:]), nil
+}
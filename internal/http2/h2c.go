@@ -0,0 +1,71 @@
+package http2
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/request"
+)
+
+// IsUpgradeRequest reports whether req asks to switch to HTTP/2 cleartext
+// with "Upgrade: h2c" as described in RFC 7540 section 3.2.
+func IsUpgradeRequest(req *request.Request) bool {
+	if _, ok := req.Headers["http2-settings"]; !ok {
+		return false
+	}
+	return hasToken(req.Headers.Get("Upgrade"), "h2c") &&
+		hasToken(req.Headers.Get("Connection"), "upgrade") &&
+		hasToken(req.Headers.Get("Connection"), "http2-settings")
+}
+
+func hasToken(list, token string) bool {
+	for _, part := range strings.Split(list, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeUpgrade answers an h2c upgrade request with 101 Switching Protocols
+// and serves the connection as HTTP/2. The upgrade request itself becomes
+// stream 1 and is answered over HTTP/2.
+func ServeUpgrade(ctx context.Context, rw io.ReadWriter, req *request.Request, handler Handler, opts Options) error {
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(req.Headers.Get("HTTP2-Settings"), "="))
+	if err != nil {
+		return fmt.Errorf("http2: invalid HTTP2-Settings header: %w", err)
+	}
+	settings, err := ParseSettings(payload)
+	if err != nil {
+		return fmt.Errorf("http2: invalid HTTP2-Settings header: %w", err)
+	}
+
+	sc := newServerConn(ctx, rw, handler, opts)
+	if err := sc.applySettings(settings); err != nil {
+		return err
+	}
+	_, err = io.WriteString(rw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+	if err != nil {
+		return err
+	}
+
+	for _, name := range []string{"Connection", "Upgrade", "HTTP2-Settings", "Keep-Alive", "Proxy-Connection"} {
+		req.Headers.Delete(name)
+	}
+	req.RequestLine.HttpVersion = "2"
+	st := sc.newStream(1, streamHalfClosedRemote, req)
+	st.sendWindow = sc.peerInitialWindow
+	sc.streams[1] = st
+	sc.lastStreamID = 1
+
+	// The server connection preface has to be the first thing sent after
+	// the 101 response, so the handler only starts once SETTINGS is out.
+	sc.onSettingsSent = func() {
+		sc.handlers.Add(1)
+		go sc.runHandler(st)
+	}
+	return sc.serve()
+}
@@ -0,0 +1,404 @@
+package http2
+
+import (
+	"errors"
+	"fmt"
+)
+
+// HeaderField is a single name/value pair of an HPACK header list.
+// Sensitive fields are never added to the dynamic table by either side.
+type HeaderField struct {
+	Name      string
+	Value     string
+	Sensitive bool
+}
+
+func (f HeaderField) size() uint32 {
+	return uint32(len(f.Name) + len(f.Value) + 32)
+}
+
+const defaultHeaderTableSize = 4096
+
+var (
+	ErrHpackIndex     = errors.New("hpack: invalid table index")
+	ErrHpackInteger   = errors.New("hpack: integer overflow")
+	ErrHpackTruncated = errors.New("hpack: truncated header block")
+	ErrHpackTableSize = errors.New("hpack: invalid dynamic table size update")
+	ErrHpackTooLarge  = errors.New("hpack: header list too large")
+)
+
+var staticTable = [...]HeaderField{
+	{Name: ":authority"},
+	{Name: ":method", Value: "GET"},
+	{Name: ":method", Value: "POST"},
+	{Name: ":path", Value: "/"},
+	{Name: ":path", Value: "/index.html"},
+	{Name: ":scheme", Value: "http"},
+	{Name: ":scheme", Value: "https"},
+	{Name: ":status", Value: "200"},
+	{Name: ":status", Value: "204"},
+	{Name: ":status", Value: "206"},
+	{Name: ":status", Value: "304"},
+	{Name: ":status", Value: "400"},
+	{Name: ":status", Value: "404"},
+	{Name: ":status", Value: "500"},
+	{Name: "accept-charset"},
+	{Name: "accept-encoding", Value: "gzip, deflate"},
+	{Name: "accept-language"},
+	{Name: "accept-ranges"},
+	{Name: "accept"},
+	{Name: "access-control-allow-origin"},
+	{Name: "age"},
+	{Name: "allow"},
+	{Name: "authorization"},
+	{Name: "cache-control"},
+	{Name: "content-disposition"},
+	{Name: "content-encoding"},
+	{Name: "content-language"},
+	{Name: "content-length"},
+	{Name: "content-location"},
+	{Name: "content-range"},
+	{Name: "content-type"},
+	{Name: "cookie"},
+	{Name: "date"},
+	{Name: "etag"},
+	{Name: "expect"},
+	{Name: "expires"},
+	{Name: "from"},
+	{Name: "host"},
+	{Name: "if-match"},
+	{Name: "if-modified-since"},
+	{Name: "if-none-match"},
+	{Name: "if-range"},
+	{Name: "if-unmodified-since"},
+	{Name: "last-modified"},
+	{Name: "link"},
+	{Name: "location"},
+	{Name: "max-forwards"},
+	{Name: "proxy-authenticate"},
+	{Name: "proxy-authorization"},
+	{Name: "range"},
+	{Name: "referer"},
+	{Name: "refresh"},
+	{Name: "retry-after"},
+	{Name: "server"},
+	{Name: "set-cookie"},
+	{Name: "strict-transport-security"},
+	{Name: "transfer-encoding"},
+	{Name: "user-agent"},
+	{Name: "vary"},
+	{Name: "via"},
+	{Name: "www-authenticate"},
+}
+
+// dynamicTable is the FIFO table of RFC 7541 section 2.3.2. The newest
+// entry is at the end of the slice and has the lowest index.
+type dynamicTable struct {
+	entries []HeaderField
+	size    uint32
+	maxSize uint32
+}
+
+func (t *dynamicTable) add(f HeaderField) {
+	t.entries = append(t.entries, f)
+	t.size += f.size()
+	t.evict()
+}
+
+func (t *dynamicTable) setMaxSize(n uint32) {
+	t.maxSize = n
+	t.evict()
+}
+
+func (t *dynamicTable) evict() {
+	drop := 0
+	for t.size > t.maxSize && drop < len(t.entries) {
+		t.size -= t.entries[drop].size()
+		drop++
+	}
+	if drop > 0 {
+		t.entries = append(t.entries[:0], t.entries[drop:]...)
+	}
+}
+
+// at returns the field for a combined static and dynamic index, starting at 1.
+func (t *dynamicTable) at(index uint64) (HeaderField, bool) {
+	if index == 0 {
+		return HeaderField{}, false
+	}
+	if index <= uint64(len(staticTable)) {
+		return staticTable[index-1], true
+	}
+	index -= uint64(len(staticTable))
+	if index > uint64(len(t.entries)) {
+		return HeaderField{}, false
+	}
+	return t.entries[uint64(len(t.entries))-index], true
+}
+
+// search returns the best index for f. exact reports whether the value
+// matched as well as the name; an index of 0 means no match at all.
+func (t *dynamicTable) search(f HeaderField) (index uint64, exact bool) {
+	for i, e := range staticTable {
+		if e.Name != f.Name {
+			continue
+		}
+		if index == 0 {
+			index = uint64(i + 1)
+		}
+		if e.Value == f.Value {
+			return uint64(i + 1), true
+		}
+	}
+	for i := len(t.entries) - 1; i >= 0; i-- {
+		e := t.entries[i]
+		if e.Name != f.Name {
+			continue
+		}
+		dynIndex := uint64(len(staticTable) + len(t.entries) - i)
+		if index == 0 {
+			index = dynIndex
+		}
+		if e.Value == f.Value {
+			return dynIndex, true
+		}
+	}
+	return index, false
+}
+
+// Decoder decodes HPACK header blocks. A Decoder holds the dynamic table of
+// one direction of a connection, so every block must be passed in order.
+type Decoder struct {
+	table dynamicTable
+	// allowedMaxSize is the SETTINGS_HEADER_TABLE_SIZE we advertised and the
+	// upper bound for size updates sent by the encoder.
+	allowedMaxSize uint32
+	// MaxHeaderListSize bounds the decoded size of a single block, 0 means no limit.
+	MaxHeaderListSize uint32
+}
+
+func NewDecoder(maxTableSize uint32) *Decoder {
+	return &Decoder{
+		table:          dynamicTable{maxSize: maxTableSize},
+		allowedMaxSize: maxTableSize,
+	}
+}
+
+// Decode decodes one complete header block.
+func (d *Decoder) Decode(block []byte) ([]HeaderField, error) {
+	var fields []HeaderField
+	var listSize uint32
+	sawField := false
+	for len(block) > 0 {
+		b := block[0]
+		var (
+			f   HeaderField
+			err error
+		)
+		switch {
+		case b&0x80 != 0:
+			var index uint64
+			index, block, err = decodeInteger(block, 7)
+			if err != nil {
+				return nil, err
+			}
+			var ok bool
+			f, ok = d.table.at(index)
+			if !ok {
+				return nil, fmt.Errorf("%w: %d", ErrHpackIndex, index)
+			}
+		case b&0xc0 == 0x40:
+			f, block, err = d.decodeLiteral(block, 6)
+			if err != nil {
+				return nil, err
+			}
+			d.table.add(f)
+		case b&0xe0 == 0x20:
+			if sawField {
+				return nil, fmt.Errorf("%w: update after header field", ErrHpackTableSize)
+			}
+			var size uint64
+			size, block, err = decodeInteger(block, 5)
+			if err != nil {
+				return nil, err
+			}
+			if size > uint64(d.allowedMaxSize) {
+				return nil, fmt.Errorf("%w: %d exceeds %d", ErrHpackTableSize, size, d.allowedMaxSize)
+			}
+			d.table.setMaxSize(uint32(size))
+			continue
+		default:
+			// Literal without indexing (0000) or never indexed (0001).
+			f, block, err = d.decodeLiteral(block, 4)
+			if err != nil {
+				return nil, err
+			}
+			f.Sensitive = b&0x10 != 0
+		}
+		sawField = true
+		listSize += f.size()
+		if d.MaxHeaderListSize != 0 && listSize > d.MaxHeaderListSize {
+			return nil, ErrHpackTooLarge
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+func (d *Decoder) decodeLiteral(block []byte, prefix uint8) (HeaderField, []byte, error) {
+	var f HeaderField
+	index, rest, err := decodeInteger(block, prefix)
+	if err != nil {
+		return f, nil, err
+	}
+	if index == 0 {
+		f.Name, rest, err = decodeString(rest)
+		if err != nil {
+			return f, nil, err
+		}
+	} else {
+		indexed, ok := d.table.at(index)
+		if !ok {
+			return f, nil, fmt.Errorf("%w: %d", ErrHpackIndex, index)
+		}
+		f.Name = indexed.Name
+	}
+	f.Value, rest, err = decodeString(rest)
+	if err != nil {
+		return f, nil, err
+	}
+	return f, rest, nil
+}
+
+func decodeInteger(data []byte, prefix uint8) (uint64, []byte, error) {
+	if len(data) == 0 {
+		return 0, nil, ErrHpackTruncated
+	}
+	max := uint64(1)<<prefix - 1
+	value := uint64(data[0]) & max
+	data = data[1:]
+	if value < max {
+		return value, data, nil
+	}
+	shift := uint(0)
+	for {
+		if len(data) == 0 {
+			return 0, nil, ErrHpackTruncated
+		}
+		b := data[0]
+		data = data[1:]
+		if shift > 56 {
+			return 0, nil, ErrHpackInteger
+		}
+		value += uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return value, data, nil
+		}
+		shift += 7
+	}
+}
+
+func decodeString(data []byte) (string, []byte, error) {
+	if len(data) == 0 {
+		return "", nil, ErrHpackTruncated
+	}
+	huffman := data[0]&0x80 != 0
+	length, rest, err := decodeInteger(data, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if uint64(len(rest)) < length {
+		return "", nil, ErrHpackTruncated
+	}
+	raw := rest[:length]
+	rest = rest[length:]
+	if !huffman {
+		return string(raw), rest, nil
+	}
+	decoded, err := huffmanDecode(make([]byte, 0, len(raw)*8/5), raw)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(decoded), rest, nil
+}
+
+// Encoder encodes header lists into HPACK header blocks.
+type Encoder struct {
+	table dynamicTable
+	// pendingUpdate and minSize record table size changes that have to be
+	// announced at the start of the next block.
+	pendingUpdate bool
+	minSize       uint32
+}
+
+func NewEncoder() *Encoder {
+	return &Encoder{table: dynamicTable{maxSize: defaultHeaderTableSize}}
+}
+
+// SetMaxDynamicTableSize applies the decoder's SETTINGS_HEADER_TABLE_SIZE.
+func (e *Encoder) SetMaxDynamicTableSize(n uint32) {
+	if !e.pendingUpdate || n < e.minSize {
+		e.minSize = n
+	}
+	e.pendingUpdate = true
+	e.table.setMaxSize(n)
+}
+
+// Encode appends the header block for fields to dst.
+func (e *Encoder) Encode(dst []byte, fields []HeaderField) []byte {
+	if e.pendingUpdate {
+		if e.minSize < e.table.maxSize {
+			dst = appendInteger(dst, 0x20, 5, uint64(e.minSize))
+		}
+		dst = appendInteger(dst, 0x20, 5, uint64(e.table.maxSize))
+		e.pendingUpdate = false
+	}
+	for _, f := range fields {
+		index, exact := e.table.search(f)
+		switch {
+		case exact && !f.Sensitive:
+			dst = appendInteger(dst, 0x80, 7, index)
+		case f.Sensitive:
+			dst = appendInteger(dst, 0x10, 4, index)
+			dst = e.appendLiteral(dst, index, f)
+		case f.size() > e.table.maxSize:
+			dst = appendInteger(dst, 0x00, 4, index)
+			dst = e.appendLiteral(dst, index, f)
+		default:
+			dst = appendInteger(dst, 0x40, 6, index)
+			dst = e.appendLiteral(dst, index, f)
+			e.table.add(f)
+		}
+	}
+	return dst
+}
+
+func (e *Encoder) appendLiteral(dst []byte, index uint64, f HeaderField) []byte {
+	if index == 0 {
+		dst = appendString(dst, f.Name)
+	}
+	return appendString(dst, f.Value)
+}
+
+func appendInteger(dst []byte, flags byte, prefix uint8, value uint64) []byte {
+	max := uint64(1)<<prefix - 1
+	if value < max {
+		return append(dst, flags|byte(value))
+	}
+	dst = append(dst, flags|byte(max))
+	value -= max
+	for value >= 0x80 {
+		dst = append(dst, byte(value&0x7f)|0x80)
+		value >>= 7
+	}
+	return append(dst, byte(value))
+}
+
+func appendString(dst []byte, s string) []byte {
+	if n := huffmanEncodedLen(s); n < len(s) {
+		dst = appendInteger(dst, 0x80, 7, uint64(n))
+		return huffmanEncode(dst, s)
+	}
+	dst = appendInteger(dst, 0x00, 7, uint64(len(s)))
+	return append(dst, s...)
+}
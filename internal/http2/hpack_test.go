@@ -0,0 +1,112 @@
+package http2
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	require.NoError(t, err)
+	return b
+}
+
+func TestHpackDecode(t *testing.T) {
+	// Test: RFC 7541 C.3, requests without Huffman coding sharing one table
+	decoder := NewDecoder(defaultHeaderTableSize)
+	fields, err := decoder.Decode(mustHex(t, "828684410f7777772e6578616d706c652e636f6d"))
+	require.NoError(t, err)
+	assert.Equal(t, []HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/"},
+		{Name: ":authority", Value: "www.example.com"},
+	}, fields)
+	fields, err = decoder.Decode(mustHex(t, "828684be58086e6f2d6361636865"))
+	require.NoError(t, err)
+	assert.Equal(t, HeaderField{Name: ":authority", Value: "www.example.com"}, fields[3])
+	assert.Equal(t, HeaderField{Name: "cache-control", Value: "no-cache"}, fields[4])
+	fields, err = decoder.Decode(mustHex(t, "828785bf400a637573746f6d2d6b65790c637573746f6d2d76616c7565"))
+	require.NoError(t, err)
+	assert.Equal(t, HeaderField{Name: ":scheme", Value: "https"}, fields[1])
+	assert.Equal(t, HeaderField{Name: ":path", Value: "/index.html"}, fields[2])
+	assert.Equal(t, HeaderField{Name: "custom-key", Value: "custom-value"}, fields[4])
+	assert.Equal(t, uint32(164), decoder.table.size)
+
+	// Test: RFC 7541 C.4, the same requests with Huffman coding
+	decoder = NewDecoder(defaultHeaderTableSize)
+	fields, err = decoder.Decode(mustHex(t, "828684418cf1e3c2e5f23a6ba0ab90f4ff"))
+	require.NoError(t, err)
+	assert.Equal(t, HeaderField{Name: ":authority", Value: "www.example.com"}, fields[3])
+	fields, err = decoder.Decode(mustHex(t, "828684be5886a8eb10649cbf"))
+	require.NoError(t, err)
+	assert.Equal(t, HeaderField{Name: "cache-control", Value: "no-cache"}, fields[4])
+	fields, err = decoder.Decode(mustHex(t, "828785bf408825a849e95ba97d7f8925a849e95bb8e8b4bf"))
+	require.NoError(t, err)
+	assert.Equal(t, HeaderField{Name: "custom-key", Value: "custom-value"}, fields[4])
+
+	// Test: Never indexed literal keeps the sensitive flag
+	decoder = NewDecoder(defaultHeaderTableSize)
+	fields, err = decoder.Decode(mustHex(t, "100870617373776f726406736563726574"))
+	require.NoError(t, err)
+	assert.Equal(t, []HeaderField{{Name: "password", Value: "secret", Sensitive: true}}, fields)
+	assert.Empty(t, decoder.table.entries)
+
+	// Test: Index out of range
+	decoder = NewDecoder(defaultHeaderTableSize)
+	_, err = decoder.Decode([]byte{0xff, 0x00})
+	require.ErrorIs(t, err, ErrHpackIndex)
+
+	// Test: Table size update above the advertised maximum
+	decoder = NewDecoder(defaultHeaderTableSize)
+	_, err = decoder.Decode(appendInteger(nil, 0x20, 5, 8192))
+	require.ErrorIs(t, err, ErrHpackTableSize)
+
+	// Test: Truncated string literal
+	decoder = NewDecoder(defaultHeaderTableSize)
+	_, err = decoder.Decode(mustHex(t, "400a637573"))
+	require.ErrorIs(t, err, ErrHpackTruncated)
+
+	// Test: Huffman padding that is not all ones
+	_, err = huffmanDecode(nil, []byte{0xf1, 0xe3, 0xc2, 0xe5, 0xf2, 0x3a, 0x6b, 0xa0, 0xab, 0x90, 0xf4, 0xfe})
+	require.ErrorIs(t, err, ErrInvalidHuffman)
+}
+
+func TestHpackEncode(t *testing.T) {
+	// Test: Encoder output matches RFC 7541 C.4.1
+	encoder := NewEncoder()
+	block := encoder.Encode(nil, []HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/"},
+		{Name: ":authority", Value: "www.example.com"},
+	})
+	assert.Equal(t, "828684418cf1e3c2e5f23a6ba0ab90f4ff", hex.EncodeToString(block))
+
+	// Test: Round trip through the dynamic table
+	encoder = NewEncoder()
+	decoder := NewDecoder(defaultHeaderTableSize)
+	fields := []HeaderField{
+		{Name: ":status", Value: "200"},
+		{Name: "content-type", Value: "text/html"},
+		{Name: "x-custom", Value: "some value with UPPER and \x7f bytes"},
+		{Name: "authorization", Value: "secret", Sensitive: true},
+	}
+	for range 3 {
+		decoded, err := decoder.Decode(encoder.Encode(nil, fields))
+		require.NoError(t, err)
+		assert.Equal(t, fields, decoded)
+	}
+	assert.Len(t, encoder.table.entries, 2)
+
+	// Test: Shrinking the table is announced to the decoder
+	encoder.SetMaxDynamicTableSize(0)
+	decoded, err := decoder.Decode(encoder.Encode(nil, fields))
+	require.NoError(t, err)
+	assert.Equal(t, fields, decoded)
+	assert.Empty(t, decoder.table.entries)
+}
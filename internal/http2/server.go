@@ -0,0 +1,655 @@
+package http2
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/request"
+	"github.com/ohrelaxo/httpfromtcp/internal/response"
+)
+
+// Handler has the same shape as server.Handler, every stream is served by
+// one call with a Request built from the stream's HEADERS and DATA frames.
+type Handler func(w *response.Writer, req *request.Request)
+
+// Options configures an HTTP/2 connection.
+type Options struct {
+	// MaxBodyBytes bounds the request body of each stream, zero selects
+	// request.DefaultMaxBodyBytes. A stream that sends more is answered
+	// with 413 and reset.
+	MaxBodyBytes int
+}
+
+const (
+	maxConcurrentStreams = 100
+	maxHeaderListSize    = 1 << 20
+)
+
+type streamState int
+
+const (
+	streamOpen streamState = iota
+	streamHalfClosedRemote
+	streamClosed
+)
+
+type stream struct {
+	id    uint32
+	state streamState
+	// reset is set once either side sent RST_STREAM, pending writes fail.
+	reset bool
+
+	recvWindow int64
+	sendWindow int64
+
+	req    *request.Request
+	cancel context.CancelFunc
+}
+
+type serverConn struct {
+	rw      io.ReadWriter
+	handler Handler
+	decoder *Decoder
+	// ctx is the parent of every stream context, it is cancelled when the
+	// connection ends.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// wmu serialises frame writes and guards the encoder, so header blocks
+	// are never interleaved with other frames.
+	wmu     sync.Mutex
+	encoder *Encoder
+
+	mu                sync.Mutex
+	cond              *sync.Cond
+	streams           map[uint32]*stream
+	lastStreamID      uint32
+	sendWindow        int64
+	recvWindow        int64
+	peerInitialWindow int64
+	peerMaxFrameSize  uint32
+	goingAway         bool
+	closed            bool
+
+	// headerStream is the stream whose header block is still waiting for
+	// CONTINUATION frames, 0 if none.
+	headerStream    uint32
+	headerBlock     []byte
+	headerEndStream bool
+
+	// remoteAddr is copied into every request when rw is a connection.
+	remoteAddr   string
+	maxBodyBytes int
+
+	handlers sync.WaitGroup
+	// onSettingsSent runs once the server preface is written, h2c uses it
+	// to start the handler for the upgrade request.
+	onSettingsSent func()
+}
+
+func newServerConn(ctx context.Context, rw io.ReadWriter, handler Handler, opts Options) *serverConn {
+	if opts.MaxBodyBytes <= 0 {
+		opts.MaxBodyBytes = request.DefaultMaxBodyBytes
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	sc := &serverConn{
+		ctx:               ctx,
+		cancel:            cancel,
+		rw:                rw,
+		handler:           handler,
+		decoder:           NewDecoder(defaultHeaderTableSize),
+		encoder:           NewEncoder(),
+		streams:           make(map[uint32]*stream),
+		sendWindow:        defaultWindowSize,
+		recvWindow:        defaultWindowSize,
+		peerInitialWindow: defaultWindowSize,
+		peerMaxFrameSize:  defaultMaxFrameSize,
+		maxBodyBytes:      opts.MaxBodyBytes,
+	}
+	sc.decoder.MaxHeaderListSize = maxHeaderListSize
+	if conn, ok := rw.(interface{ RemoteAddr() net.Addr }); ok {
+		sc.remoteAddr = conn.RemoteAddr().String()
+	}
+	sc.cond = sync.NewCond(&sc.mu)
+	return sc
+}
+
+// ServeConn serves HTTP/2 with prior knowledge on rw, the client preface
+// has not been consumed yet. It returns once the connection is finished.
+func ServeConn(ctx context.Context, rw io.ReadWriter, handler Handler, opts Options) error {
+	sc := newServerConn(ctx, rw, handler, opts)
+	return sc.serve()
+}
+
+func (sc *serverConn) serve() error {
+	err := sc.writeFrame(Frame{Type: FrameSettings, Payload: SettingsPayload(
+		Setting{SettingMaxConcurrentStreams, maxConcurrentStreams},
+		Setting{SettingMaxHeaderListSize, maxHeaderListSize},
+	)})
+	if err != nil {
+		return err
+	}
+	if sc.onSettingsSent != nil {
+		sc.onSettingsSent()
+	}
+
+	preface := make([]byte, len(ClientPreface))
+	if _, err := io.ReadFull(sc.rw, preface); err != nil {
+		return err
+	}
+	if !bytes.Equal(preface, []byte(ClientPreface)) {
+		return sc.goAway(ConnError{ErrCodeProtocol, "invalid client preface"})
+	}
+
+	first := true
+	for {
+		f, err := ReadFrame(sc.rw, defaultMaxFrameSize)
+		if err == nil && first && (f.Type != FrameSettings || f.Flags.Has(FlagAck)) {
+			err = ConnError{ErrCodeProtocol, "first frame must be SETTINGS"}
+		}
+		first = false
+		if err == nil {
+			err = sc.processFrame(f)
+		}
+
+		var streamErr StreamError
+		var connErr ConnError
+		switch {
+		case err == nil:
+		case errors.As(err, &streamErr):
+			sc.resetStream(streamErr)
+		case errors.Is(err, ErrFrameTooLarge):
+			return sc.goAway(ConnError{ErrCodeFrameSize, err.Error()})
+		case errors.As(err, &connErr):
+			return sc.goAway(connErr)
+		case errors.Is(err, io.EOF):
+			// The client may only have closed its side, give running
+			// handlers the chance to finish their responses.
+			sc.handlers.Wait()
+			sc.shutdown()
+			return nil
+		default:
+			sc.shutdown()
+			return err
+		}
+	}
+}
+
+func (sc *serverConn) shutdown() {
+	sc.mu.Lock()
+	sc.closed = true
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+	sc.cancel()
+}
+
+func (sc *serverConn) goAway(connErr ConnError) error {
+	sc.mu.Lock()
+	lastStreamID := sc.lastStreamID
+	sc.mu.Unlock()
+	log.Printf("http2: closing connection: %v", connErr)
+	err := sc.writeFrame(Frame{Type: FrameGoAway, Payload: GoAwayPayload(lastStreamID, connErr.Code, connErr.Reason)})
+	sc.shutdown()
+	if err != nil {
+		return err
+	}
+	return connErr
+}
+
+func (sc *serverConn) resetStream(streamErr StreamError) {
+	sc.mu.Lock()
+	if st, ok := sc.streams[streamErr.StreamID]; ok {
+		st.reset = true
+		sc.closeStreamLocked(st)
+	}
+	sc.mu.Unlock()
+	sc.writeFrame(Frame{Type: FrameRSTStream, StreamID: streamErr.StreamID, Payload: RSTStreamPayload(streamErr.Code)})
+}
+
+func (sc *serverConn) closeStreamLocked(st *stream) {
+	if st.reset {
+		st.cancel()
+	}
+	st.state = streamClosed
+	delete(sc.streams, st.id)
+	sc.cond.Broadcast()
+}
+
+func (sc *serverConn) writeFrame(f Frame) error {
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	return WriteFrame(sc.rw, f)
+}
+
+func (sc *serverConn) processFrame(f Frame) error {
+	if sc.headerStream != 0 && (f.Type != FrameContinuation || f.StreamID != sc.headerStream) {
+		return ConnError{ErrCodeProtocol, fmt.Sprintf("expected CONTINUATION for stream %d, got %v", sc.headerStream, f.Type)}
+	}
+
+	switch f.Type {
+	case FrameSettings:
+		return sc.processSettings(f)
+	case FramePing:
+		if f.StreamID != 0 {
+			return ConnError{ErrCodeProtocol, "PING on a stream"}
+		}
+		if len(f.Payload) != 8 {
+			return ConnError{ErrCodeFrameSize, "PING payload must be 8 bytes"}
+		}
+		if f.Flags.Has(FlagAck) {
+			return nil
+		}
+		return sc.writeFrame(Frame{Type: FramePing, Flags: FlagAck, Payload: f.Payload})
+	case FrameGoAway:
+		if f.StreamID != 0 {
+			return ConnError{ErrCodeProtocol, "GOAWAY on a stream"}
+		}
+		if _, _, _, err := ParseGoAway(f.Payload); err != nil {
+			return err
+		}
+		sc.mu.Lock()
+		sc.goingAway = true
+		sc.mu.Unlock()
+		return nil
+	case FrameWindowUpdate:
+		return sc.processWindowUpdate(f)
+	case FrameRSTStream:
+		if f.StreamID == 0 {
+			return ConnError{ErrCodeProtocol, "RST_STREAM on stream 0"}
+		}
+		if _, err := ParseRSTStream(f.Payload); err != nil {
+			return err
+		}
+		sc.mu.Lock()
+		defer sc.mu.Unlock()
+		if f.StreamID > sc.lastStreamID {
+			return ConnError{ErrCodeProtocol, "RST_STREAM on idle stream"}
+		}
+		if st, ok := sc.streams[f.StreamID]; ok {
+			st.reset = true
+			sc.closeStreamLocked(st)
+		}
+		return nil
+	case FramePriority:
+		if f.StreamID == 0 {
+			return ConnError{ErrCodeProtocol, "PRIORITY on stream 0"}
+		}
+		if len(f.Payload) != 5 {
+			return StreamError{f.StreamID, ErrCodeFrameSize, "PRIORITY payload must be 5 bytes"}
+		}
+		return nil
+	case FramePushPromise:
+		return ConnError{ErrCodeProtocol, "clients cannot push"}
+	case FrameHeaders:
+		if f.StreamID == 0 || f.StreamID%2 == 0 {
+			return ConnError{ErrCodeProtocol, fmt.Sprintf("HEADERS on invalid stream %d", f.StreamID)}
+		}
+		fragment, err := f.HeaderBlockFragment()
+		if err != nil {
+			return err
+		}
+		sc.headerBlock = append(sc.headerBlock[:0], fragment...)
+		sc.headerEndStream = f.Flags.Has(FlagEndStream)
+		if !f.Flags.Has(FlagEndHeaders) {
+			sc.headerStream = f.StreamID
+			return nil
+		}
+		return sc.processHeaderBlock(f.StreamID)
+	case FrameContinuation:
+		if sc.headerStream == 0 {
+			return ConnError{ErrCodeProtocol, "unexpected CONTINUATION"}
+		}
+		sc.headerBlock = append(sc.headerBlock, f.Payload...)
+		if len(sc.headerBlock) > maxHeaderListSize {
+			return ConnError{ErrCodeEnhanceYourCalm, "header block too large"}
+		}
+		if !f.Flags.Has(FlagEndHeaders) {
+			return nil
+		}
+		sc.headerStream = 0
+		return sc.processHeaderBlock(f.StreamID)
+	case FrameData:
+		return sc.processData(f)
+	default:
+		// Unknown frame types must be ignored.
+		return nil
+	}
+}
+
+func (sc *serverConn) processSettings(f Frame) error {
+	if f.StreamID != 0 {
+		return ConnError{ErrCodeProtocol, "SETTINGS on a stream"}
+	}
+	if f.Flags.Has(FlagAck) {
+		if len(f.Payload) != 0 {
+			return ConnError{ErrCodeFrameSize, "SETTINGS ACK with payload"}
+		}
+		return nil
+	}
+	settings, err := ParseSettings(f.Payload)
+	if err != nil {
+		return err
+	}
+	if err := sc.applySettings(settings); err != nil {
+		return err
+	}
+	return sc.writeFrame(Frame{Type: FrameSettings, Flags: FlagAck})
+}
+
+func (sc *serverConn) applySettings(settings []Setting) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for _, s := range settings {
+		switch s.ID {
+		case SettingHeaderTableSize:
+			sc.wmu.Lock()
+			sc.encoder.SetMaxDynamicTableSize(min(s.Value, defaultHeaderTableSize))
+			sc.wmu.Unlock()
+		case SettingEnablePush:
+			if s.Value > 1 {
+				return ConnError{ErrCodeProtocol, "invalid SETTINGS_ENABLE_PUSH"}
+			}
+		case SettingInitialWindowSize:
+			if s.Value > maxWindowSize {
+				return ConnError{ErrCodeFlowControl, "SETTINGS_INITIAL_WINDOW_SIZE too large"}
+			}
+			delta := int64(s.Value) - sc.peerInitialWindow
+			sc.peerInitialWindow = int64(s.Value)
+			for _, st := range sc.streams {
+				st.sendWindow += delta
+				if st.sendWindow > maxWindowSize {
+					return ConnError{ErrCodeFlowControl, "stream window overflow"}
+				}
+			}
+			sc.cond.Broadcast()
+		case SettingMaxFrameSize:
+			if s.Value < defaultMaxFrameSize || s.Value > maxAllowedFrameSize {
+				return ConnError{ErrCodeProtocol, "invalid SETTINGS_MAX_FRAME_SIZE"}
+			}
+			sc.peerMaxFrameSize = s.Value
+		}
+	}
+	return nil
+}
+
+func (sc *serverConn) processWindowUpdate(f Frame) error {
+	increment, err := ParseWindowUpdate(f.Payload)
+	if err != nil {
+		return err
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if f.StreamID == 0 {
+		if increment == 0 {
+			return ConnError{ErrCodeProtocol, "WINDOW_UPDATE with zero increment"}
+		}
+		sc.sendWindow += int64(increment)
+		if sc.sendWindow > maxWindowSize {
+			return ConnError{ErrCodeFlowControl, "connection window overflow"}
+		}
+		sc.cond.Broadcast()
+		return nil
+	}
+	if f.StreamID > sc.lastStreamID {
+		return ConnError{ErrCodeProtocol, "WINDOW_UPDATE on idle stream"}
+	}
+	st, ok := sc.streams[f.StreamID]
+	if !ok {
+		return nil
+	}
+	if increment == 0 {
+		return StreamError{f.StreamID, ErrCodeProtocol, "WINDOW_UPDATE with zero increment"}
+	}
+	st.sendWindow += int64(increment)
+	if st.sendWindow > maxWindowSize {
+		return StreamError{f.StreamID, ErrCodeFlowControl, "stream window overflow"}
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) processHeaderBlock(id uint32) error {
+	// The block has to be decoded even for refused streams to keep the
+	// HPACK state in sync with the client.
+	fields, err := sc.decoder.Decode(sc.headerBlock)
+	if err != nil {
+		return ConnError{ErrCodeCompression, err.Error()}
+	}
+	endStream := sc.headerEndStream
+
+	sc.mu.Lock()
+	if st, ok := sc.streams[id]; ok {
+		sc.mu.Unlock()
+		return sc.processTrailers(st, fields, endStream)
+	}
+	if id <= sc.lastStreamID {
+		sc.mu.Unlock()
+		return ConnError{ErrCodeStreamClosed, fmt.Sprintf("HEADERS on closed stream %d", id)}
+	}
+	sc.lastStreamID = id
+	if sc.goingAway || len(sc.streams) >= maxConcurrentStreams {
+		sc.mu.Unlock()
+		return StreamError{id, ErrCodeRefusedStream, "stream refused"}
+	}
+	sc.mu.Unlock()
+
+	req, err := requestFromFields(fields)
+	if err != nil {
+		return StreamError{id, ErrCodeProtocol, err.Error()}
+	}
+	st := sc.newStream(id, streamOpen, req)
+	sc.mu.Lock()
+	st.sendWindow = sc.peerInitialWindow
+	sc.streams[id] = st
+	sc.mu.Unlock()
+
+	if endStream {
+		return sc.endRequest(st)
+	}
+	return nil
+}
+
+func (sc *serverConn) processTrailers(st *stream, fields []HeaderField, endStream bool) error {
+	sc.mu.Lock()
+	open := st.state == streamOpen
+	sc.mu.Unlock()
+	if !open {
+		return StreamError{st.id, ErrCodeStreamClosed, "HEADERS on half-closed stream"}
+	}
+	if !endStream {
+		return StreamError{st.id, ErrCodeProtocol, "trailers without END_STREAM"}
+	}
+	if err := addTrailerFields(st.req, fields); err != nil {
+		return StreamError{st.id, ErrCodeProtocol, err.Error()}
+	}
+	return sc.endRequest(st)
+}
+
+func (sc *serverConn) processData(f Frame) error {
+	if f.StreamID == 0 {
+		return ConnError{ErrCodeProtocol, "DATA on stream 0"}
+	}
+	if int64(f.Length) > sc.recvWindow {
+		return ConnError{ErrCodeFlowControl, "connection window exceeded"}
+	}
+	sc.mu.Lock()
+	if f.StreamID > sc.lastStreamID {
+		sc.mu.Unlock()
+		return ConnError{ErrCodeProtocol, "DATA on idle stream"}
+	}
+	st, ok := sc.streams[f.StreamID]
+	open := ok && st.state == streamOpen
+	sc.mu.Unlock()
+
+	// Bodies are buffered in full before the handler runs, so the windows
+	// are credited back as soon as the data has been received.
+	if f.Length > 0 {
+		sc.recvWindow -= int64(f.Length)
+		if err := sc.writeFrame(Frame{Type: FrameWindowUpdate, Payload: WindowUpdatePayload(f.Length)}); err != nil {
+			return err
+		}
+		sc.recvWindow += int64(f.Length)
+	}
+	if !open {
+		return StreamError{f.StreamID, ErrCodeStreamClosed, "DATA on closed stream"}
+	}
+	if int64(f.Length) > st.recvWindow {
+		return StreamError{f.StreamID, ErrCodeFlowControl, "stream window exceeded"}
+	}
+	if len(st.req.Body)+len(f.Payload) > sc.maxBodyBytes {
+		// The response is complete before the request, RFC 9113 section
+		// 8.1 lets the stream be reset with NO_ERROR then.
+		sc.writeHeaders(st, []HeaderField{{Name: ":status", Value: "413"}, {Name: "content-length", Value: "0"}}, true)
+		st.cancel()
+		return StreamError{f.StreamID, ErrCodeNo, "request body too large"}
+	}
+	st.req.Body = append(st.req.Body, f.Payload...)
+
+	if f.Flags.Has(FlagEndStream) {
+		return sc.endRequest(st)
+	}
+	if f.Length > 0 {
+		st.recvWindow -= int64(f.Length)
+		if err := sc.writeFrame(Frame{Type: FrameWindowUpdate, StreamID: f.StreamID, Payload: WindowUpdatePayload(f.Length)}); err != nil {
+			return err
+		}
+		st.recvWindow += int64(f.Length)
+	}
+	return nil
+}
+
+// endRequest is called once the client half-closed the stream and starts
+// the handler for it.
+func (sc *serverConn) endRequest(st *stream) error {
+	if err := checkContentLength(st.req); err != nil {
+		return StreamError{st.id, ErrCodeProtocol, err.Error()}
+	}
+	sc.mu.Lock()
+	st.state = streamHalfClosedRemote
+	sc.mu.Unlock()
+
+	sc.handlers.Add(1)
+	go sc.runHandler(st)
+	return nil
+}
+
+// newStream creates a stream whose request context ends with the stream.
+func (sc *serverConn) newStream(id uint32, state streamState, req *request.Request) *stream {
+	ctx, cancel := context.WithCancel(sc.ctx)
+	req = req.WithContext(ctx)
+	if sc.remoteAddr != "" {
+		req.RemoteAddr = sc.remoteAddr
+	}
+	return &stream{
+		id:         id,
+		state:      state,
+		recvWindow: defaultWindowSize,
+		req:        req,
+		cancel:     cancel,
+	}
+}
+
+func (sc *serverConn) runHandler(st *stream) {
+	defer sc.handlers.Done()
+	defer st.cancel()
+	rs := &responseStream{sc: sc, st: st, remaining: -1}
+	w := response.NewBufferedWriter(rs, response.DefaultBufferSize)
+	if st.req.RequestLine.Method == "HEAD" {
+		rs.head = true
+		w.OmitBody()
+	}
+	sc.handler(w, st.req)
+	if unfinished := w.Unfinished(); unfinished != "" {
+		log.Printf("http2: handler for %s %s left the response unfinished: %s", st.req.RequestLine.Method, st.req.RequestLine.RequestTarget, unfinished)
+	}
+	if err := w.Close(); err != nil && rs.err == nil {
+		rs.err = err
+	}
+	rs.finish()
+}
+
+// writeHeaders encodes fields and writes them as one HEADERS frame followed
+// by as many CONTINUATION frames as the peer's frame size requires.
+func (sc *serverConn) writeHeaders(st *stream, fields []HeaderField, endStream bool) error {
+	sc.mu.Lock()
+	if err := sc.streamWritableLocked(st); err != nil {
+		sc.mu.Unlock()
+		return err
+	}
+	maxFrame := int(sc.peerMaxFrameSize)
+	if endStream {
+		sc.closeStreamLocked(st)
+	}
+	sc.mu.Unlock()
+
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	block := sc.encoder.Encode(nil, fields)
+	frameType := FrameHeaders
+	for first := true; first || len(block) > 0; first = false {
+		chunk := block[:min(len(block), maxFrame)]
+		block = block[len(chunk):]
+		var flags Flags
+		if first && endStream {
+			flags |= FlagEndStream
+		}
+		if len(block) == 0 {
+			flags |= FlagEndHeaders
+		}
+		if err := WriteFrame(sc.rw, Frame{Type: frameType, Flags: flags, StreamID: st.id, Payload: chunk}); err != nil {
+			return err
+		}
+		frameType = FrameContinuation
+	}
+	return nil
+}
+
+// writeData sends p as DATA frames, blocking while the stream or the
+// connection has no send window left.
+func (sc *serverConn) writeData(st *stream, p []byte, endStream bool) error {
+	for {
+		sc.mu.Lock()
+		for len(p) > 0 && (st.sendWindow <= 0 || sc.sendWindow <= 0) && sc.streamWritableLocked(st) == nil {
+			sc.cond.Wait()
+		}
+		if err := sc.streamWritableLocked(st); err != nil {
+			sc.mu.Unlock()
+			return err
+		}
+		n := min(int64(len(p)), st.sendWindow, sc.sendWindow, int64(sc.peerMaxFrameSize))
+		st.sendWindow -= n
+		sc.sendWindow -= n
+		last := int(n) == len(p)
+		if last && endStream {
+			sc.closeStreamLocked(st)
+		}
+		sc.mu.Unlock()
+
+		var flags Flags
+		if last && endStream {
+			flags = FlagEndStream
+		}
+		if err := sc.writeFrame(Frame{Type: FrameData, Flags: flags, StreamID: st.id, Payload: p[:n]}); err != nil {
+			return err
+		}
+		p = p[n:]
+		if last {
+			return nil
+		}
+	}
+}
+
+var errStreamClosed = errors.New("http2: stream closed")
+
+func (sc *serverConn) streamWritableLocked(st *stream) error {
+	if sc.closed || st.reset || st.state == streamClosed {
+		return errStreamClosed
+	}
+	return nil
+}
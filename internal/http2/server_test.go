@@ -0,0 +1,383 @@
+package http2
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/headers"
+	"github.com/ohrelaxo/httpfromtcp/internal/request"
+	"github.com/ohrelaxo/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testClient is a minimal HTTP/2 client that speaks to the server over a
+// loopback connection, one frame at a time.
+type testClient struct {
+	t       *testing.T
+	conn    net.Conn
+	encoder *Encoder
+	decoder *Decoder
+}
+
+type testResponse struct {
+	fields   []HeaderField
+	body     []byte
+	trailers []HeaderField
+}
+
+func (r testResponse) get(name string) string {
+	for _, f := range r.fields {
+		if f.Name == name {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+func serveTestConn(t *testing.T, serve func(net.Conn)) net.Conn {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		conn, err := listener.Accept()
+		listener.Close()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		serve(conn)
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func newTestClient(t *testing.T, handler Handler, settings ...Setting) *testClient {
+	t.Helper()
+	conn := serveTestConn(t, func(conn net.Conn) { ServeConn(context.Background(), conn, handler, Options{MaxBodyBytes: 1 << 10}) })
+	c := &testClient{t: t, conn: conn, encoder: NewEncoder(), decoder: NewDecoder(defaultHeaderTableSize)}
+	_, err := io.WriteString(conn, ClientPreface)
+	require.NoError(t, err)
+	c.writeFrame(Frame{Type: FrameSettings, Payload: SettingsPayload(settings...)})
+
+	f := c.readFrame()
+	require.Equal(t, FrameSettings, f.Type)
+	require.False(t, f.Flags.Has(FlagAck))
+	c.writeFrame(Frame{Type: FrameSettings, Flags: FlagAck})
+	f = c.readFrame()
+	require.Equal(t, FrameSettings, f.Type)
+	require.True(t, f.Flags.Has(FlagAck))
+	return c
+}
+
+func (c *testClient) writeFrame(f Frame) {
+	c.t.Helper()
+	require.NoError(c.t, WriteFrame(c.conn, f))
+}
+
+func (c *testClient) readFrame() Frame {
+	c.t.Helper()
+	f, err := ReadFrame(c.conn, maxAllowedFrameSize)
+	require.NoError(c.t, err)
+	return f
+}
+
+func (c *testClient) writeHeaders(id uint32, endStream bool, fields ...HeaderField) {
+	c.t.Helper()
+	flags := FlagEndHeaders
+	if endStream {
+		flags |= FlagEndStream
+	}
+	c.writeFrame(Frame{Type: FrameHeaders, Flags: flags, StreamID: id, Payload: c.encoder.Encode(nil, fields)})
+}
+
+func requestFields(method, path string) []HeaderField {
+	return []HeaderField{
+		{Name: ":method", Value: method},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: path},
+		{Name: ":authority", Value: "localhost:42069"},
+	}
+}
+
+// readResponses reads frames until every stream in ids has ended and
+// returns the responses by stream.
+func (c *testClient) readResponses(ids ...uint32) map[uint32]*testResponse {
+	c.t.Helper()
+	responses := map[uint32]*testResponse{}
+	pending := map[uint32]bool{}
+	for _, id := range ids {
+		responses[id] = &testResponse{}
+		pending[id] = true
+	}
+	for len(pending) > 0 {
+		f := c.readFrame()
+		switch f.Type {
+		case FrameHeaders:
+			fields, err := c.decoder.Decode(f.Payload)
+			require.NoError(c.t, err)
+			resp := responses[f.StreamID]
+			if resp.fields == nil {
+				resp.fields = fields
+			} else {
+				resp.trailers = fields
+			}
+		case FrameData:
+			responses[f.StreamID].body = append(responses[f.StreamID].body, f.Payload...)
+			if f.Length > 0 {
+				c.writeFrame(Frame{Type: FrameWindowUpdate, Payload: WindowUpdatePayload(f.Length)})
+				c.writeFrame(Frame{Type: FrameWindowUpdate, StreamID: f.StreamID, Payload: WindowUpdatePayload(f.Length)})
+			}
+		case FrameRSTStream:
+			code, _ := ParseRSTStream(f.Payload)
+			c.t.Fatalf("stream %d reset: %v", f.StreamID, code)
+		case FrameGoAway:
+			_, code, debug, _ := ParseGoAway(f.Payload)
+			c.t.Fatalf("connection closed: %v %s", code, debug)
+		}
+		if (f.Type == FrameHeaders || f.Type == FrameData) && f.Flags.Has(FlagEndStream) {
+			delete(pending, f.StreamID)
+		}
+	}
+	return responses
+}
+
+func textHandler(w *response.Writer, req *request.Request) {
+	body := fmt.Sprintf("%s %s %s", req.RequestLine.Method, req.RequestLine.RequestTarget, req.Headers.Get("Host"))
+	w.WriteStatusLine(response.Ok)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody([]byte(body))
+}
+
+func TestServeConn(t *testing.T) {
+	// Test: Simple GET
+	c := newTestClient(t, textHandler)
+	c.writeHeaders(1, true, requestFields("GET", "/coffee")...)
+	resp := c.readResponses(1)[1]
+	assert.Equal(t, "200", resp.get(":status"))
+	assert.Equal(t, "text/plain", resp.get("content-type"))
+	assert.Equal(t, "", resp.get("connection"))
+	assert.Equal(t, "GET /coffee localhost:42069", string(resp.body))
+
+	// Test: PING is acknowledged with the same payload
+	c.writeFrame(Frame{Type: FramePing, Payload: []byte("12345678")})
+	f := c.readFrame()
+	assert.Equal(t, FramePing, f.Type)
+	assert.True(t, f.Flags.Has(FlagAck))
+	assert.Equal(t, "12345678", string(f.Payload))
+
+	// Test: Request body, chunked response and trailers
+	c = newTestClient(t, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.Ok)
+		h := response.GetDefaultHeaders(0)
+		h.Delete("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Trailer", "X-Body-Length")
+		w.WriteHeaders(h)
+		w.WriteChunkedBody(req.Body[:5])
+		w.WriteChunkedBody(req.Body[5:])
+		w.WriteChunkedBodyDone()
+		trailers := headers.NewHeaders()
+		trailers.Set("X-Body-Length", strconv.Itoa(len(req.Body)))
+		w.WriteTrailers(trailers)
+	})
+	c.writeHeaders(1, false, append(requestFields("POST", "/submit"), HeaderField{Name: "content-length", Value: "13"})...)
+	c.writeFrame(Frame{Type: FrameData, StreamID: 1, Payload: []byte("hello ")})
+	c.writeFrame(Frame{Type: FrameData, Flags: FlagEndStream, StreamID: 1, Payload: []byte("world!\n")})
+	resp = c.readResponses(1)[1]
+	assert.Equal(t, "hello world!\n", string(resp.body))
+	assert.Equal(t, "", resp.get("transfer-encoding"))
+	assert.Equal(t, []HeaderField{{Name: "x-body-length", Value: "13"}}, resp.trailers)
+
+	// Test: A body over the limit gets 413 and the stream is reset
+	c = newTestClient(t, textHandler)
+	c.writeHeaders(1, false, requestFields("POST", "/upload")...)
+	c.writeFrame(Frame{Type: FrameData, StreamID: 1, Payload: bytes.Repeat([]byte("x"), 600)})
+	c.writeFrame(Frame{Type: FrameData, StreamID: 1, Payload: bytes.Repeat([]byte("x"), 600)})
+	var got []Frame
+	for len(got) < 2 {
+		// Window updates for the received data may come first.
+		if f := c.readFrame(); f.Type != FrameWindowUpdate {
+			got = append(got, f)
+		}
+	}
+	require.Equal(t, FrameHeaders, got[0].Type)
+	assert.True(t, got[0].Flags.Has(FlagEndStream))
+	tooLarge, err := c.decoder.Decode(got[0].Payload)
+	require.NoError(t, err)
+	assert.Contains(t, tooLarge, HeaderField{Name: ":status", Value: "413"})
+	f = got[1]
+	require.Equal(t, FrameRSTStream, f.Type)
+	assert.Equal(t, []byte{0, 0, 0, 0}, f.Payload)
+
+	// Test: Streams are multiplexed, the first response waits for the second
+	release := make(chan struct{})
+	c = newTestClient(t, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/slow" {
+			<-release
+		} else {
+			defer close(release)
+		}
+		textHandler(w, req)
+	})
+	c.writeHeaders(1, true, requestFields("GET", "/slow")...)
+	c.writeHeaders(3, true, requestFields("GET", "/fast")...)
+	responses := c.readResponses(1, 3)
+	assert.Equal(t, "GET /slow localhost:42069", string(responses[1].body))
+	assert.Equal(t, "GET /fast localhost:42069", string(responses[3].body))
+
+	// Test: Large response respects a small initial window
+	large := bytes.Repeat([]byte("0123456789"), 10000)
+	c = newTestClient(t, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.Ok)
+		w.WriteHeaders(response.GetDefaultHeaders(len(large)))
+		w.WriteBody(large)
+	}, Setting{SettingInitialWindowSize, 1000}, Setting{SettingMaxFrameSize, 20000})
+	c.writeHeaders(1, true, requestFields("GET", "/large")...)
+	f = c.readFrame()
+	require.Equal(t, FrameHeaders, f.Type)
+	f = c.readFrame()
+	require.Equal(t, FrameData, f.Type)
+	assert.Equal(t, 1000, len(f.Payload))
+	c.writeFrame(Frame{Type: FrameWindowUpdate, StreamID: 1, Payload: WindowUpdatePayload(200000)})
+	resp = c.readResponses(1)[1]
+	assert.Equal(t, large[1000:], resp.body)
+
+	// Test: HEAD ends the stream with the header block
+	c = newTestClient(t, textHandler)
+	c.writeHeaders(1, true, requestFields("HEAD", "/")...)
+	f = c.readFrame()
+	require.Equal(t, FrameHeaders, f.Type)
+	assert.True(t, f.Flags.Has(FlagEndStream))
+	fields, err := c.decoder.Decode(f.Payload)
+	require.NoError(t, err)
+	assert.Contains(t, fields, HeaderField{Name: "content-length", Value: "22"})
+
+	// Test: Handler that writes nothing gets a 500
+	c = newTestClient(t, func(w *response.Writer, req *request.Request) {})
+	c.writeHeaders(1, true, requestFields("GET", "/")...)
+	resp = c.readResponses(1)[1]
+	assert.Equal(t, "500", resp.get(":status"))
+	assert.Empty(t, resp.body)
+
+	// Test: RST_STREAM cancels the context of the stream
+	cancelled := make(chan error, 1)
+	c = newTestClient(t, func(w *response.Writer, req *request.Request) {
+		<-req.Context().Done()
+		cancelled <- req.Context().Err()
+	})
+	c.writeHeaders(1, true, requestFields("GET", "/")...)
+	c.writeFrame(Frame{Type: FrameRSTStream, StreamID: 1, Payload: RSTStreamPayload(ErrCodeCancel)})
+	assert.ErrorIs(t, <-cancelled, context.Canceled)
+
+	// Test: Malformed request is a stream error
+	c = newTestClient(t, textHandler)
+	c.writeHeaders(1, true, append(requestFields("GET", "/"), HeaderField{Name: "connection", Value: "close"})...)
+	f = c.readFrame()
+	require.Equal(t, FrameRSTStream, f.Type)
+	code, err := ParseRSTStream(f.Payload)
+	require.NoError(t, err)
+	assert.Equal(t, ErrCodeProtocol, code)
+
+	// Test: Even stream ids are a connection error
+	c = newTestClient(t, textHandler)
+	c.writeHeaders(2, true, requestFields("GET", "/")...)
+	f = c.readFrame()
+	require.Equal(t, FrameGoAway, f.Type)
+	_, code, _, err = ParseGoAway(f.Payload)
+	require.NoError(t, err)
+	assert.Equal(t, ErrCodeProtocol, code)
+
+	// Test: DATA on an idle stream is a connection error
+	c = newTestClient(t, textHandler)
+	c.writeFrame(Frame{Type: FrameData, StreamID: 5, Payload: []byte("hello")})
+	f = c.readFrame()
+	require.Equal(t, FrameGoAway, f.Type)
+	_, code, _, _ = ParseGoAway(f.Payload)
+	assert.Equal(t, ErrCodeProtocol, code)
+}
+
+func TestServeUpgrade(t *testing.T) {
+	settings := base64.RawURLEncoding.EncodeToString(SettingsPayload(Setting{SettingInitialWindowSize, 100000}))
+	conn := serveTestConn(t, func(conn net.Conn) {
+		req, err := request.RequestFromReader(conn)
+		if err != nil || !IsUpgradeRequest(req) {
+			return
+		}
+		ServeUpgrade(context.Background(), conn, req, textHandler, Options{})
+	})
+	_, err := io.WriteString(conn, "GET /upgraded HTTP/1.1\r\nHost: localhost:42069\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: "+settings+"\r\n\r\n")
+	require.NoError(t, err)
+
+	status := make([]byte, len("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n"))
+	_, err = io.ReadFull(conn, status)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(status), "HTTP/1.1 101 "))
+
+	c := &testClient{t: t, conn: conn, encoder: NewEncoder(), decoder: NewDecoder(defaultHeaderTableSize)}
+	_, err = io.WriteString(conn, ClientPreface)
+	require.NoError(t, err)
+	c.writeFrame(Frame{Type: FrameSettings})
+	f := c.readFrame()
+	require.Equal(t, FrameSettings, f.Type)
+	resp := c.readResponses(1)[1]
+	assert.Equal(t, "200", resp.get(":status"))
+	assert.Equal(t, "GET /upgraded localhost:42069", string(resp.body))
+}
+
+func TestServeConnNetHTTP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				ServeConn(context.Background(), conn, func(w *response.Writer, req *request.Request) {
+					body := append([]byte(req.RequestLine.Method+" "), req.Body...)
+					w.WriteStatusLine(response.Ok)
+					h := response.GetDefaultHeaders(len(body))
+					h.Set("X-Request-Header", req.Headers.Get("X-Test"))
+					w.WriteHeaders(h)
+					w.WriteBody(body)
+				}, Options{})
+			}()
+		}
+	}()
+
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}, Timeout: 5 * time.Second}
+	defer client.CloseIdleConnections()
+
+	for i := range 3 {
+		body := strings.Repeat("x", i*50000)
+		req, err := http.NewRequest("POST", "http://"+listener.Addr().String()+"/echo", strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("X-Test", strconv.Itoa(i))
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		got, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, 2, resp.ProtoMajor)
+		assert.Equal(t, strconv.Itoa(i), resp.Header.Get("X-Request-Header"))
+		assert.Equal(t, "POST "+body, string(got))
+	}
+}
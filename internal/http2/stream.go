@@ -0,0 +1,350 @@
+package http2
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/headers"
+	"github.com/ohrelaxo/httpfromtcp/internal/request"
+)
+
+// connectionHeaders are only meaningful for a single HTTP/1.1 hop and must
+// not appear in HTTP/2 messages.
+var connectionHeaders = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+// requestFromFields maps a decoded request header list onto a Request. The
+// pseudo-header fields become the request line, :authority becomes Host.
+func requestFromFields(fields []HeaderField) (*request.Request, error) {
+	req := &request.Request{Headers: headers.NewHeaders(), Body: make([]byte, 0)}
+	pseudo := map[string]string{}
+	regular := false
+	for _, f := range fields {
+		if strings.HasPrefix(f.Name, ":") {
+			if regular {
+				return nil, fmt.Errorf("pseudo-header %s after regular header", f.Name)
+			}
+			switch f.Name {
+			case ":method", ":path", ":scheme", ":authority":
+			default:
+				return nil, fmt.Errorf("unknown pseudo-header %s", f.Name)
+			}
+			if _, ok := pseudo[f.Name]; ok {
+				return nil, fmt.Errorf("duplicate pseudo-header %s", f.Name)
+			}
+			pseudo[f.Name] = f.Value
+			continue
+		}
+		regular = true
+		if err := addField(req.Headers, f); err != nil {
+			return nil, err
+		}
+	}
+
+	method := pseudo[":method"]
+	if method == "" {
+		return nil, errors.New("missing :method")
+	}
+	target := pseudo[":path"]
+	if method == "CONNECT" {
+		if pseudo[":authority"] == "" || target != "" || pseudo[":scheme"] != "" {
+			return nil, errors.New("malformed CONNECT request")
+		}
+		target = pseudo[":authority"]
+	} else if target == "" || pseudo[":scheme"] == "" {
+		return nil, errors.New("missing :path or :scheme")
+	}
+	if authority := pseudo[":authority"]; authority != "" && req.Headers.Get("Host") == "" {
+		if err := req.Headers.Set("Host", authority); err != nil {
+			return nil, err
+		}
+	}
+
+	req.RequestLine = request.RequestLine{
+		HttpVersion:   "2",
+		RequestTarget: target,
+		Method:        method,
+	}
+	return req, nil
+}
+
+func addTrailerFields(req *request.Request, fields []HeaderField) error {
+	req.Trailers = headers.NewHeaders()
+	for _, f := range fields {
+		if strings.HasPrefix(f.Name, ":") {
+			return fmt.Errorf("pseudo-header %s in trailers", f.Name)
+		}
+		if err := addField(req.Trailers, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addField(h headers.Headers, f HeaderField) error {
+	if strings.ToLower(f.Name) != f.Name {
+		return fmt.Errorf("uppercase header name %s", f.Name)
+	}
+	if connectionHeaders[f.Name] {
+		return fmt.Errorf("connection-specific header %s", f.Name)
+	}
+	if f.Name == "te" && f.Value != "trailers" {
+		return fmt.Errorf("invalid te header %s", f.Value)
+	}
+	if strings.ContainsAny(f.Value, "\r\n\x00") {
+		return fmt.Errorf("invalid value for header %s", f.Name)
+	}
+	existing, ok := h[f.Name]
+	switch {
+	case !ok:
+		return h.Set(f.Name, f.Value)
+	case f.Name == "cookie":
+		// Cookie crumbs are joined with "; " instead of ", ".
+		return h.Set(f.Name, existing+"; "+f.Value)
+	default:
+		h.Put(f.Name, f.Value)
+		return nil
+	}
+}
+
+func checkContentLength(req *request.Request) error {
+	contentLength := req.Headers.Get("Content-Length")
+	if contentLength == "" {
+		return nil
+	}
+	length, err := strconv.Atoi(contentLength)
+	if err != nil || length != len(req.Body) {
+		return fmt.Errorf("content-length %q does not match body length %d", contentLength, len(req.Body))
+	}
+	return nil
+}
+
+type translatorState int
+
+const (
+	translateStatusLine translatorState = iota
+	translateHeaders
+	translateBody
+	translateChunkSize
+	translateChunkData
+	translateChunkEnd
+	translateTrailers
+	translateDone
+)
+
+const maxResponseLine = 64 << 10
+
+// responseStream is the io.Writer behind a stream's response.Writer. It
+// reads back the HTTP/1.1 message the writer produces and translates it
+// into HEADERS and DATA frames, so handlers work unchanged over HTTP/2.
+type responseStream struct {
+	sc *serverConn
+	st *stream
+
+	state translatorState
+	line  []byte
+
+	status    int
+	fields    []HeaderField
+	chunked   bool
+	remaining int64
+	chunkLeft int64
+
+	headersSent bool
+	err         error
+
+	// head is set for responses to HEAD, they end with the header block.
+	head bool
+}
+
+func (rs *responseStream) Write(p []byte) (int, error) {
+	if rs.err != nil {
+		return 0, rs.err
+	}
+	n := len(p)
+	for len(p) > 0 && rs.err == nil {
+		switch rs.state {
+		case translateBody:
+			take := p
+			if rs.remaining >= 0 {
+				if int64(len(p)) > rs.remaining {
+					rs.err = errors.New("http2: response body exceeds Content-Length")
+					break
+				}
+				rs.remaining -= int64(len(take))
+			}
+			p = p[len(take):]
+			end := rs.remaining == 0
+			if end {
+				rs.state = translateDone
+			}
+			rs.err = rs.sc.writeData(rs.st, take, end)
+		case translateChunkData:
+			take := p[:min(int64(len(p)), rs.chunkLeft)]
+			p = p[len(take):]
+			rs.chunkLeft -= int64(len(take))
+			if rs.chunkLeft == 0 {
+				rs.state = translateChunkEnd
+			}
+			rs.err = rs.sc.writeData(rs.st, take, false)
+		case translateDone:
+			rs.err = errors.New("http2: write after response was complete")
+		default:
+			idx := bytes.IndexByte(p, '\n')
+			if idx == -1 {
+				rs.line = append(rs.line, p...)
+				p = nil
+				if len(rs.line) > maxResponseLine {
+					rs.err = errors.New("http2: response line too long")
+				}
+				break
+			}
+			line := string(bytes.TrimSuffix(append(rs.line, p[:idx]...), []byte("\r")))
+			rs.line = rs.line[:0]
+			p = p[idx+1:]
+			rs.err = rs.handleLine(line)
+		}
+	}
+	if rs.err != nil {
+		return 0, rs.err
+	}
+	return n, nil
+}
+
+func (rs *responseStream) handleLine(line string) error {
+	switch rs.state {
+	case translateStatusLine:
+		parts := strings.SplitN(line, " ", 3)
+		if len(parts) < 2 {
+			return fmt.Errorf("http2: malformed status line %q", line)
+		}
+		status, err := strconv.Atoi(parts[1])
+		if err != nil || status < 100 || status > 999 {
+			return fmt.Errorf("http2: malformed status line %q", line)
+		}
+		rs.status = status
+		rs.fields = rs.fields[:0]
+		rs.chunked = false
+		rs.remaining = -1
+		rs.state = translateHeaders
+	case translateHeaders:
+		if line == "" {
+			return rs.endHeaders()
+		}
+		name, value, err := splitField(line)
+		if err != nil {
+			return err
+		}
+		switch name {
+		case "transfer-encoding":
+			rs.chunked = strings.Contains(strings.ToLower(value), "chunked")
+		case "content-length":
+			length, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || length < 0 {
+				return fmt.Errorf("http2: invalid content-length %q", value)
+			}
+			rs.remaining = length
+		}
+		if !connectionHeaders[name] {
+			rs.fields = append(rs.fields, HeaderField{Name: name, Value: value})
+		}
+	case translateChunkSize:
+		size, _, _ := strings.Cut(line, ";")
+		length, err := strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+		if err != nil || length < 0 {
+			return fmt.Errorf("http2: invalid chunk size %q", line)
+		}
+		if length == 0 {
+			rs.fields = rs.fields[:0]
+			rs.state = translateTrailers
+			return nil
+		}
+		rs.chunkLeft = length
+		rs.state = translateChunkData
+	case translateChunkEnd:
+		if line != "" {
+			return fmt.Errorf("http2: missing CRLF after chunk")
+		}
+		rs.state = translateChunkSize
+	case translateTrailers:
+		if line == "" {
+			return rs.endTrailers()
+		}
+		name, value, err := splitField(line)
+		if err != nil {
+			return err
+		}
+		rs.fields = append(rs.fields, HeaderField{Name: name, Value: value})
+	}
+	return nil
+}
+
+func splitField(line string) (string, string, error) {
+	name, value, ok := strings.Cut(line, ":")
+	if !ok {
+		return "", "", fmt.Errorf("http2: malformed header line %q", line)
+	}
+	return strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(value), nil
+}
+
+func (rs *responseStream) endHeaders() error {
+	fields := append([]HeaderField{{Name: ":status", Value: strconv.Itoa(rs.status)}}, rs.fields...)
+	if rs.status < 200 {
+		// Interim responses are sent as their own header block and the
+		// final status line follows.
+		rs.state = translateStatusLine
+		return rs.sc.writeHeaders(rs.st, fields, false)
+	}
+	rs.headersSent = true
+	endStream := rs.head || rs.status == 204 || rs.status == 304 || (!rs.chunked && rs.remaining == 0)
+	switch {
+	case endStream:
+		rs.state = translateDone
+	case rs.chunked:
+		rs.state = translateChunkSize
+	default:
+		rs.state = translateBody
+	}
+	return rs.sc.writeHeaders(rs.st, fields, endStream)
+}
+
+func (rs *responseStream) endTrailers() error {
+	rs.state = translateDone
+	if len(rs.fields) == 0 {
+		return rs.sc.writeData(rs.st, nil, true)
+	}
+	return rs.sc.writeHeaders(rs.st, rs.fields, true)
+}
+
+// finish ends the stream after the handler returned. Bodies delimited by
+// the end of the handler are closed normally, anything else that was left
+// incomplete resets the stream.
+func (rs *responseStream) finish() {
+	if rs.err != nil {
+		if !errors.Is(rs.err, errStreamClosed) {
+			rs.sc.resetStream(StreamError{rs.st.id, ErrCodeInternal, rs.err.Error()})
+		}
+		return
+	}
+	if rs.state == translateDone {
+		return
+	}
+	switch {
+	case !rs.headersSent:
+		rs.sc.resetStream(StreamError{rs.st.id, ErrCodeInternal, "handler did not write a response"})
+	case rs.state == translateBody && rs.remaining > 0:
+		rs.sc.resetStream(StreamError{rs.st.id, ErrCodeInternal, "response body shorter than Content-Length"})
+	case rs.state == translateTrailers:
+		rs.endTrailers()
+	default:
+		rs.sc.writeData(rs.st, nil, true)
+	}
+}
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/request"
+	"github.com/ohrelaxo/httpfromtcp/internal/response"
+	"github.com/ohrelaxo/httpfromtcp/internal/server"
+)
+
+// hopByHop are the fields that only apply to one connection and are not
+// forwarded, RFC 9110 section 7.6.1.
+var hopByHop = map[string]bool{
+	"connection":          true,
+	"keep-alive":          true,
+	"proxy-authenticate":  true,
+	"proxy-authorization": true,
+	"proxy-connection":    true,
+	"te":                  true,
+	"trailer":             true,
+	"transfer-encoding":   true,
+	"upgrade":             true,
+}
+
+// Options configures a reverse proxy.
+type Options struct {
+	// StripPrefix is removed from the request path before it is appended
+	// to the path of the upstream URL.
+	StripPrefix string
+	// Client sends the upstream requests. The default one does not follow
+	// redirects, they are passed on to the client.
+	Client *http.Client
+}
+
+var defaultClient = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// New forwards requests to upstream, an http or https URL. The response is
+// streamed back chunked, with the digests of the body in the trailers.
+func New(upstream string, opts Options) (server.Handler, error) {
+	base, err := url.Parse(upstream)
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" || base.Host == "" {
+		return nil, fmt.Errorf("upstream %q is not an absolute http or https URL", upstream)
+	}
+	if opts.Client == nil {
+		opts.Client = defaultClient
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/")
+	return func(w *response.Writer, req *request.Request) {
+		target := strings.TrimPrefix(req.RequestLine.RequestTarget, opts.StripPrefix)
+		if !strings.HasPrefix(target, "/") {
+			target = "/" + target
+		}
+		resp, err := forward(opts.Client, base.String()+target, req)
+		if err != nil {
+			log.Printf("proxy: %s %s: %v\n", req.RequestLine.Method, target, err)
+			w.Header().Set("Content-Length", "0")
+			w.WriteHeader(response.BadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		writeResponse(w, req, resp)
+	}, nil
+}
+
+func forward(client *http.Client, url string, req *request.Request) (*http.Response, error) {
+	body, err := req.ReadBody()
+	if err != nil {
+		return nil, err
+	}
+	// The upstream request is abandoned when the client goes away.
+	upstream, err := http.NewRequestWithContext(req.Context(), req.RequestLine.Method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	connection := listed(req.Headers.Get("Connection"))
+	for name, value := range req.Headers {
+		if !hopByHop[name] && !connection[name] && name != "host" && name != "content-length" {
+			upstream.Header.Set(name, value)
+		}
+	}
+	if host := req.Headers.Get("Host"); host != "" {
+		upstream.Header.Set("X-Forwarded-Host", host)
+	}
+	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		if prior := req.Headers.Get("X-Forwarded-For"); prior != "" {
+			ip = prior + ", " + ip
+		}
+		upstream.Header.Set("X-Forwarded-For", ip)
+	}
+	return client.Do(upstream)
+}
+
+func writeResponse(w *response.Writer, req *request.Request, resp *http.Response) {
+	connection := listed(resp.Header.Get("Connection"))
+	h := w.Header()
+	for name, values := range resp.Header {
+		lower := strings.ToLower(name)
+		if hopByHop[lower] || connection[lower] || lower == "content-length" {
+			continue
+		}
+		// Set-Cookie cannot be combined into one line.
+		if lower == "set-cookie" {
+			for _, value := range values {
+				w.AddHeaderLine(name, value)
+			}
+			continue
+		}
+		h.Set(name, strings.Join(values, ", "))
+	}
+	status := response.StatusCode(resp.StatusCode)
+	if status == response.NoContent || status == response.NotModified || status < response.Ok {
+		w.WriteHeader(status)
+		return
+	}
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", response.DigestTrailerNames)
+	if err := w.WriteHeader(status); err != nil {
+		log.Printf("proxy: %v\n", err)
+		return
+	}
+
+	digest := response.NewDigestWriter(w)
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := digest.Write(buf[:n]); err != nil {
+				log.Printf("proxy: error writing chunked body: %v\n", err)
+				return
+			}
+			if err := w.Flush(); err != nil {
+				log.Printf("proxy: error flushing chunked body: %v\n", err)
+				return
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			log.Printf("proxy: error reading response body for %s: %v\n", req.RequestLine.RequestTarget, err)
+			return
+		}
+	}
+	if err := digest.Close(); err != nil {
+		log.Printf("proxy: error writing trailers: %v\n", err)
+	}
+}
+
+// listed returns the lowercase field names in a Connection header.
+func listed(value string) map[string]bool {
+	names := map[string]bool{}
+	for name := range strings.SplitSeq(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names[strings.ToLower(name)] = true
+		}
+	}
+	return names
+}
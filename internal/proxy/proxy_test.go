@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/servertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Connection", "X-Private")
+		w.Header().Set("X-Private", "hop")
+		w.Header().Add("Set-Cookie", "a=1")
+		w.Header().Add("Set-Cookie", "b=2")
+		switch r.URL.Path {
+		case "/api/moved":
+			http.Redirect(w, r, "/api/new", http.StatusFound)
+		case "/api/same":
+			w.WriteHeader(http.StatusNotModified)
+		default:
+			w.WriteHeader(http.StatusCreated)
+			io.WriteString(w, strings.Join([]string{r.Method, r.URL.RequestURI(), string(body),
+				r.Header.Get("X-Custom"), r.Header.Get("X-Hop"), r.Header.Get("X-Forwarded-Host"), r.Header.Get("X-Forwarded-For")}, "|"))
+		}
+	}))
+	defer upstream.Close()
+	handler, err := New(upstream.URL+"/api/", Options{StripPrefix: "/ext"})
+	require.NoError(t, err)
+
+	// Test: Method, path, body and end-to-end fields are forwarded
+	resp := servertest.Send(t, handler, "POST /ext/items?x=1 HTTP/1.1\r\nHost: front.example\r\nContent-Length: 4\r\n"+
+		"X-Custom: yes\r\nConnection: close, X-Hop\r\nX-Hop: no\r\nX-Forwarded-For: 10.0.0.1\r\n\r\ndata")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 201 "), resp)
+	assert.Contains(t, resp, "POST|/api/items?x=1|data|yes||front.example|10.0.0.1, ")
+	assert.Contains(t, resp, "content-type: text/plain\r\n")
+	assert.Contains(t, resp, "set-cookie: a=1\r\nset-cookie: b=2\r\n")
+	assert.NotContains(t, resp, "x-private")
+	assert.Contains(t, resp, "transfer-encoding: chunked\r\n")
+	assert.Contains(t, resp, "x-content-sha256: ")
+
+	// Test: Redirects and 304s are passed on, not followed
+	resp = servertest.Send(t, handler, "GET /ext/moved HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 302 Found\r\n"), resp)
+	assert.Contains(t, resp, "location: /api/new\r\n")
+	resp = servertest.Send(t, handler, "GET /ext/same HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 304 Not Modified\r\n"), resp)
+	assert.NotContains(t, resp, "transfer-encoding")
+
+	// Test: An unreachable upstream is a 502
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+	handler, err = New("http://"+addr, Options{})
+	require.NoError(t, err)
+	resp = servertest.Send(t, handler, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 502 Bad Gateway\r\n"), resp)
+
+	// Test: Only absolute http and https upstreams are accepted
+	for _, upstream := range []string{"ftp://example.com", "/relative", "http://"} {
+		_, err := New(upstream, Options{})
+		assert.Error(t, err, upstream)
+	}
+}
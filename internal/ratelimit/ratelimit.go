@@ -0,0 +1,123 @@
+package ratelimit
+
+import (
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/request"
+	"github.com/ohrelaxo/httpfromtcp/internal/response"
+	"github.com/ohrelaxo/httpfromtcp/internal/server"
+)
+
+// sweepInterval is how often the limiter drops buckets that are full again.
+const sweepInterval = time.Minute
+
+// Limiter is a token bucket per key: every key may do burst requests at
+// once and gets rate new tokens per second.
+type Limiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewLimiter(rate float64, burst int) *Limiter {
+	return &Limiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: map[string]*bucket{},
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token for key. If there is none it returns how long until
+// the next one is available.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if now.Sub(l.lastSweep) >= sweepInterval {
+		l.lastSweep = now
+		for k, b := range l.buckets {
+			if l.refill(b, now) >= l.burst {
+				delete(l.buckets, k)
+			}
+		}
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := (1 - b.tokens) / l.rate
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// refill returns the tokens b has at now.
+func (l *Limiter) refill(b *bucket, now time.Time) float64 {
+	return math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+}
+
+// Len returns the number of keys tracked.
+func (l *Limiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+// KeyFunc returns the key a request is limited by.
+type KeyFunc func(req *request.Request) string
+
+// ByIP limits each client address.
+func ByIP(req *request.Request) string {
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+// ByHeader limits by the value of the header name, such as an API key.
+// Requests without it are limited by client address.
+func ByHeader(name string) KeyFunc {
+	return func(req *request.Request) string {
+		if value := req.Headers.Get(name); value != "" {
+			return name + ":" + value
+		}
+		return ByIP(req)
+	}
+}
+
+// Middleware answers requests over the limit with 429 and a Retry-After
+// header instead of running the handler.
+func Middleware(limiter *Limiter, key KeyFunc) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			ok, wait := limiter.Allow(key(req))
+			if !ok {
+				seconds := int(math.Ceil(wait.Seconds()))
+				w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+				w.Header().Set("Content-Length", "0")
+				w.WriteHeader(response.TooManyRequests)
+				return
+			}
+			next(w, req)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package ratelimit
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/request"
+	"github.com/ohrelaxo/httpfromtcp/internal/response"
+	"github.com/ohrelaxo/httpfromtcp/internal/server"
+	"github.com/ohrelaxo/httpfromtcp/internal/servertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Now()
+	l := NewLimiter(2, 3)
+	l.now = func() time.Time { return now }
+
+	// Test: A burst is allowed, then the caller has to wait for a token
+	for range 3 {
+		ok, _ := l.Allow("a")
+		assert.True(t, ok)
+	}
+	ok, wait := l.Allow("a")
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	// Test: Keys have their own buckets
+	ok, _ = l.Allow("b")
+	assert.True(t, ok)
+
+	// Test: Tokens come back at the rate
+	now = now.Add(time.Second)
+	for range 2 {
+		ok, _ = l.Allow("a")
+		assert.True(t, ok)
+	}
+	ok, _ = l.Allow("a")
+	assert.False(t, ok)
+
+	// Test: Full buckets are swept
+	now = now.Add(time.Hour)
+	l.Allow("c")
+	assert.Equal(t, 1, l.Len())
+}
+
+func TestMiddleware(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) {
+		w.Write([]byte("ok"))
+	}
+	s, err := server.Serve(0, handler, server.WithMiddleware(Middleware(NewLimiter(0.5, 1), ByHeader("X-Api-Key"))))
+	require.NoError(t, err)
+	defer s.Close()
+	get := func(key string) string {
+		return servertest.RoundTrip(t, s.Addr().String(), "GET / HTTP/1.1\r\nHost: localhost\r\nX-Api-Key: "+key+"\r\n\r\n")
+	}
+
+	// Test: The second request of a key is rejected with Retry-After
+	resp := get("one")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"), resp)
+	resp = get("one")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 429 Too Many Requests\r\n"), resp)
+	assert.Contains(t, resp, "retry-after: 2\r\n")
+
+	// Test: Another key is not affected
+	resp = get("two")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"), resp)
+}
@@ -0,0 +1,40 @@
+package request
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func benchmarkRequests() map[string]string {
+	var many strings.Builder
+	many.WriteString("GET /api/v1/items?page=2 HTTP/1.1\r\nHost: localhost:42069\r\n")
+	for i := range 40 {
+		fmt.Fprintf(&many, "X-Custom-Header-%d: value number %d\r\n", i, i)
+	}
+	many.WriteString("\r\n")
+
+	body := strings.Repeat("0123456789abcdef", 4096)
+	return map[string]string{
+		"small": "GET / HTTP/1.1\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n",
+		"large": "POST /upload HTTP/1.1\r\nHost: localhost:42069\r\nContent-Type: application/octet-stream\r\n" +
+			fmt.Sprintf("Content-Length: %d\r\n\r\n", len(body)) + body,
+		"many-headers": many.String(),
+	}
+}
+
+func BenchmarkRequestFromReader(b *testing.B) {
+	for name, data := range benchmarkRequests() {
+		b.Run(name, func(b *testing.B) {
+			reader := strings.NewReader(data)
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			for b.Loop() {
+				reader.Reset(data)
+				if _, err := RequestFromReader(reader); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
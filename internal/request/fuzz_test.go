@@ -0,0 +1,148 @@
+package request
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/headers"
+)
+
+func addSeeds(f *testing.F) {
+	f.Add("GET / HTTP/1.1\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n", 3)
+	f.Add("POST /submit HTTP/1.1\r\nHost: localhost:42069\r\nContent-Length: 13\r\n\r\nhello world!\n", 1)
+	f.Add("POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5;ext=1\r\nhello\r\n0\r\nX-Sum: 1\r\n\r\n", 5)
+	f.Add("GET http://example.com:8080/a?b=%20c HTTP/1.1\nHost: example.com\n\n", 64)
+	f.Add("OPTIONS * HTTP/1.1\r\nHost: a\r\n\r\n", 2)
+	f.Add("\r\nGET / HTTP/1.1\r\nHost: a\r\nX: a\r\nX: b\r\n\r\n", 7)
+	for _, tc := range smugglingCases {
+		f.Add(tc.data, 4)
+	}
+}
+
+// checkInvariants parses data in one piece and with the given read size and
+// verifies what must hold for any input: parse never consumes more than it
+// is given, both ways of reading agree, and an accepted request survives a
+// round trip through Write.
+func checkInvariants(t *testing.T, p Parser, data string, perRead int) {
+	r := &Request{status: initialized, Headers: make(map[string]string), Body: make([]byte, 0), parser: p.withDefaults()}
+	rest := []byte(data)
+	var parseErr error
+	for r.status != done {
+		n, err := r.parse(rest)
+		if n < 0 || n > len(rest) {
+			t.Fatalf("parse consumed %d of %d bytes", n, len(rest))
+		}
+		if err != nil {
+			parseErr = err
+			break
+		}
+		if n == 0 {
+			break
+		}
+		rest = rest[n:]
+	}
+	complete := parseErr == nil && r.status == done
+
+	got, err := p.RequestFromReader(&chunkReader{data: data, numBytesPerRead: perRead})
+	if complete != (err == nil) {
+		t.Fatalf("verdict depends on read size %d: parse %v, reader %v", perRead, parseErr, err)
+	}
+	if err != nil {
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := got.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	again, err := p.RequestFromReader(&buf)
+	if err != nil {
+		t.Fatalf("serialized request %q does not parse: %v", buf.String(), err)
+	}
+	if again.RequestLine != got.RequestLine {
+		t.Fatalf("request line changed: %+v != %+v", again.RequestLine, got.RequestLine)
+	}
+	if !bytes.Equal(again.Body, got.Body) {
+		t.Fatalf("body changed: %q != %q", again.Body, got.Body)
+	}
+	for key, value := range got.Headers {
+		if key == "content-length" || key == "transfer-encoding" {
+			continue
+		}
+		if again.Headers[key] != value {
+			t.Fatalf("header %s changed: %q != %q", key, again.Headers[key], value)
+		}
+	}
+}
+
+func FuzzRequestFromReader(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, data string, perRead int) {
+		if perRead <= 0 || perRead > len(data) {
+			perRead = len(data) + 1
+		}
+		for _, mode := range []Mode{Lenient, Strict} {
+			checkInvariants(t, Parser{Mode: mode, MaxBodyBytes: 1 << 16}, data, perRead)
+		}
+	})
+}
+
+// stricterThanNetHTTP are the errors for input that net/http accepts on
+// purpose and the parser rejects on purpose, RFC 9112 leaves the choice to
+// the recipient or the input is a known request smuggling vector.
+var stricterThanNetHTTP = []error{
+	// Bare LF line endings and whitespace before the colon.
+	headers.ErrLineEnding,
+	headers.ErrInvalidFieldName,
+	// net/http unfolds obsolete line folding.
+	headers.ErrObsoleteLineFolding,
+	// net/http drops Content-Length when Transfer-Encoding is present.
+	ErrConflictingLength,
+	// net/http allows whitespace after the chunk size.
+	ErrMalformedChunk,
+	// net/http allows characters outside RFC 3986 in the target.
+	ErrInvalidRequestTarget,
+	// net/http accepts any HTTP/1.x and HTTP/2 version.
+	ErrUnsupportedVersion,
+	// net/http has no limit on the body read here.
+	ErrBodyTooLarge,
+}
+
+// FuzzDifferential compares the strict parser against net/http. Requests
+// that both accept must carry the same body, and both must come to the
+// same verdict except for the differences in stricterThanNetHTTP and blank
+// lines before the request-line, which RFC 9112 section 2.2 lets the
+// parser skip.
+func FuzzDifferential(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, data string, _ int) {
+		ours, ourErr := Parser{Mode: Strict, MaxBodyBytes: 1 << 16}.RequestFromReader(strings.NewReader(data))
+
+		var theirBody []byte
+		theirs, theirErr := http.ReadRequest(bufio.NewReader(strings.NewReader(data)))
+		if theirErr == nil {
+			theirBody, theirErr = io.ReadAll(theirs.Body)
+		}
+
+		switch {
+		case ourErr == nil && theirErr == nil:
+			if !bytes.Equal(ours.Body, theirBody) {
+				t.Fatalf("body mismatch for %q: %q != %q", data, ours.Body, theirBody)
+			}
+		case ourErr == nil:
+			if !strings.HasPrefix(data, "\r\n") && !strings.HasPrefix(data, "\n") {
+				t.Errorf("net/http rejects %q: %v", data, theirErr)
+			}
+		case theirErr == nil:
+			if !slices.ContainsFunc(stricterThanNetHTTP, func(target error) bool { return errors.Is(ourErr, target) }) {
+				t.Errorf("parser rejects %q: %v", data, ourErr)
+			}
+		}
+	})
+}
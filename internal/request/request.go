@@ -1,13 +1,14 @@
 package request
 
 import (
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"slices"
 	"strconv"
 	"strings"
-	"unicode"
+	"sync"
 
 	"github.com/ohrelaxo/httpfromtcp/internal/headers"
 )
@@ -16,8 +17,47 @@ type Request struct {
 	RequestLine RequestLine
 	Headers     headers.Headers
 	Body        []byte
+	// Trailers holds the trailer section of a chunked body. The fields are
+	// kept apart from Headers so they cannot override framing fields.
+	Trailers headers.Headers
+	// RemoteAddr is the address of the client, set by the server.
+	RemoteAddr string
 
-	status requestState
+	status        requestState
+	parser        Parser
+	headerBytes   int
+	contentLength int
+	chunked       bool
+	chunkLeft     int
+
+	// reader is where the rest of the body comes from after ReadHeaders,
+	// pending holds the bytes that were read past the parsed part.
+	reader  io.Reader
+	pending []byte
+	bodyErr error
+
+	ctx context.Context
+}
+
+// Context returns the context of the request. The server cancels it when
+// the client goes away, the server shuts down or the request times out.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// WithContext returns a shallow copy of r that carries ctx. Middleware uses
+// it to attach values for the handlers further down.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("request: nil context")
+	}
+	r2 := new(Request)
+	*r2 = *r
+	r2.ctx = ctx
+	return r2
 }
 
 type RequestLine struct {
@@ -32,75 +72,299 @@ const (
 	initialized requestState = iota
 	parsingHeaders
 	parsingBody
+	parsingChunkSize
+	parsingChunkData
+	parsingChunkEnd
+	parsingTrailers
 	done
 )
 
+// Mode selects how forgiving the parser is with input that does not match
+// the RFC 9112 grammar.
+type Mode int
+
 const (
-	crlf       = "\r\n"
-	bufferSize = 8
+	// Lenient accepts bare LF line endings, repeated whitespace in the
+	// request-line and whitespace at the end of field lines for
+	// interoperability. Field lines that start with whitespace are rejected
+	// in both modes.
+	Lenient Mode = iota
+	// Strict validates every production of the request-line and the field
+	// lines and rejects anything else.
+	Strict
+)
+
+var (
+	ErrMalformedRequestLine      = errors.New("malformed request-line")
+	ErrInvalidMethod             = errors.New("invalid method")
+	ErrInvalidRequestTarget      = errors.New("invalid request-target")
+	ErrUnsupportedVersion        = errors.New("unsupported HTTP-version")
+	ErrURITooLong                = errors.New("request-target too long")
+	ErrHeadersTooLarge           = errors.New("header section too large")
+	ErrInvalidContentLength      = errors.New("invalid content-length")
+	ErrBodyTooLarge              = errors.New("body too large")
+	ErrUnsupportedTransferCoding = errors.New("unsupported transfer-coding")
+	ErrInvalidTransferEncoding   = errors.New("invalid transfer-encoding")
+	ErrConflictingLength         = errors.New("both content-length and transfer-encoding are present")
+	ErrMalformedChunk            = errors.New("malformed chunked body")
+	ErrIncompleteRequest         = errors.New("incomplete request")
 )
 
+const (
+	bufferSize = 4096
+	// maxPooledBuffer keeps buffers that grew for a large header section
+	// from being held on to by the pool.
+	maxPooledBuffer = 64 << 10
+
+	DefaultMaxTargetLength = 8 << 10
+	DefaultMaxHeaderBytes  = 64 << 10
+	DefaultMaxBodyBytes    = 10 << 20
+
+	// maxChunkLine bounds a chunk-size line including its extensions.
+	maxChunkLine = 4096
+
+	// maxInitialBody caps the room reserved for a body up front, larger
+	// bodies grow as their bytes arrive rather than on the client's word.
+	maxInitialBody = 64 << 10
+
+	// requestLineOverhead is the room left for the method and the version
+	// when checking a request-line that has no line ending yet.
+	requestLineOverhead = 64
+)
+
+// Parser reads requests off a connection. The zero value is a lenient parser
+// that uses the Default limits.
+type Parser struct {
+	Mode Mode
+	// MaxTargetLength, MaxHeaderBytes and MaxBodyBytes bound the size of
+	// each part of the request, zero selects the matching Default value.
+	MaxTargetLength int
+	MaxHeaderBytes  int
+	MaxBodyBytes    int
+}
+
+func (p Parser) withDefaults() Parser {
+	if p.MaxTargetLength <= 0 {
+		p.MaxTargetLength = DefaultMaxTargetLength
+	}
+	if p.MaxHeaderBytes <= 0 {
+		p.MaxHeaderBytes = DefaultMaxHeaderBytes
+	}
+	if p.MaxBodyBytes <= 0 {
+		p.MaxBodyBytes = DefaultMaxBodyBytes
+	}
+	return p
+}
+
 func RequestFromReader(reader io.Reader) (*Request, error) {
-	buffer := make([]byte, bufferSize)
-	readToIndex := 0
-	request := Request{status: initialized, Headers: make(headers.Headers), Body: make([]byte, 0)}
-	for request.status != done {
-		if readToIndex >= len(buffer) {
-			tempBuffer := make([]byte, len(buffer)*2)
-			copy(tempBuffer, buffer)
-			buffer = tempBuffer
+	return Parser{}.RequestFromReader(reader)
+}
+
+var bufferPool = sync.Pool{
+	New: func() any {
+		buffer := make([]byte, bufferSize)
+		return &buffer
+	},
+}
+
+func (p Parser) RequestFromReader(reader io.Reader) (*Request, error) {
+	request, err := p.ReadHeaders(reader)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := request.ReadBody(); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// ReadHeaders parses the request-line and the header section and leaves the
+// body on reader until ReadBody is called.
+func (p Parser) ReadHeaders(reader io.Reader) (*Request, error) {
+	request := &Request{status: initialized, Headers: make(headers.Headers), Body: make([]byte, 0), parser: p.withDefaults(), reader: reader}
+	err := request.readUntil(func() bool {
+		return request.status != initialized && request.status != parsingHeaders
+	})
+	if err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// ReadBody reads the rest of the message body into Body and returns it.
+// Requests from RequestFromReader, or built by hand, already hold their
+// whole body.
+func (r *Request) ReadBody() ([]byte, error) {
+	if r.reader == nil || r.status == done {
+		return r.Body, nil
+	}
+	if r.bodyErr == nil {
+		r.bodyErr = r.readUntil(func() bool { return r.status == done })
+	}
+	if r.bodyErr != nil {
+		return nil, r.bodyErr
+	}
+	return r.Body, nil
+}
+
+// Unread returns the bytes that were read past the end of the request, the
+// start of a pipelined request that follows it. It is only complete once
+// the body has been read.
+func (r *Request) Unread() []byte {
+	return r.pending
+}
+
+// readUntil reads from r.reader and parses until stop reports true. Bytes
+// read past that point are kept in r.pending for the next call.
+func (r *Request) readUntil(stop func() bool) error {
+	pooled := bufferPool.Get().(*[]byte)
+	buffer := *pooled
+	defer func() {
+		if cap(buffer) <= maxPooledBuffer {
+			*pooled = buffer
+			bufferPool.Put(pooled)
 		}
+	}()
+	for len(buffer) < len(r.pending) {
+		buffer = make([]byte, len(buffer)*2)
+	}
 
-		bytesRead, err := reader.Read(buffer[readToIndex:])
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				if request.status != done {
-					return nil, fmt.Errorf("incomplete request, in state: %d, read n bytes on EOF: %d, bytes not read: %v", request.status, bytesRead, readToIndex)
-				}
+	// buffer[start:end] holds the bytes that were read but not parsed yet.
+	// Parsed bytes are skipped and only compacted when the buffer is full.
+	start, end := 0, copy(buffer, r.pending)
+	r.pending = nil
+	for {
+		// A single read can hold several parts of the request, keep parsing
+		// until the buffered data is used up.
+		for !stop() {
+			bytesConsumed, err := r.parse(buffer[start:end])
+			if err != nil {
+				return err
+			}
+			start += bytesConsumed
+			if bytesConsumed == 0 {
 				break
 			}
-			return nil, err
 		}
-		readToIndex += bytesRead
+		if stop() {
+			break
+		}
+		if start == end {
+			start, end = 0, 0
+		}
 
-		bytesConsumed, err := request.parse(buffer[:readToIndex])
-		if err != nil {
-			return nil, err
+		if end == len(buffer) {
+			if start > 0 {
+				end = copy(buffer, buffer[start:end])
+				start = 0
+			} else {
+				tempBuffer := make([]byte, len(buffer)*2)
+				copy(tempBuffer, buffer)
+				buffer = tempBuffer
+			}
 		}
 
-		copy(buffer, buffer[bytesConsumed:])
-		readToIndex -= bytesConsumed
+		bytesRead, readErr := r.reader.Read(buffer[end:])
+		end += bytesRead
+		if readErr != nil && bytesRead == 0 {
+			if errors.Is(readErr, io.EOF) {
+				return fmt.Errorf("%w, in state: %d, bytes not read: %v", ErrIncompleteRequest, r.status, end-start)
+			}
+			return readErr
+		}
+	}
 
+	if start < end {
+		r.pending = append([]byte(nil), buffer[start:end]...)
 	}
+	return nil
+}
 
-	return &request, nil
+// Write serializes the request in HTTP/1.1 wire format. The body is always
+// framed with Content-Length, a chunked body is written as the decoded bytes
+// and its trailers are dropped.
+func (r *Request) Write(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s HTTP/%s\r\n", r.RequestLine.Method, r.RequestLine.RequestTarget, r.RequestLine.HttpVersion)
+	keys := make([]string, 0, len(r.Headers))
+	for key := range r.Headers {
+		if key != "content-length" && key != "transfer-encoding" {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		// Trailing whitespace is not part of a field value, so empty
+		// members at the end of a list go on field lines of their own.
+		value, empty := r.Headers[key], 0
+		for strings.HasSuffix(value, ", ") {
+			value = strings.TrimSuffix(value, ", ")
+			empty++
+		}
+		b.WriteString(key + ": " + value + "\r\n")
+		b.WriteString(strings.Repeat(key+": \r\n", empty))
+	}
+	if len(r.Body) > 0 {
+		b.WriteString("content-length: " + strconv.Itoa(len(r.Body)) + "\r\n")
+	}
+	b.WriteString("\r\n")
+	b.Write(r.Body)
+	_, err := io.WriteString(w, b.String())
+	return err
 }
 
 func (r *Request) parse(data []byte) (int, error) {
 	switch r.status {
 	case initialized:
-		consumed, requestLine, err := parseRequestLine(data)
+		consumed, requestLine, err := parseRequestLine(data, r.parser.Mode)
 		if err != nil {
 			return 0, err
 		}
 		if consumed == 0 {
+			if len(data) > r.parser.MaxTargetLength+requestLineOverhead {
+				return 0, fmt.Errorf("%w: no request-line after %d bytes", ErrURITooLong, len(data))
+			}
 			return 0, nil
 		}
+		if len(requestLine.RequestTarget) > r.parser.MaxTargetLength {
+			return 0, fmt.Errorf("%w: %d bytes", ErrURITooLong, len(requestLine.RequestTarget))
+		}
 
 		r.status = parsingHeaders
 		r.RequestLine = *requestLine
 		return consumed, nil
 	case parsingHeaders:
 		bytesUsed := 0
-		for r.status != parsingBody {
-			consumed, parseDone, err := r.Headers.Parse(data[bytesUsed:])
+		parse := r.Headers.Parse
+		if r.parser.Mode == Strict {
+			parse = r.Headers.ParseStrict
+		}
+		for r.status == parsingHeaders {
+			// Field lines starting with whitespace are rejected in both
+			// modes, RFC 9112 section 2.2. Folded or not, such a framing
+			// header is read differently by different parsers.
+			if bytesUsed < len(data) && (data[bytesUsed] == ' ' || data[bytesUsed] == '\t') {
+				return 0, fmt.Errorf("%w: in request", headers.ErrObsoleteLineFolding)
+			}
+			consumed, parseDone, err := parse(data[bytesUsed:])
 			if err != nil {
 				return 0, err
 			}
+			r.headerBytes += consumed
+			if r.headerBytes > r.parser.MaxHeaderBytes || (consumed == 0 && r.headerBytes+len(data)-bytesUsed > r.parser.MaxHeaderBytes) {
+				return 0, fmt.Errorf("%w: limit is %d bytes", ErrHeadersTooLarge, r.parser.MaxHeaderBytes)
+			}
 			if parseDone {
-				if contentLength := r.Headers.Get("Content-Length"); contentLength == "" || contentLength == "0" {
+				if err := r.bodyLength(); err != nil {
+					return 0, err
+				}
+				switch {
+				case r.chunked:
+					r.status = parsingChunkSize
+				case r.contentLength == 0:
 					r.status = done
-				} else {
+				default:
+					r.Body = make([]byte, 0, min(r.contentLength, maxInitialBody))
 					r.status = parsingBody
 				}
 			}
@@ -111,20 +375,71 @@ func (r *Request) parse(data []byte) (int, error) {
 		}
 		return bytesUsed, nil
 	case parsingBody:
-		length, err := strconv.Atoi(r.Headers.Get("Content-Length"))
+		remaining := r.contentLength - len(r.Body)
+		take := min(remaining, len(data))
+		r.Body = append(r.Body, data[:take]...)
+		if r.contentLength == len(r.Body) {
+			r.status = done
+		}
+		return take, nil
+
+	case parsingChunkSize:
+		line, n, err := headers.SplitLine(data, true)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %w", ErrMalformedChunk, err)
+		}
+		if n == 0 {
+			if len(data) > maxChunkLine {
+				return 0, fmt.Errorf("%w: chunk-size line too long", ErrMalformedChunk)
+			}
+			return 0, nil
+		}
+		size, err := parseChunkSize(line)
 		if err != nil {
 			return 0, err
 		}
-		r.Body = append(r.Body, data...)
-		if len(r.Body) > length {
-			fmt.Printf("content length: %v\nlen(data): %v\n", length, len(data))
-			return 0, fmt.Errorf("error: content-lenght header is too small for body")
+		if size > r.parser.MaxBodyBytes-len(r.Body) {
+			return 0, fmt.Errorf("%w: limit is %d bytes", ErrBodyTooLarge, r.parser.MaxBodyBytes)
+		}
+		if size == 0 {
+			r.Trailers = headers.NewHeaders()
+			r.status = parsingTrailers
+		} else {
+			r.chunkLeft = size
+			r.status = parsingChunkData
+		}
+		return n, nil
+	case parsingChunkData:
+		take := min(r.chunkLeft, len(data))
+		r.Body = append(r.Body, data[:take]...)
+		r.chunkLeft -= take
+		if r.chunkLeft == 0 {
+			r.status = parsingChunkEnd
+		}
+		return take, nil
+	case parsingChunkEnd:
+		if len(data) < 2 {
+			return 0, nil
+		}
+		if data[0] != '\r' || data[1] != '\n' {
+			return 0, fmt.Errorf("%w: chunk-data not followed by CRLF", ErrMalformedChunk)
 		}
-		if length == len(r.Body) {
+		r.status = parsingChunkSize
+		return 2, nil
+	case parsingTrailers:
+		parse := r.Trailers.ParseStrict
+		consumed, parseDone, err := parse(data)
+		if err != nil {
+			return 0, err
+		}
+		r.headerBytes += consumed
+		if r.headerBytes > r.parser.MaxHeaderBytes || (consumed == 0 && r.headerBytes+len(data) > r.parser.MaxHeaderBytes) {
+			return 0, fmt.Errorf("%w: limit is %d bytes", ErrHeadersTooLarge, r.parser.MaxHeaderBytes)
+		}
+		if parseDone {
 			r.status = done
 		}
-		return len(data), nil
-
+		return consumed, nil
 	case done:
 		return 0, fmt.Errorf("error: trying to read data in a done state")
 	default:
@@ -132,48 +447,266 @@ func (r *Request) parse(data []byte) (int, error) {
 	}
 }
 
-func parseRequestLine(data []byte) (int, *RequestLine, error) {
-	idx := bytes.Index(data, []byte(crlf))
-	if idx == -1 {
-		return 0, nil, nil
+// bodyLength applies the message body length rules of RFC 9112 section 6.3
+// once the header section is complete.
+func (r *Request) bodyLength() error {
+	transferEncoding, hasTransferEncoding := r.Headers["transfer-encoding"]
+	contentLength, hasContentLength := r.Headers["content-length"]
+	if hasTransferEncoding && hasContentLength {
+		return ErrConflictingLength
 	}
-	requestLineText := string(data[:idx])
-	requestLine, err := requestLineFromString(requestLineText)
+
+	if hasTransferEncoding {
+		codings := splitList(transferEncoding)
+		chunkedCount := 0
+		for _, coding := range codings {
+			if strings.EqualFold(coding, "chunked") {
+				chunkedCount++
+			}
+		}
+		if len(codings) == 0 || chunkedCount > 1 || (chunkedCount == 1 && !strings.EqualFold(codings[len(codings)-1], "chunked")) {
+			return fmt.Errorf("%w: %q", ErrInvalidTransferEncoding, transferEncoding)
+		}
+		if chunkedCount == 0 {
+			// Without chunked as the final coding the length of a request
+			// body cannot be determined.
+			return fmt.Errorf("%w: chunked is not the final coding: %q", ErrInvalidTransferEncoding, transferEncoding)
+		}
+		if len(codings) > 1 {
+			return fmt.Errorf("%w: %s", ErrUnsupportedTransferCoding, transferEncoding)
+		}
+		r.chunked = true
+		return nil
+	}
+
+	if !hasContentLength {
+		r.contentLength = 0
+		return nil
+	}
+	// Repeated fields have been joined into a list, which is only valid if
+	// every member is the same decimal value.
+	values := strings.Split(contentLength, ",")
+	length := -1
+	for _, value := range values {
+		value = strings.Trim(value, " \t")
+		if value == "" || len(value) > 18 || strings.TrimLeft(value, "0123456789") != "" {
+			return fmt.Errorf("%w: %q", ErrInvalidContentLength, contentLength)
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || (length != -1 && n != length) {
+			return fmt.Errorf("%w: %q", ErrInvalidContentLength, contentLength)
+		}
+		length = n
+	}
+	if length > r.parser.MaxBodyBytes {
+		return fmt.Errorf("%w: %d bytes, limit is %d", ErrBodyTooLarge, length, r.parser.MaxBodyBytes)
+	}
+	r.contentLength = length
+	return nil
+}
+
+// splitList splits a comma separated field value and drops empty members.
+func splitList(value string) []string {
+	var members []string
+	for _, member := range strings.Split(value, ",") {
+		if member = strings.Trim(member, " \t"); member != "" {
+			members = append(members, member)
+		}
+	}
+	return members
+}
+
+// parseChunkSize reads the hexadecimal chunk-size and skips any chunk
+// extensions, which carry no meaning for this server.
+func parseChunkSize(line []byte) (int, error) {
+	size, extensions, _ := strings.Cut(string(line), ";")
+	if size == "" || len(size) > 15 || strings.TrimLeft(size, "0123456789abcdefABCDEF") != "" {
+		return 0, fmt.Errorf("%w: invalid chunk-size %q", ErrMalformedChunk, line)
+	}
+	for i := 0; i < len(extensions); i++ {
+		if c := extensions[i]; (c < 0x20 && c != '\t') || c == 0x7f {
+			return 0, fmt.Errorf("%w: invalid chunk extension %q", ErrMalformedChunk, line)
+		}
+	}
+	n, err := strconv.ParseInt(size, 16, 64)
 	if err != nil {
-		return 0, nil, err
+		return 0, fmt.Errorf("%w: invalid chunk-size %q", ErrMalformedChunk, line)
 	}
-	return idx + 2, requestLine, nil
+	return int(n), nil
 }
 
-func requestLineFromString(requestLine string) (*RequestLine, error) {
-	parts := strings.Split(requestLine, " ")
-	if len(parts) > 3 {
-		return nil, fmt.Errorf("the request-line contains too many parts")
+func parseRequestLine(data []byte, mode Mode) (int, *RequestLine, error) {
+	consumed := 0
+	for {
+		line, n, err := headers.SplitLine(data[consumed:], mode == Strict)
+		if err != nil {
+			return 0, nil, fmt.Errorf("%w: %w", ErrMalformedRequestLine, err)
+		}
+		if n == 0 {
+			return 0, nil, nil
+		}
+		consumed += n
+		// Empty lines ahead of the request-line are ignored, RFC 9112 section 2.2.
+		if len(line) == 0 {
+			continue
+		}
+		requestLine, err := requestLineFromString(string(line), mode)
+		if err != nil {
+			return 0, nil, err
+		}
+		return consumed, requestLine, nil
 	}
+}
 
-	method := parts[0]
-	for _, char := range method {
-		upper := unicode.IsUpper(char)
-		letter := unicode.IsLetter(char)
-		if !upper || !letter {
-			return nil, fmt.Errorf("the method is not formatted correctly: %s", requestLine)
+func requestLineFromString(requestLine string, mode Mode) (*RequestLine, error) {
+	var parts [3]string
+	count := 0
+	if mode == Strict {
+		rest := requestLine
+		for ok := true; ok; count++ {
+			var part string
+			part, rest, ok = strings.Cut(rest, " ")
+			if count < len(parts) {
+				parts[count] = part
+			}
 		}
+	} else {
+		for i := 0; i < len(requestLine); {
+			for i < len(requestLine) && isSpace(requestLine[i]) {
+				i++
+			}
+			j := i
+			for j < len(requestLine) && !isSpace(requestLine[j]) {
+				j++
+			}
+			if j > i {
+				if count < len(parts) {
+					parts[count] = requestLine[i:j]
+				}
+				count++
+			}
+			i = j
+		}
+	}
+	if count > 3 {
+		return nil, fmt.Errorf("%w: the request-line contains too many parts: %q", ErrMalformedRequestLine, requestLine)
+	}
+	if count < 3 {
+		return nil, fmt.Errorf("%w: the request-line contains too few parts: %q", ErrMalformedRequestLine, requestLine)
+	}
+
+	method := parts[0]
+	if !headers.IsToken(method) {
+		return nil, fmt.Errorf("%w: the method is not formatted correctly: %q", ErrInvalidMethod, requestLine)
+	}
+
+	target := parts[1]
+	if err := validateRequestTarget(method, target, mode); err != nil {
+		return nil, err
 	}
 
-	versionParts := strings.Split(parts[2], "/")
-	if len(versionParts) != 2 {
-		return nil, fmt.Errorf("malformed start-line: %s", requestLine)
+	httpPart, version, ok := strings.Cut(parts[2], "/")
+	if !ok || strings.Contains(version, "/") {
+		return nil, fmt.Errorf("%w: malformed start-line: %q", ErrMalformedRequestLine, requestLine)
 	}
-	if httpPart := versionParts[0]; httpPart != "HTTP" {
-		return nil, fmt.Errorf("unrecognized HTTP-version: %s", httpPart)
+	if httpPart != "HTTP" {
+		return nil, fmt.Errorf("%w: unrecognized HTTP-version: %s", ErrMalformedRequestLine, httpPart)
 	}
-	if version := versionParts[1]; version != "1.1" {
-		return nil, fmt.Errorf("unrecognized HTTP-version: %s", version)
+	if len(version) != 3 || !isDigit(version[0]) || version[1] != '.' || !isDigit(version[2]) {
+		return nil, fmt.Errorf("%w: unrecognized HTTP-version: %s", ErrMalformedRequestLine, version)
+	}
+	if version != "1.1" {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedVersion, version)
 	}
 
 	return &RequestLine{
-		HttpVersion:   versionParts[1],
-		RequestTarget: parts[1],
+		HttpVersion:   version,
+		RequestTarget: target,
 		Method:        method,
 	}, nil
 }
+
+// validateRequestTarget checks the four request-target forms of RFC 9112
+// section 3.2 in strict mode. Lenient mode only rejects control characters.
+func validateRequestTarget(method, target string, mode Mode) error {
+	if target == "" {
+		return fmt.Errorf("%w: empty request-target", ErrInvalidRequestTarget)
+	}
+	if mode != Strict {
+		for i := 0; i < len(target); i++ {
+			if target[i] < 0x21 || target[i] == 0x7f {
+				return fmt.Errorf("%w: %q", ErrInvalidRequestTarget, target)
+			}
+		}
+		return nil
+	}
+
+	for i := 0; i < len(target); i++ {
+		c := target[i]
+		if c == '%' {
+			if i+2 >= len(target) || !isHexDigit(target[i+1]) || !isHexDigit(target[i+2]) {
+				return fmt.Errorf("%w: bad percent-encoding: %q", ErrInvalidRequestTarget, target)
+			}
+			continue
+		}
+		if !isURIChar(c) {
+			return fmt.Errorf("%w: invalid character %q: %q", ErrInvalidRequestTarget, c, target)
+		}
+	}
+
+	switch {
+	case target == "*":
+		if method != "OPTIONS" {
+			return fmt.Errorf("%w: asterisk-form is only allowed for OPTIONS", ErrInvalidRequestTarget)
+		}
+	case method == "CONNECT":
+		host, port, ok := strings.Cut(target, ":")
+		if !ok || host == "" || port == "" || strings.ContainsAny(target, "/?") {
+			return fmt.Errorf("%w: CONNECT needs authority-form: %q", ErrInvalidRequestTarget, target)
+		}
+	case strings.HasPrefix(target, "/"):
+	default:
+		scheme, rest, ok := strings.Cut(target, ":")
+		if !ok || scheme == "" || !isScheme(scheme) || rest == "" {
+			return fmt.Errorf("%w: %q", ErrInvalidRequestTarget, target)
+		}
+	}
+	return nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// isSpace matches the ASCII whitespace the lenient request-line accepts
+// between its parts.
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\v' || c == '\f' || c == '\r'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// isURIChar reports whether c may appear in a request-target: unreserved,
+// sub-delims and the gen-delims that are allowed outside of a fragment.
+func isURIChar(c byte) bool {
+	if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || isDigit(c) {
+		return true
+	}
+	return strings.IndexByte("-._~!$&'()*+,;=:@/?", c) != -1
+}
+
+func isScheme(scheme string) bool {
+	for i := 0; i < len(scheme); i++ {
+		c := scheme[i]
+		letter := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		if i == 0 && !letter {
+			return false
+		}
+		if !letter && !isDigit(c) && c != '+' && c != '-' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
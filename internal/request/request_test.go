@@ -2,8 +2,10 @@ package request
 
 import (
 	"io"
+	"strings"
 	"testing"
 
+	"github.com/ohrelaxo/httpfromtcp/internal/headers"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -214,3 +216,227 @@ func TestBodyParse(t *testing.T) {
 	require.NotNil(t, r)
 	assert.Equal(t, "", string(r.Body))
 }
+
+func TestStrictParse(t *testing.T) {
+	strict := Parser{Mode: Strict}
+
+	// Test: Good strict request
+	reader := &chunkReader{
+		data:            "GET /coffee?beans=arabica%20light HTTP/1.1\r\nHost: localhost:42069\r\nAccept: */*\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := strict.RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "/coffee?beans=arabica%20light", r.RequestLine.RequestTarget)
+	assert.Equal(t, "*/*", r.Headers["accept"])
+
+	// Test: Two part request-line is an error instead of a panic
+	reader = &chunkReader{
+		data:            "GET /coffee\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrMalformedRequestLine)
+	reader.pos = 0
+	_, err = strict.RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrMalformedRequestLine)
+
+	// Test: Methods follow the token rules
+	reader = &chunkReader{
+		data:            "M-SEARCH * HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = strict.RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrInvalidRequestTarget)
+	reader = &chunkReader{
+		data:            "G(T / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = strict.RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrInvalidMethod)
+
+	// Test: Invalid request-target characters
+	reader = &chunkReader{
+		data:            "GET /coffee\"<script> HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = strict.RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrInvalidRequestTarget)
+	reader = &chunkReader{
+		data:            "GET /coffee%zz HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = strict.RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrInvalidRequestTarget)
+
+	// Test: Well formed but unsupported version
+	reader = &chunkReader{
+		data:            "GET / HTTP/2.0\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = strict.RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrUnsupportedVersion)
+
+	// Test: Bare LF is rejected in strict mode but accepted in lenient mode
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\nHost: localhost:42069\n\n",
+		numBytesPerRead: 3,
+	}
+	_, err = strict.RequestFromReader(reader)
+	require.ErrorIs(t, err, headers.ErrLineEnding)
+	reader.pos = 0
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "localhost:42069", r.Headers["host"])
+
+	// Test: Bare CR is rejected in both modes
+	reader = &chunkReader{
+		data:            "GET /\r HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = strict.RequestFromReader(reader)
+	require.ErrorIs(t, err, headers.ErrLineEnding)
+	reader.pos = 0
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, headers.ErrLineEnding)
+
+	// Test: Repeated whitespace in the request-line is only accepted in lenient mode
+	reader = &chunkReader{
+		data:            "GET  /  HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = strict.RequestFromReader(reader)
+	require.Error(t, err)
+	reader.pos = 0
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "/", r.RequestLine.RequestTarget)
+
+	// Test: Obsolete line folding
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nX-Folded: first\r\n second\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = strict.RequestFromReader(reader)
+	require.ErrorIs(t, err, headers.ErrObsoleteLineFolding)
+}
+
+func TestLenientParse(t *testing.T) {
+	// Test: Bare LF line endings, repeated whitespace in the request-line and
+	// trailing whitespace after field lines are accepted
+	reader := &chunkReader{
+		data:            "GET  /coffee  HTTP/1.1\nHost: localhost:42069  \nAccept: */*\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "/coffee", r.RequestLine.RequestTarget)
+	assert.Equal(t, "localhost:42069", r.Headers.Get("Host"))
+	assert.Equal(t, "*/*", r.Headers.Get("Accept"))
+
+	// Test: Field lines starting with whitespace are rejected as in strict
+	// mode
+	for _, data := range []string{
+		"GET / HTTP/1.1\r\n Host: localhost:42069\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost: localhost:42069\r\n\tAccept: */*\r\n\r\n",
+	} {
+		_, err := RequestFromReader(&chunkReader{data: data, numBytesPerRead: 3})
+		assert.ErrorIs(t, err, headers.ErrObsoleteLineFolding, data)
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	// Test: Request-target over the limit
+	reader := &chunkReader{
+		data:            "GET /" + strings.Repeat("a", 100) + " HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 7,
+	}
+	_, err := Parser{MaxTargetLength: 50}.RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrURITooLong)
+
+	// Test: Request-line that never ends
+	reader = &chunkReader{
+		data:            "GET /" + strings.Repeat("a", 1000),
+		numBytesPerRead: 7,
+	}
+	_, err = Parser{MaxTargetLength: 50}.RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrURITooLong)
+
+	// Test: Header section over the limit
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nX-Big: " + strings.Repeat("b", 200) + "\r\n\r\n",
+		numBytesPerRead: 7,
+	}
+	_, err = Parser{MaxHeaderBytes: 100}.RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrHeadersTooLarge)
+
+	// Test: Content-Length over the limit is rejected before reading the body
+	reader = &chunkReader{
+		data:            "POST / HTTP/1.1\r\nHost: localhost:42069\r\nContent-Length: 1000\r\n\r\n",
+		numBytesPerRead: 7,
+	}
+	_, err = Parser{MaxBodyBytes: 100}.RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: Transfer-Codings other than chunked are not supported
+	reader = &chunkReader{
+		data:            "POST / HTTP/1.1\r\nHost: localhost:42069\r\nTransfer-Encoding: gzip, chunked\r\n\r\n",
+		numBytesPerRead: 7,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrUnsupportedTransferCoding)
+
+	// Test: Content-Length that is not a number
+	reader = &chunkReader{
+		data:            "POST / HTTP/1.1\r\nHost: localhost:42069\r\nContent-Length: ten\r\n\r\n",
+		numBytesPerRead: 7,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrInvalidContentLength)
+
+	// Test: Truncated request
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\n",
+		numBytesPerRead: 7,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrIncompleteRequest)
+}
+
+func TestReadHeaders(t *testing.T) {
+	// Test: The body stays on the reader until ReadBody
+	reader := &chunkReader{
+		data:            "POST /submit HTTP/1.1\r\nHost: localhost:42069\r\nContent-Length: 11\r\n\r\nhello world",
+		numBytesPerRead: 7,
+	}
+	r, err := Parser{}.ReadHeaders(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "/submit", r.RequestLine.RequestTarget)
+	assert.Less(t, reader.pos, len(reader.data))
+	body, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(body))
+	assert.Equal(t, "hello world", string(r.Body))
+	body, err = r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(body))
+
+	// Test: A short body is an error from ReadBody, not ReadHeaders
+	reader = &chunkReader{
+		data:            "POST /submit HTTP/1.1\r\nHost: localhost:42069\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhel",
+		numBytesPerRead: 64,
+	}
+	r, err = Parser{}.ReadHeaders(reader)
+	require.NoError(t, err)
+	_, err = r.ReadBody()
+	require.ErrorIs(t, err, ErrIncompleteRequest)
+	_, err = r.ReadBody()
+	require.ErrorIs(t, err, ErrIncompleteRequest)
+
+	// Test: Requests built by hand keep their body
+	r = &Request{Body: []byte("as is")}
+	body, err = r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "as is", string(body))
+}
@@ -0,0 +1,211 @@
+package request
+
+import (
+	"testing"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// smugglingCases are request framing tricks collected from desync research
+// and fuzzing. Every payload must either be rejected or parsed with exactly
+// the body a strict RFC 9112 parser would see, in both modes and for any
+// way the bytes are split across reads.
+var smugglingCases = []struct {
+	name    string
+	data    string
+	wantErr error
+	// strictErr replaces wantErr in strict mode when the payload is already
+	// caught by the field grammar.
+	strictErr error
+	body      string
+}{
+	{
+		name:    "CL.TE",
+		data:    "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 13\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nSMUGGLED",
+		wantErr: ErrConflictingLength,
+	},
+	{
+		name:    "TE.CL",
+		data:    "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nContent-Length: 3\r\n\r\n8\r\nSMUGGLED\r\n0\r\n\r\n",
+		wantErr: ErrConflictingLength,
+	},
+	{
+		name:    "TE.TE obfuscated second header",
+		data:    "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nTransfer-encoding: cow\r\n\r\n0\r\n\r\n",
+		wantErr: ErrInvalidTransferEncoding,
+	},
+	{
+		name:    "TE xchunked",
+		data:    "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: xchunked\r\n\r\n0\r\n\r\n",
+		wantErr: ErrInvalidTransferEncoding,
+	},
+	{
+		name:    "TE chunked twice",
+		data:    "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked, chunked\r\n\r\n0\r\n\r\n",
+		wantErr: ErrInvalidTransferEncoding,
+	},
+	{
+		name:    "TE chunked not last",
+		data:    "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked, identity\r\n\r\n0\r\n\r\n",
+		wantErr: ErrInvalidTransferEncoding,
+	},
+	{
+		name:      "TE with vertical tab",
+		data:      "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\v\r\n\r\n0\r\n\r\n",
+		wantErr:   ErrInvalidTransferEncoding,
+		strictErr: headers.ErrInvalidFieldValue,
+	},
+	{
+		name:    "TE empty",
+		data:    "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: \r\nContent-Length: 5\r\n\r\nhello",
+		wantErr: ErrConflictingLength,
+	},
+	{
+		name:    "space before colon",
+		data:    "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding : chunked\r\n\r\n0\r\n\r\n",
+		wantErr: headers.ErrInvalidFieldName,
+	},
+	{
+		name:    "tab before colon",
+		data:    "POST / HTTP/1.1\r\nHost: a\r\nContent-Length\t: 5\r\n\r\nhello",
+		wantErr: headers.ErrInvalidFieldName,
+	},
+	{
+		name:    "vertical tab in name",
+		data:    "POST / HTTP/1.1\r\nHost: a\r\nContent-Length\v: 5\r\n\r\nhello",
+		wantErr: headers.ErrInvalidFieldName,
+	},
+	{
+		name:    "folded transfer-encoding",
+		data:    "POST / HTTP/1.1\r\nHost: a\r\n Transfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+		wantErr: headers.ErrObsoleteLineFolding,
+	},
+	{
+		name:    "indented first field line",
+		data:    "POST / HTTP/1.1\r\n Transfer-Encoding: chunked\r\nHost: a\r\n\r\n0\r\n\r\n",
+		wantErr: headers.ErrObsoleteLineFolding,
+	},
+	{
+		name:    "empty duplicate content-length",
+		data:    "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nContent-Length: \r\n\r\nhello",
+		wantErr: ErrInvalidContentLength,
+	},
+	{
+		name:    "conflicting duplicate content-length",
+		data:    "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nContent-Length: 10\r\n\r\nhello",
+		wantErr: ErrInvalidContentLength,
+	},
+	{
+		name:    "conflicting content-length list",
+		data:    "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5, 10\r\n\r\nhello",
+		wantErr: ErrInvalidContentLength,
+	},
+	{
+		name: "identical duplicate content-length",
+		data: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nhello",
+		body: "hello",
+	},
+	{
+		name:    "negative content-length",
+		data:    "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: -1\r\n\r\nhello",
+		wantErr: ErrInvalidContentLength,
+	},
+	{
+		name:    "signed content-length",
+		data:    "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: +5\r\n\r\nhello",
+		wantErr: ErrInvalidContentLength,
+	},
+	{
+		name:    "hex content-length",
+		data:    "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 0x5\r\n\r\nhello",
+		wantErr: ErrInvalidContentLength,
+	},
+	{
+		name:    "overflowing content-length",
+		data:    "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 18446744073709551621\r\n\r\nhello",
+		wantErr: ErrInvalidContentLength,
+	},
+	{
+		name:    "empty content-length",
+		data:    "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: \r\n\r\nhello",
+		wantErr: ErrInvalidContentLength,
+	},
+	{
+		name: "content-length leaves next request in the buffer",
+		data: "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\nhelloGET /admin HTTP/1.1\r\n\r\n",
+		body: "hello",
+	},
+	{
+		name: "chunked body",
+		data: "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: Chunked\r\n\r\n5\r\nhello\r\n6;name=value\r\n world\r\n0\r\nX-Trailer: yes\r\n\r\n",
+		body: "hello world",
+	},
+	{
+		name:    "chunk-size with 0x prefix",
+		data:    "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n0x5\r\nhello\r\n0\r\n\r\n",
+		wantErr: ErrMalformedChunk,
+	},
+	{
+		name:    "chunk-size with trailing space",
+		data:    "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5 \r\nhello\r\n0\r\n\r\n",
+		wantErr: ErrMalformedChunk,
+	},
+	{
+		name:    "negative chunk-size",
+		data:    "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n-5\r\nhello\r\n0\r\n\r\n",
+		wantErr: ErrMalformedChunk,
+	},
+	{
+		name:    "overflowing chunk-size",
+		data:    "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\nffffffffffffffff1\r\nhello\r\n0\r\n\r\n",
+		wantErr: ErrMalformedChunk,
+	},
+	{
+		name:    "bare LF after chunk-size",
+		data:    "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5\nhello\r\n0\r\n\r\n",
+		wantErr: ErrMalformedChunk,
+	},
+	{
+		name:    "chunk-data longer than chunk-size",
+		data:    "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nhello\r\n0\r\n\r\n",
+		wantErr: ErrMalformedChunk,
+	},
+	{
+		name:    "bare LF after chunk-data",
+		data:    "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\n0\r\n\r\n",
+		wantErr: ErrMalformedChunk,
+	},
+	{
+		name:    "bare CR in chunk extension",
+		data:    "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5;a\rb\r\nhello\r\n0\r\n\r\n",
+		wantErr: ErrMalformedChunk,
+	},
+	{
+		name:    "chunked body missing last-chunk",
+		data:    "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n",
+		wantErr: ErrIncompleteRequest,
+	},
+}
+
+func TestSmugglingPayloads(t *testing.T) {
+	for _, tc := range smugglingCases {
+		for _, mode := range []Mode{Lenient, Strict} {
+			for _, perRead := range []int{1, 3, len(tc.data)} {
+				reader := &chunkReader{data: tc.data, numBytesPerRead: perRead}
+				r, err := Parser{Mode: mode}.RequestFromReader(reader)
+				wantErr := tc.wantErr
+				if mode == Strict && tc.strictErr != nil {
+					wantErr = tc.strictErr
+				}
+				if wantErr != nil {
+					require.ErrorIs(t, err, wantErr, "%s (mode %d, %d bytes per read)", tc.name, mode, perRead)
+					continue
+				}
+				require.NoError(t, err, "%s (mode %d, %d bytes per read)", tc.name, mode, perRead)
+				assert.Equal(t, tc.body, string(r.Body), tc.name)
+			}
+		}
+	}
+}
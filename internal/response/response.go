@@ -1,9 +1,13 @@
 package response
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"strconv"
+	"strings"
 
 	"github.com/ohrelaxo/httpfromtcp/internal/headers"
 )
@@ -11,6 +15,54 @@ import (
 type Writer struct {
 	writer io.Writer
 	status writerStatus
+
+	// buffered is set in buffered mode, writer then writes into it.
+	buffered *bufio.Writer
+	// held is the header section held back while the body length is not
+	// known yet, body collects the body written in the meantime.
+	held        headers.Headers
+	deferred    bool
+	body        []byte
+	autoChunked bool
+
+	// header backs Header for handlers that use WriteHeader and Write.
+	header headers.Headers
+
+	// chunked and contentLength record the framing of the header section
+	// that was written, written counts the body bytes sent since.
+	chunked       bool
+	contentLength int
+	hasLength     bool
+	written       int
+
+	// trailers holds the field names declared in the Trailer header.
+	trailers map[string]bool
+
+	// code is the final status, omitBody drops the body of responses that
+	// must not have one and heldLength counts a held back body.
+	code       StatusCode
+	omitBody   bool
+	heldLength int
+
+	// lines are added to the header section with AddHeaderLine.
+	lines []headerLine
+	// beforeHeaders run once right before the header section is written,
+	// afterClose once the response is complete.
+	beforeHeaders []func()
+	afterClose    []func()
+
+	// sent counts the body bytes that reach the client.
+	sent int64
+
+	// keepAlive leaves Connection: close out of the defaults, closing
+	// records whether the header section that was written has it.
+	keepAlive bool
+	closing   bool
+}
+
+type headerLine struct {
+	name  string
+	value string
 }
 
 type writerStatus int
@@ -20,16 +72,78 @@ const (
 	statusHeaders
 	statusBody
 	statusTrailer
+	statusDone
 )
 
+// DefaultBufferSize is the buffer size used by NewBufferedWriter when size
+// is not positive.
+const DefaultBufferSize = 4096
+
 type StatusCode int
 
 const (
-	Ok                  StatusCode = 200
-	BadRequest          StatusCode = 400
-	InternalServerError StatusCode = 500
+	Continue                    StatusCode = 100
+	EarlyHints                  StatusCode = 103
+	Ok                          StatusCode = 200
+	NoContent                   StatusCode = 204
+	MovedPermanently            StatusCode = 301
+	Found                       StatusCode = 302
+	SeeOther                    StatusCode = 303
+	NotModified                 StatusCode = 304
+	TemporaryRedirect           StatusCode = 307
+	PermanentRedirect           StatusCode = 308
+	BadRequest                  StatusCode = 400
+	Unauthorized                StatusCode = 401
+	NotFound                    StatusCode = 404
+	MethodNotAllowed            StatusCode = 405
+	ContentTooLarge             StatusCode = 413
+	URITooLong                  StatusCode = 414
+	ExpectationFailed           StatusCode = 417
+	MisdirectedRequest          StatusCode = 421
+	TooManyRequests             StatusCode = 429
+	RequestHeaderFieldsTooLarge StatusCode = 431
+	InternalServerError         StatusCode = 500
+	NotImplemented              StatusCode = 501
+	BadGateway                  StatusCode = 502
+	ServiceUnavailable          StatusCode = 503
+	GatewayTimeout              StatusCode = 504
+	HTTPVersionNotSupported     StatusCode = 505
 )
 
+var statusText = map[StatusCode]string{
+	Continue:                    "Continue",
+	EarlyHints:                  "Early Hints",
+	Ok:                          "OK",
+	NoContent:                   "No Content",
+	MovedPermanently:            "Moved Permanently",
+	Found:                       "Found",
+	SeeOther:                    "See Other",
+	NotModified:                 "Not Modified",
+	TemporaryRedirect:           "Temporary Redirect",
+	PermanentRedirect:           "Permanent Redirect",
+	BadRequest:                  "Bad Request",
+	Unauthorized:                "Unauthorized",
+	NotFound:                    "Not Found",
+	MethodNotAllowed:            "Method Not Allowed",
+	ContentTooLarge:             "Content Too Large",
+	URITooLong:                  "URI Too Long",
+	ExpectationFailed:           "Expectation Failed",
+	MisdirectedRequest:          "Misdirected Request",
+	TooManyRequests:             "Too Many Requests",
+	RequestHeaderFieldsTooLarge: "Request Header Fields Too Large",
+	InternalServerError:         "Internal Server Error",
+	NotImplemented:              "Not Implemented",
+	BadGateway:                  "Bad Gateway",
+	ServiceUnavailable:          "Service Unavailable",
+	GatewayTimeout:              "Gateway Timeout",
+	HTTPVersionNotSupported:     "HTTP Version Not Supported",
+}
+
+// StatusText returns the reason phrase for code, or "" if it is unknown.
+func StatusText(code StatusCode) string {
+	return statusText[code]
+}
+
 func NewWriter(writer io.Writer) *Writer {
 	return &Writer{
 		writer: writer,
@@ -37,24 +151,59 @@ func NewWriter(writer io.Writer) *Writer {
 	}
 }
 
+// NewBufferedWriter returns a Writer that collects the response in a buffer
+// of the given size instead of writing every piece to writer. If the header
+// section sets neither Content-Length nor Transfer-Encoding, the body is held
+// back and Close adds the Content-Length. A body that outgrows the buffer, or
+// a call to Flush, switches the response to chunked encoding instead.
+func NewBufferedWriter(writer io.Writer, size int) *Writer {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	buffered := bufio.NewWriterSize(writer, size)
+	return &Writer{
+		writer:   buffered,
+		status:   statusLine,
+		buffered: buffered,
+	}
+}
+
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
 	if w.status != statusLine {
 		return fmt.Errorf("error: response: %v is getting written in wrong order, current status: %v", statusLine, w.status)
 	}
-	codes := map[StatusCode]string{
-		Ok:                  "OK",
-		BadRequest:          "Bad Request",
-		InternalServerError: "Internal Server Error",
-	}
-	statusLine := fmt.Sprintf("HTTP/1.1 %v %v\r\n", statusCode, codes[statusCode])
+	statusLine := fmt.Sprintf("HTTP/1.1 %v %v\r\n", statusCode, StatusText(statusCode))
 	_, err := w.writer.Write([]byte(statusLine))
 	if err != nil {
 		return err
 	}
+	w.code = statusCode
 	defer func() { w.status = statusHeaders }()
 	return nil
 }
 
+// WriteInformational sends an interim 1xx response, such as 100 Continue or
+// 103 Early Hints, ahead of the final status line. It is flushed right away.
+func (w *Writer) WriteInformational(statusCode StatusCode, h headers.Headers) error {
+	if w.status != statusLine {
+		return fmt.Errorf("error: response: %v is getting written in wrong order, current status: %v", statusLine, w.status)
+	}
+	if statusCode < 100 || statusCode > 199 || statusCode == 101 {
+		return fmt.Errorf("error: response: %d is not an informational status", statusCode)
+	}
+	statusLine := fmt.Sprintf("HTTP/1.1 %v %v\r\n", statusCode, StatusText(statusCode))
+	if _, err := w.writer.Write([]byte(statusLine)); err != nil {
+		return err
+	}
+	if err := w.processHeadersOrTrailers(h); err != nil {
+		return err
+	}
+	if w.buffered == nil {
+		return nil
+	}
+	return w.buffered.Flush()
+}
+
 func GetDefaultHeaders(contentLen int) headers.Headers {
 	header := headers.NewHeaders()
 	header.Set("Content-Length", strconv.Itoa(contentLen))
@@ -67,26 +216,397 @@ func (w *Writer) WriteHeaders(h headers.Headers) error {
 	if w.status != statusHeaders {
 		return fmt.Errorf("error: response: %v is getting written in wrong order, current status: %v", statusHeaders, w.status)
 	}
+	w.runBeforeHeaders()
 	if h == nil {
 		h = GetDefaultHeaders(0)
+		if w.buffered != nil {
+			h.Delete("Content-Length")
+		}
+		if w.keepAlive {
+			h.Delete("Connection")
+		}
+	}
+
+	trailers, err := declaredTrailers(h)
+	if err != nil {
+		return err
 	}
+	w.trailers = trailers
 
 	defer func() { w.status = statusBody }()
-	return w.processHeadersOrTrailers(h)
+	if w.code == NoContent || w.code == NotModified {
+		// These responses never have a body, whatever the handler writes.
+		h = maps.Clone(h)
+		h.Delete("Transfer-Encoding")
+		if w.code == NoContent {
+			h.Delete("Content-Length")
+		}
+		w.omitBody = true
+		return w.writeHeaderSection(h)
+	}
+	if w.buffered != nil && h.Get("Content-Length") == "" && h.Get("Transfer-Encoding") == "" {
+		w.held = h
+		w.deferred = true
+		return nil
+	}
+	w.chunked = strings.Contains(strings.ToLower(h.Get("Transfer-Encoding")), "chunked")
+	if length, err := strconv.Atoi(h.Get("Content-Length")); err == nil && !w.chunked {
+		w.contentLength, w.hasLength = length, true
+	}
+	return w.writeHeaderSection(h)
+}
+
+// OmitBody makes the writer drop the body while the header section is
+// written as usual, including a Content-Length computed from the dropped
+// bytes. It is used for responses to HEAD.
+func (w *Writer) OmitBody() {
+	w.omitBody = true
+}
+
+// KeepAlive leaves Connection: close out of the default fields. The server
+// uses it when the connection stays open for another request.
+func (w *Writer) KeepAlive() {
+	w.keepAlive = true
+}
+
+// ClosesConnection reports whether the header section that was written
+// asks the client to close the connection.
+func (w *Writer) ClosesConnection() bool {
+	return w.closing
+}
+
+// AddHeaderLine adds a field line to the header section that is written
+// as its own line next to the fields of the header map. It is meant for
+// fields that cannot be combined into one value, such as Set-Cookie.
+func (w *Writer) AddHeaderLine(name, value string) error {
+	if w.status != statusLine && w.status != statusHeaders {
+		return fmt.Errorf("error: response: header line %s added after the header section was written", name)
+	}
+	if !headers.IsToken(name) {
+		return fmt.Errorf("%w: %q", headers.ErrInvalidFieldName, name)
+	}
+	if strings.ContainsAny(value, "\x00\r\n") {
+		return fmt.Errorf("%w: %q", headers.ErrInvalidFieldValue, value)
+	}
+	w.lines = append(w.lines, headerLine{name: strings.ToLower(name), value: value})
+	return nil
+}
+
+// Fields returns the fields set so far with Header and AddHeaderLine, with
+// repeated lines joined as a recipient combines them.
+func (w *Writer) Fields() headers.Headers {
+	h := maps.Clone(w.Header())
+	for _, line := range w.lines {
+		h.Put(line.name, line.value)
+	}
+	return h
+}
+
+// BeforeHeaders registers f to run right before the header section is
+// written, while Header and AddHeaderLine can still change it. It is meant
+// for middleware that adds fields depending on what the handler did.
+func (w *Writer) BeforeHeaders(f func()) {
+	w.beforeHeaders = append(w.beforeHeaders, f)
+}
+
+// AfterClose registers f to run once Close has completed the response, when
+// Status and BodyBytes are final.
+func (w *Writer) AfterClose(f func()) {
+	w.afterClose = append(w.afterClose, f)
+}
+
+// Capture copies everything written to the connection from now on to c,
+// the response is still sent as it is written. c must not fail.
+func (w *Writer) Capture(c io.Writer) {
+	w.writer = io.MultiWriter(w.writer, c)
+}
+
+// Status returns the final status code, or 0 if none was written yet.
+func (w *Writer) Status() StatusCode {
+	return w.code
+}
+
+// BodyBytes returns the number of body bytes written so far, not counting
+// chunked framing or a body that is omitted.
+func (w *Writer) BodyBytes() int64 {
+	return w.sent
+}
+
+func (w *Writer) runBeforeHeaders() {
+	hooks := w.beforeHeaders
+	w.beforeHeaders = nil
+	for _, f := range hooks {
+		f()
+	}
+}
+
+// writeHeaderSection writes the header section and stops the body from
+// reaching the connection when it is to be omitted.
+func (w *Writer) writeHeaderSection(h headers.Headers) error {
+	w.closing = hasCloseOption(h.Get("Connection"))
+	for _, line := range w.lines {
+		if line.name == "connection" && hasCloseOption(line.value) {
+			w.closing = true
+		}
+	}
+	if err := w.processHeadersOrTrailers(h, w.lines...); err != nil {
+		return err
+	}
+	if w.omitBody {
+		w.writer = io.Discard
+	}
+	return nil
+}
+
+func hasCloseOption(value string) bool {
+	for option := range strings.SplitSeq(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(option), "close") {
+			return true
+		}
+	}
+	return false
+}
+
+// Header returns the header map that WriteHeader, or the first Write, sends.
+// Changes made after that have no effect.
+func (w *Writer) Header() headers.Headers {
+	if w.header == nil {
+		w.header = headers.NewHeaders()
+	}
+	return w.header
+}
+
+// WriteHeader writes the status line and the fields from Header, adding the
+// defaults of GetDefaultHeaders for fields that are not set. Without a
+// Content-Length the body is sent chunked, a buffered writer decides that
+// on Close.
+func (w *Writer) WriteHeader(statusCode StatusCode) error {
+	if err := w.WriteStatusLine(statusCode); err != nil {
+		return err
+	}
+	return w.writeHeaderMap()
+}
+
+func (w *Writer) writeHeaderMap() error {
+	w.runBeforeHeaders()
+	h := maps.Clone(w.Header())
+	for key, value := range GetDefaultHeaders(0) {
+		if key == "connection" && w.keepAlive {
+			continue
+		}
+		if key != "content-length" && h.Get(key) == "" {
+			h.Set(key, value)
+		}
+	}
+	// Trailers need a chunked body, so a buffered writer cannot wait for
+	// the length either.
+	chunked := h.Get("Content-Length") == "" && h.Get("Transfer-Encoding") == "" &&
+		(w.buffered == nil || h.Get("Trailer") != "")
+	if chunked {
+		h.Set("Transfer-Encoding", "chunked")
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return err
+	}
+	w.autoChunked = chunked && w.chunked
+	return nil
+}
+
+// Write writes p as part of the body. The status line and the header section
+// are written first if that has not happened yet, with status 200 unless
+// WriteStatusLine was called.
+func (w *Writer) Write(p []byte) (int, error) {
+	switch w.status {
+	case statusLine:
+		if err := w.WriteHeader(Ok); err != nil {
+			return 0, err
+		}
+	case statusHeaders:
+		if err := w.writeHeaderMap(); err != nil {
+			return 0, err
+		}
+	}
+	return w.WriteBody(p)
 }
 
 func (w *Writer) WriteBody(p []byte) (int, error) {
+	n, err := w.writeBody(p)
+	if !w.omitBody {
+		w.sent += int64(n)
+	}
+	return n, err
+}
+
+func (w *Writer) writeBody(p []byte) (int, error) {
 	if w.status != statusBody {
 		return 0, fmt.Errorf("error: response: %v is getting written in wrong order, current status: %v", statusBody, w.status)
 	}
-	return w.writer.Write(p)
+	if w.deferred {
+		if w.omitBody {
+			w.heldLength += len(p)
+			return len(p), nil
+		}
+		if len(w.body)+len(p) <= w.buffered.Size() {
+			w.body = append(w.body, p...)
+			w.heldLength += len(p)
+			return len(p), nil
+		}
+		if err := w.startChunked(); err != nil {
+			return 0, err
+		}
+	}
+	if w.autoChunked {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		if _, err := w.writeChunk(p); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	n, err := w.writer.Write(p)
+	w.written += n
+	return n, err
+}
+
+// startChunked writes the held back header section with chunked encoding
+// once the body no longer fits into the buffer.
+func (w *Writer) startChunked() error {
+	w.deferred = false
+	w.autoChunked = true
+	w.chunked = true
+	w.held.Set("Transfer-Encoding", "chunked")
+	if err := w.writeHeaderSection(w.held); err != nil {
+		return err
+	}
+	body := w.body
+	w.body = nil
+	if len(body) == 0 {
+		return nil
+	}
+	_, err := w.writeChunk(body)
+	return err
+}
+
+// Flush writes everything buffered so far to the connection. A response
+// whose length is still unknown continues with chunked encoding.
+func (w *Writer) Flush() error {
+	if w.buffered == nil {
+		return nil
+	}
+	if w.deferred {
+		if err := w.startChunked(); err != nil {
+			return err
+		}
+	}
+	return w.buffered.Flush()
+}
+
+// Started reports whether the final status line was written.
+func (w *Writer) Started() bool {
+	return w.status != statusLine
+}
+
+// Unfinished describes what the handler left open in the response, or
+// returns "" if Close only has to do its regular work. A body that is
+// shorter than its Content-Length is reported but cannot be completed.
+func (w *Writer) Unfinished() string {
+	switch w.status {
+	case statusLine:
+		return "nothing was written"
+	case statusHeaders:
+		return "only the status line was written"
+	case statusBody:
+		switch {
+		case w.deferred || w.autoChunked:
+			return ""
+		case w.chunked:
+			return "chunked body without last-chunk"
+		case w.hasLength && w.written < w.contentLength && !w.omitBody:
+			return fmt.Sprintf("body is %d of %d bytes", w.written, w.contentLength)
+		}
+	case statusTrailer:
+		return "trailer section was not terminated"
+	}
+	return ""
+}
+
+// Close completes the response: a held back header section gets the
+// Content-Length of the collected body and an open chunked body gets its
+// last-chunk. If nothing was written a 500 is sent, a lone status line gets
+// the header section from Header. A buffered writer is flushed at the end.
+func (w *Writer) Close() error {
+	err := w.close()
+	hooks := w.afterClose
+	w.afterClose = nil
+	for _, f := range hooks {
+		f()
+	}
+	return err
+}
+
+func (w *Writer) close() error {
+	if err := w.complete(); err != nil {
+		return err
+	}
+	if w.buffered == nil {
+		return nil
+	}
+	return w.buffered.Flush()
+}
+
+func (w *Writer) complete() error {
+	switch w.status {
+	case statusDone:
+		return nil
+	case statusLine:
+		if err := w.WriteStatusLine(InternalServerError); err != nil {
+			return err
+		}
+		if err := w.WriteHeaders(GetDefaultHeaders(0)); err != nil {
+			return err
+		}
+	case statusHeaders:
+		if err := w.writeHeaderMap(); err != nil {
+			return err
+		}
+	}
+	defer func() { w.status = statusDone }()
+	switch {
+	case w.status == statusTrailer:
+		_, err := w.writer.Write([]byte("\r\n"))
+		return err
+	case w.deferred:
+		w.deferred = false
+		w.held.Set("Content-Length", strconv.Itoa(w.heldLength))
+		if err := w.writeHeaderSection(w.held); err != nil {
+			return err
+		}
+		_, err := w.writer.Write(w.body)
+		w.body = nil
+		return err
+	case w.chunked:
+		_, err := w.writer.Write([]byte("0\r\n\r\n"))
+		return err
+	}
+	return nil
 }
 
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 	if w.status != statusBody {
 		return 0, fmt.Errorf("error: response: %v is getting written in wrong order, current status: %v", statusBody, w.status)
 	}
+	if !w.chunked {
+		return 0, errors.New("error: response: chunked body without a Transfer-Encoding header")
+	}
+	n, err := w.writeChunk(p)
+	if err == nil && !w.omitBody {
+		w.sent += int64(len(p))
+	}
+	return n, err
+}
 
+func (w *Writer) writeChunk(p []byte) (int, error) {
 	lenData := len(p)
 	hex := strconv.FormatInt(int64(lenData), 16)
 	body := hex + "\r\n" + string(p) + "\r\n"
@@ -97,33 +617,43 @@ func (w *Writer) WriteChunkedBodyDone() (int, error) {
 	if w.status != statusBody {
 		return 0, fmt.Errorf("error: response: %v is getting written in wrong order, current status: %v", statusBody, w.status)
 	}
+	if !w.chunked {
+		return 0, errors.New("error: response: chunked body without a Transfer-Encoding header")
+	}
 	defer func() { w.status = statusTrailer }()
 	return w.writer.Write([]byte("0\r\n"))
 }
 
+// WriteTrailers ends a chunked body with the trailer section. Every field
+// must be declared in the Trailer header of the response, nil h writes an
+// empty section.
 func (w *Writer) WriteTrailers(h headers.Headers) error {
 	if w.status != statusTrailer {
 		return fmt.Errorf("error: response: %v (Trailers) is getting written in wrong order, current status: %v", statusTrailer, w.status)
 	}
-
-	/*
-		_, err := w.writer.Write([]byte("0\r\n"))
-		if err != nil {
+	for name := range h {
+		if err := w.checkTrailer(name); err != nil {
 			return err
 		}
+	}
 
-	*/
-
+	defer func() { w.status = statusDone }()
 	return w.processHeadersOrTrailers(h)
 }
 
-func (w *Writer) processHeadersOrTrailers(h headers.Headers) error {
+func (w *Writer) processHeadersOrTrailers(h headers.Headers, lines ...headerLine) error {
 	for k, v := range h {
 		_, err := w.writer.Write([]byte(k + ": " + v + "\r\n"))
 		if err != nil {
 			return err
 		}
 	}
+	for _, line := range lines {
+		_, err := w.writer.Write([]byte(line.name + ": " + line.value + "\r\n"))
+		if err != nil {
+			return err
+		}
+	}
 	_, err := w.writer.Write([]byte("\r\n"))
 	if err != nil {
 		return err
@@ -0,0 +1,249 @@
+package response
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingWriter records every Write call it receives.
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.writes++
+	return c.Buffer.Write(p)
+}
+
+func TestBufferedWriter(t *testing.T) {
+	// Test: Content-Length is added when the body fits into the buffer
+	out := &countingWriter{}
+	w := NewBufferedWriter(out, 256)
+	require.NoError(t, w.WriteStatusLine(Ok))
+	require.NoError(t, w.WriteHeaders(nil))
+	_, err := w.WriteBody([]byte("hello "))
+	require.NoError(t, err)
+	_, err = w.WriteBody([]byte("world"))
+	require.NoError(t, err)
+	assert.Equal(t, 0, out.writes)
+	require.NoError(t, w.Close())
+	assert.Equal(t, 1, out.writes)
+	assert.True(t, strings.HasPrefix(out.String(), "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out.String(), "content-length: 11\r\n")
+	assert.NotContains(t, out.String(), "transfer-encoding")
+	assert.True(t, strings.HasSuffix(out.String(), "\r\n\r\nhello world"))
+
+	// Test: A body larger than the buffer switches to chunked encoding
+	out = &countingWriter{}
+	w = NewBufferedWriter(out, 16)
+	require.NoError(t, w.WriteStatusLine(Ok))
+	require.NoError(t, w.WriteHeaders(nil))
+	_, err = w.WriteBody([]byte("0123456789"))
+	require.NoError(t, err)
+	_, err = w.WriteBody([]byte("abcdefghij"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	assert.Contains(t, out.String(), "transfer-encoding: chunked\r\n")
+	assert.NotContains(t, out.String(), "content-length")
+	assert.True(t, strings.HasSuffix(out.String(), "\r\n\r\na\r\n0123456789\r\na\r\nabcdefghij\r\n0\r\n\r\n"))
+
+	// Test: Flush streams a response of unknown length as chunks
+	out = &countingWriter{}
+	w = NewBufferedWriter(out, 64)
+	require.NoError(t, w.WriteStatusLine(Ok))
+	require.NoError(t, w.WriteHeaders(nil))
+	_, err = w.WriteBody([]byte("event"))
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	assert.True(t, strings.HasSuffix(out.String(), "\r\n\r\n5\r\nevent\r\n"))
+	require.NoError(t, w.Close())
+	assert.True(t, strings.HasSuffix(out.String(), "5\r\nevent\r\n0\r\n\r\n"))
+
+	// Test: An explicit Content-Length is written as is
+	out = &countingWriter{}
+	w = NewBufferedWriter(out, 64)
+	require.NoError(t, w.WriteStatusLine(Ok))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(3)))
+	_, err = w.WriteBody([]byte("abc"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	assert.Contains(t, out.String(), "content-length: 3\r\n")
+	assert.True(t, strings.HasSuffix(out.String(), "\r\n\r\nabc"))
+
+	// Test: Explicit chunked encoding with trailers is left alone
+	out = &countingWriter{}
+	w = NewBufferedWriter(out, 64)
+	require.NoError(t, w.WriteStatusLine(Ok))
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Sum")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteChunkedBody([]byte("abc"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Sum", "1")
+	require.NoError(t, w.WriteTrailers(trailers))
+	require.NoError(t, w.Close())
+	assert.True(t, strings.HasSuffix(out.String(), "\r\n\r\n3\r\nabc\r\n0\r\nx-sum: 1\r\n\r\n"))
+
+	// Test: Chunked writes need a Transfer-Encoding header
+	w = NewBufferedWriter(&countingWriter{}, 64)
+	require.NoError(t, w.WriteStatusLine(Ok))
+	require.NoError(t, w.WriteHeaders(nil))
+	_, err = w.WriteChunkedBody([]byte("abc"))
+	require.Error(t, err)
+
+	// Test: Nothing can be written after Close
+	w = NewBufferedWriter(&countingWriter{}, 64)
+	require.NoError(t, w.Close())
+	require.Error(t, w.WriteStatusLine(Ok))
+}
+
+func TestImplicitHeaders(t *testing.T) {
+	// Test: The first Write sends a 200 with the header map and defaults
+	out := &countingWriter{}
+	w := NewBufferedWriter(out, 256)
+	w.Header().Set("Content-Type", "text/html")
+	_, err := w.Write([]byte("<p>hi</p>"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	assert.True(t, strings.HasPrefix(out.String(), "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out.String(), "content-type: text/html\r\n")
+	assert.Contains(t, out.String(), "connection: close\r\n")
+	assert.Contains(t, out.String(), "content-length: 9\r\n")
+	assert.True(t, strings.HasSuffix(out.String(), "\r\n\r\n<p>hi</p>"))
+
+	// Test: WriteHeader sets the status, later changes to the map are ignored
+	out = &countingWriter{}
+	w = NewBufferedWriter(out, 256)
+	require.NoError(t, w.WriteHeader(InternalServerError))
+	w.Header().Set("X-Late", "1")
+	_, err = w.Write([]byte("oops"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	assert.True(t, strings.HasPrefix(out.String(), "HTTP/1.1 500 Internal Server Error\r\n"))
+	assert.NotContains(t, out.String(), "x-late")
+	require.Error(t, w.WriteHeader(Ok))
+
+	// Test: An explicit status line is followed by the header map on Write
+	out = &countingWriter{}
+	w = NewBufferedWriter(out, 256)
+	require.NoError(t, w.WriteStatusLine(BadRequest))
+	_, err = w.Write([]byte("bad"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	assert.True(t, strings.HasPrefix(out.String(), "HTTP/1.1 400 Bad Request\r\n"))
+	assert.Contains(t, out.String(), "content-length: 3\r\n")
+
+	// Test: An unbuffered writer without Content-Length falls back to chunked
+	out = &countingWriter{}
+	w = NewWriter(out)
+	_, err = w.Write([]byte("abc"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	assert.Contains(t, out.String(), "transfer-encoding: chunked\r\n")
+	assert.True(t, strings.HasSuffix(out.String(), "\r\n\r\n3\r\nabc\r\n0\r\n\r\n"))
+
+	// Test: An unbuffered writer keeps a Content-Length from the map
+	out = &countingWriter{}
+	w = NewWriter(out)
+	w.Header().Set("Content-Length", "3")
+	_, err = w.Write([]byte("abc"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	assert.NotContains(t, out.String(), "transfer-encoding")
+	assert.True(t, strings.HasSuffix(out.String(), "\r\n\r\nabc"))
+}
+
+func TestUnfinished(t *testing.T) {
+	// Test: Every open state is reported
+	w := NewWriter(&countingWriter{})
+	assert.Equal(t, "nothing was written", w.Unfinished())
+	require.NoError(t, w.WriteStatusLine(Ok))
+	assert.Equal(t, "only the status line was written", w.Unfinished())
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	assert.Equal(t, "body is 0 of 5 bytes", w.Unfinished())
+	_, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	assert.Empty(t, w.Unfinished())
+
+	// Test: Held back and automatically chunked bodies are regular work for Close
+	w = NewBufferedWriter(&countingWriter{}, 64)
+	_, err = w.Write([]byte("abc"))
+	require.NoError(t, err)
+	assert.Empty(t, w.Unfinished())
+
+	// Test: Close sends a 500 if nothing was written
+	out := &countingWriter{}
+	w = NewBufferedWriter(out, 256)
+	require.NoError(t, w.Close())
+	assert.True(t, strings.HasPrefix(out.String(), "HTTP/1.1 500 Internal Server Error\r\n"))
+	assert.Contains(t, out.String(), "content-length: 0\r\n")
+	assert.Empty(t, w.Unfinished())
+}
+
+func TestTrailers(t *testing.T) {
+	chunkedHeaders := func(trailer string) headers.Headers {
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Trailer", trailer)
+		return h
+	}
+
+	// Test: Forbidden fields cannot be declared
+	w := NewWriter(&countingWriter{})
+	require.NoError(t, w.WriteStatusLine(Ok))
+	require.ErrorIs(t, w.WriteHeaders(chunkedHeaders("X-Sum, Content-Length")), ErrForbiddenTrailer)
+
+	// Test: Undeclared trailer fields are rejected
+	w = NewWriter(&countingWriter{})
+	require.NoError(t, w.WriteStatusLine(Ok))
+	require.NoError(t, w.WriteHeaders(chunkedHeaders("X-Sum")))
+	_, err := w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Other", "1")
+	require.ErrorIs(t, w.WriteTrailers(trailers), ErrUndeclaredTrailer)
+
+	// Test: Forbidden trailer fields are rejected even without a declaration
+	trailers = headers.NewHeaders()
+	trailers.Set("Host", "example.com")
+	require.ErrorIs(t, w.WriteTrailers(trailers), ErrForbiddenTrailer)
+
+	// Test: Close writes an empty trailer section if none was written
+	out := &countingWriter{}
+	w = NewWriter(out)
+	require.NoError(t, w.WriteStatusLine(Ok))
+	require.NoError(t, w.WriteHeaders(chunkedHeaders("X-Sum")))
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	assert.True(t, strings.HasSuffix(out.String(), "\r\n\r\n0\r\n\r\n"))
+
+	// Test: DigestWriter sends SHA-256, CRC32 and length of the body
+	out = &countingWriter{}
+	w = NewBufferedWriter(out, 256)
+	w.Header().Set("Trailer", DigestTrailerNames)
+	require.NoError(t, w.WriteHeader(Ok))
+	digest := NewDigestWriter(w)
+	_, err = digest.Write([]byte("hello "))
+	require.NoError(t, err)
+	_, err = digest.Write([]byte("world"))
+	require.NoError(t, err)
+	require.NoError(t, digest.Close())
+	require.NoError(t, w.Close())
+	assert.Contains(t, out.String(), "transfer-encoding: chunked\r\n")
+	assert.Contains(t, out.String(), "6\r\nhello \r\n5\r\nworld\r\n0\r\n")
+	assert.Contains(t, out.String(), "x-content-sha256: b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9\r\n")
+	assert.Contains(t, out.String(), "x-content-crc32: 0d4a1185\r\n")
+	assert.Contains(t, out.String(), "x-content-length: 11\r\n")
+	assert.True(t, strings.HasSuffix(out.String(), "\r\n\r\n"))
+}
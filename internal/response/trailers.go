@@ -0,0 +1,147 @@
+package response
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"strconv"
+	"strings"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/headers"
+)
+
+var (
+	ErrForbiddenTrailer  = errors.New("field is not allowed in trailers")
+	ErrUndeclaredTrailer = errors.New("trailer field was not declared")
+)
+
+// forbiddenTrailers are the fields a recipient needs before the body, for
+// framing, routing, authentication, caching or handling the content, see
+// RFC 9110 section 6.5.1.
+var forbiddenTrailers = map[string]bool{
+	"age":                 true,
+	"authorization":       true,
+	"cache-control":       true,
+	"connection":          true,
+	"content-encoding":    true,
+	"content-length":      true,
+	"content-range":       true,
+	"content-type":        true,
+	"date":                true,
+	"expect":              true,
+	"expires":             true,
+	"host":                true,
+	"if-match":            true,
+	"if-modified-since":   true,
+	"if-none-match":       true,
+	"if-range":            true,
+	"if-unmodified-since": true,
+	"keep-alive":          true,
+	"location":            true,
+	"max-forwards":        true,
+	"pragma":              true,
+	"proxy-authenticate":  true,
+	"proxy-authorization": true,
+	"range":               true,
+	"retry-after":         true,
+	"set-cookie":          true,
+	"te":                  true,
+	"trailer":             true,
+	"transfer-encoding":   true,
+	"upgrade":             true,
+	"vary":                true,
+	"www-authenticate":    true,
+}
+
+// declaredTrailers reads the field names listed in the Trailer header of h.
+func declaredTrailers(h headers.Headers) (map[string]bool, error) {
+	value := h.Get("Trailer")
+	if value == "" {
+		return nil, nil
+	}
+	declared := map[string]bool{}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if !headers.IsToken(name) {
+			return nil, fmt.Errorf("%w: %q", headers.ErrInvalidFieldName, name)
+		}
+		if forbiddenTrailers[name] {
+			return nil, fmt.Errorf("%w: %s", ErrForbiddenTrailer, name)
+		}
+		declared[name] = true
+	}
+	return declared, nil
+}
+
+func (w *Writer) checkTrailer(name string) error {
+	name = strings.ToLower(name)
+	if forbiddenTrailers[name] {
+		return fmt.Errorf("%w: %s", ErrForbiddenTrailer, name)
+	}
+	if !w.trailers[name] {
+		return fmt.Errorf("%w: %s", ErrUndeclaredTrailer, name)
+	}
+	return nil
+}
+
+// Names of the trailer fields written by DigestWriter.
+const (
+	TrailerContentSHA256 = "X-Content-SHA256"
+	TrailerContentCRC32  = "X-Content-CRC32"
+	TrailerContentLength = "X-Content-Length"
+)
+
+// DigestWriter writes a chunked body and hashes it on the way, so the digest
+// of the streamed content can be sent in the trailers. Declare Trailer with
+// DigestTrailerNames before the header section is written.
+type DigestWriter struct {
+	w      *Writer
+	sha256 hash.Hash
+	crc32  hash.Hash32
+	length int
+}
+
+// DigestTrailerNames is the value for the Trailer header of a response that
+// is written with a DigestWriter.
+const DigestTrailerNames = TrailerContentSHA256 + ", " + TrailerContentCRC32 + ", " + TrailerContentLength
+
+func NewDigestWriter(w *Writer) *DigestWriter {
+	return &DigestWriter{w: w, sha256: sha256.New(), crc32: crc32.NewIEEE()}
+}
+
+// Write writes p as one chunk and adds it to the digests.
+func (d *DigestWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if _, err := d.w.WriteChunkedBody(p); err != nil {
+		return 0, err
+	}
+	d.sha256.Write(p)
+	d.crc32.Write(p)
+	d.length += len(p)
+	return len(p), nil
+}
+
+// Trailers returns the digest fields for everything written so far.
+func (d *DigestWriter) Trailers() headers.Headers {
+	trailers := headers.NewHeaders()
+	trailers.Set(TrailerContentSHA256, hex.EncodeToString(d.sha256.Sum(nil)))
+	trailers.Set(TrailerContentCRC32, fmt.Sprintf("%08x", d.crc32.Sum32()))
+	trailers.Set(TrailerContentLength, strconv.Itoa(d.length))
+	return trailers
+}
+
+// Close ends the chunked body and writes the digest trailers.
+func (d *DigestWriter) Close() error {
+	if _, err := d.w.WriteChunkedBodyDone(); err != nil {
+		return err
+	}
+	return d.w.WriteTrailers(d.Trailers())
+}
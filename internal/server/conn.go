@@ -0,0 +1,250 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/http2"
+	"github.com/ohrelaxo/httpfromtcp/internal/request"
+	"github.com/ohrelaxo/httpfromtcp/internal/response"
+)
+
+// defaultIdleTimeout closes persistent connections that wait this long for
+// another request.
+const defaultIdleTimeout = time.Minute
+
+// conn serves the HTTP/1.1 requests of one connection. Requests are read
+// in their own goroutine while earlier ones are answered, the responses are
+// written one after the other in request order.
+type conn struct {
+	s       *Server
+	netConn net.Conn
+	in      *pendingReader
+	// ctx is the parent of the request contexts, it is cancelled when the
+	// client goes away.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// queue carries the requests that were read, slots holds one element
+	// per request read but not answered yet.
+	queue    chan *exchange
+	slots    chan struct{}
+	quit     chan struct{}
+	done     chan struct{}
+	stopping atomic.Bool
+	inFlight atomic.Int64
+}
+
+// exchange is one request read off the connection and its response.
+type exchange struct {
+	req    *request.Request
+	cancel context.CancelFunc
+	writer *response.Writer
+	// err is set when the request could not be read, last when no request
+	// may follow it on the connection and handover when the handler or the
+	// http2 package read from the connection after the header section.
+	err      error
+	last     bool
+	handover bool
+}
+
+func newConn(s *Server, netConn net.Conn, reader *bufio.Reader) *conn {
+	ctx, cancel := context.WithCancel(s.ctx)
+	depth := max(s.pipelineDepth, 1)
+	return &conn{
+		s:       s,
+		netConn: netConn,
+		in:      &pendingReader{reader: reader},
+		ctx:     ctx,
+		cancel:  cancel,
+		queue:   make(chan *exchange, depth),
+		slots:   make(chan struct{}, depth),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// serve answers requests until the connection ends. The caller closes the
+// connection afterwards.
+func (c *conn) serve() {
+	go c.readRequests()
+	defer c.stop()
+	for ex := range c.queue {
+		if !c.respond(ex) {
+			return
+		}
+	}
+}
+
+// stop ends the reading goroutine. It closes the connection, which is the
+// only way to interrupt a read that has no deadline.
+func (c *conn) stop() {
+	c.stopping.Store(true)
+	close(c.quit)
+	c.netConn.Close()
+	<-c.done
+	c.cancel()
+}
+
+// readRequests reads requests until one is the last on the connection or
+// the depth of the pipeline is reached, then waits for an answer first.
+func (c *conn) readRequests() {
+	defer close(c.done)
+	defer close(c.queue)
+	for first := true; ; first = false {
+		if !first && !c.waitForRequest() {
+			return
+		}
+		select {
+		case c.slots <- struct{}{}:
+		case <-c.quit:
+			return
+		}
+		ex := c.readRequest()
+		c.inFlight.Add(1)
+		select {
+		case c.queue <- ex:
+		case <-c.quit:
+			return
+		}
+		if ex.err != nil || ex.handover {
+			return
+		}
+		if ex.last {
+			// Only watch for the client going away.
+			c.waitForRequest()
+			return
+		}
+	}
+}
+
+// readRequest reads the next request and, unless the handler asks for it
+// with Expect: 100-continue, its body.
+func (c *conn) readRequest() *exchange {
+	writer := response.NewBufferedWriter(c.netConn, response.DefaultBufferSize)
+	ex := &exchange{writer: writer, last: true}
+	body := &continueReader{reader: c.in, writer: writer}
+	req, err := c.s.parser.ReadHeaders(body)
+	if err == nil {
+		req.RemoteAddr = c.netConn.RemoteAddr().String()
+		err = c.s.expect(req, body)
+	}
+	if err != nil {
+		if !c.stopping.Load() {
+			c.s.metrics.parseErrors.Add(1)
+		}
+		ex.err = err
+		return ex
+	}
+	if !body.armed {
+		c.in.pending = req.Unread()
+	}
+	// The request timeout only starts once the handler does, requests
+	// read ahead are just cancelled with the connection.
+	ctx, cancel := context.WithCancel(c.ctx)
+	ex.req, ex.cancel = req.WithContext(ctx), cancel
+	// A request with Expect: 100-continue ends the pipeline, since the body
+	// the client may still send cannot be told apart from the next request.
+	ex.handover = body.armed || http2.IsUpgradeRequest(req)
+	ex.last = c.s.pipelineDepth == 0 || ex.handover || !keepAlive(req)
+	return ex
+}
+
+// waitForRequest waits until the next request starts to arrive. It reports
+// false when the connection ends, which cancels the requests in flight, or
+// has been idle for too long.
+func (c *conn) waitForRequest() bool {
+	for len(c.in.pending) == 0 {
+		var deadline time.Time
+		if c.s.idleTimeout > 0 {
+			deadline = time.Now().Add(c.s.idleTimeout)
+		}
+		c.netConn.SetReadDeadline(deadline)
+		_, err := c.in.reader.Peek(1)
+		if c.stopping.Load() {
+			return false
+		}
+		if err == nil {
+			c.netConn.SetReadDeadline(time.Time{})
+			return true
+		}
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			c.cancel()
+			return false
+		}
+		// The connection is only idle once every request was answered.
+		if c.inFlight.Load() == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// respond writes the response to ex and reports whether the connection
+// stays open for the next one.
+func (c *conn) respond(ex *exchange) bool {
+	defer func() { <-c.slots }()
+	defer c.inFlight.Add(-1)
+	if ex.err != nil {
+		log.Printf("request failed: %v\n", ex.err)
+		c.s.errorRenderer(ex.writer, StatusForError(ex.err), ex.err)
+		finishResponse(ex.writer, nil)
+		return false
+	}
+	defer ex.cancel()
+
+	if http2.IsUpgradeRequest(ex.req) {
+		err := http2.ServeUpgrade(c.s.ctx, &bufferedConn{Conn: c.netConn, reader: c.in}, ex.req, c.s.http2Handler, c.s.http2Options())
+		if err != nil {
+			log.Printf("h2c upgrade failed: %v\n", err)
+		}
+		return false
+	}
+
+	if ex.req.RequestLine.Method == "HEAD" {
+		ex.writer.OmitBody()
+	}
+	if !ex.last {
+		ex.writer.KeepAlive()
+	}
+	ctx, cancel := c.s.requestContext(ex.req.Context())
+	defer cancel()
+	ex.req = ex.req.WithContext(ctx)
+	c.s.serveRequest(ex.writer, ex.req)
+	finishResponse(ex.writer, ex.req)
+	return !ex.last && !ex.writer.ClosesConnection()
+}
+
+// keepAlive reports whether the client lets the connection stay open after
+// req.
+func keepAlive(req *request.Request) bool {
+	for option := range strings.SplitSeq(req.Headers.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(option), "close") {
+			return false
+		}
+	}
+	return true
+}
+
+// pendingReader returns the bytes a request read past its end before it
+// reads from the connection again.
+type pendingReader struct {
+	pending []byte
+	reader  *bufio.Reader
+}
+
+func (p *pendingReader) Read(b []byte) (int, error) {
+	if len(p.pending) > 0 {
+		n := copy(b, p.pending)
+		p.pending = p.pending[n:]
+		return n, nil
+	}
+	return p.reader.Read(b)
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/request"
+	"github.com/ohrelaxo/httpfromtcp/internal/response"
+)
+
+// ErrExpectationFailed is returned for an Expect header other than
+// 100-continue.
+var ErrExpectationFailed = errors.New("unsupported expectation")
+
+// ErrorRenderer writes the complete response for a request that failed to
+// parse. err is only meant for logging, it should not reach the client.
+type ErrorRenderer func(w *response.Writer, code response.StatusCode, err error)
+
+// StatusForError maps an error returned by the request parser to the
+// status code that describes it best.
+func StatusForError(err error) response.StatusCode {
+	switch {
+	case errors.Is(err, request.ErrUnsupportedVersion):
+		return response.HTTPVersionNotSupported
+	case errors.Is(err, request.ErrBodyTooLarge):
+		return response.ContentTooLarge
+	case errors.Is(err, request.ErrURITooLong):
+		return response.URITooLong
+	case errors.Is(err, request.ErrHeadersTooLarge):
+		return response.RequestHeaderFieldsTooLarge
+	case errors.Is(err, request.ErrUnsupportedTransferCoding):
+		return response.NotImplemented
+	case errors.Is(err, ErrExpectationFailed):
+		return response.ExpectationFailed
+	default:
+		return response.BadRequest
+	}
+}
+
+// DefaultErrorRenderer writes a small HTML page that only contains the
+// status code and its reason phrase.
+func DefaultErrorRenderer(w *response.Writer, code response.StatusCode, err error) {
+	text := response.StatusText(code)
+	body := fmt.Sprintf("<html><head><title>%d %s</title></head><body><h1>%s</h1></body></html>", code, text, text)
+	header := response.GetDefaultHeaders(len(body))
+	header.Set("Content-Type", "text/html")
+	w.WriteStatusLine(code)
+	w.WriteHeaders(header)
+	w.WriteBody([]byte(body))
+}
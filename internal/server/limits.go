@@ -0,0 +1,134 @@
+package server
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/response"
+)
+
+// FullBehavior decides what happens to connections beyond the limit set
+// with WithMaxConnections.
+type FullBehavior int
+
+const (
+	// QueueWhenFull holds new connections until a served one ends.
+	QueueWhenFull FullBehavior = iota
+	// RejectWhenFull answers new connections with 503 and closes them.
+	RejectWhenFull
+)
+
+// rejectTimeout bounds the time spent on a rejected client.
+const rejectTimeout = time.Second
+
+// maxRejectDrain is how much of the request of a rejected client is read.
+const maxRejectDrain = 64 << 10
+
+// WithMaxConnections limits the number of connections served at once.
+func WithMaxConnections(n int, whenFull FullBehavior) Option {
+	return func(s *Server) {
+		s.slots = make(chan struct{}, n)
+		s.whenFull = whenFull
+	}
+}
+
+// WithMaxConnectionsPerIP limits the connections one client address may
+// have open, further ones are answered with 429 and closed.
+func WithMaxConnectionsPerIP(n int) Option {
+	return func(s *Server) {
+		s.perIP = &ipLimiter{max: n, conns: map[string]int{}}
+	}
+}
+
+// admit reserves what conn needs to be served. When it cannot, it returns
+// the status to reject the connection with.
+func (s *Server) admit(conn net.Conn) (response.StatusCode, bool) {
+	ip := remoteIP(conn.RemoteAddr().String())
+	if s.perIP != nil && !s.perIP.acquire(ip) {
+		return response.TooManyRequests, false
+	}
+	if s.slots == nil {
+		return 0, true
+	}
+	if s.whenFull == QueueWhenFull {
+		select {
+		case s.slots <- struct{}{}:
+			return 0, true
+		case <-s.ctx.Done():
+		}
+	} else {
+		select {
+		case s.slots <- struct{}{}:
+			return 0, true
+		default:
+		}
+	}
+	if s.perIP != nil {
+		s.perIP.release(ip)
+	}
+	return response.ServiceUnavailable, false
+}
+
+// release gives back what admit reserved for conn.
+func (s *Server) release(conn net.Conn) {
+	if s.perIP != nil {
+		s.perIP.release(remoteIP(conn.RemoteAddr().String()))
+	}
+	if s.slots != nil {
+		<-s.slots
+	}
+}
+
+// reject answers conn with code without reading the request.
+func reject(conn net.Conn, code response.StatusCode) {
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(rejectTimeout))
+	w := response.NewWriter(conn)
+	w.Header().Set("Retry-After", "1")
+	writeStatus(w, code, nil)
+	if err := w.Close(); err != nil {
+		return
+	}
+	// Closing with unread request bytes resets the connection, which can
+	// destroy the response before the client reads it.
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	}
+	conn.SetReadDeadline(time.Now().Add(rejectTimeout))
+	io.Copy(io.Discard, io.LimitReader(conn, maxRejectDrain))
+}
+
+// ipLimiter counts the open connections per client address.
+type ipLimiter struct {
+	mu    sync.Mutex
+	max   int
+	conns map[string]int
+}
+
+func (l *ipLimiter) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip] >= l.max {
+		return false
+	}
+	l.conns[ip]++
+	return true
+}
+
+func (l *ipLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip]--; l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+}
+
+// remoteIP strips the port from a remote address.
+func remoteIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/request"
+	"github.com/ohrelaxo/httpfromtcp/internal/response"
+)
+
+// durationBuckets are the upper bounds of the request duration histogram in
+// seconds, the Prometheus client defaults.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metricMethods are the methods that get their own label value, anything
+// else is counted as OTHER so clients cannot create new series.
+var metricMethods = []string{"CONNECT", "DELETE", "GET", "HEAD", "OPTIONS", "PATCH", "POST", "PUT", "TRACE"}
+
+// Metrics counts what the server does. It is written in the Prometheus text
+// exposition format by Serve.
+type Metrics struct {
+	activeConnections   atomic.Int64
+	acceptedConnections atomic.Int64
+	rejectedConnections atomic.Int64
+	parseErrors         atomic.Int64
+	bytesReceived       atomic.Int64
+	bytesSent           atomic.Int64
+
+	mu       sync.Mutex
+	requests map[requestKey]uint64
+	// buckets counts the durations per bucket, the last one is +Inf.
+	buckets  []uint64
+	duration float64
+	count    uint64
+}
+
+type requestKey struct {
+	method string
+	code   response.StatusCode
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		requests: map[requestKey]uint64{},
+		buckets:  make([]uint64, len(durationBuckets)+1),
+	}
+}
+
+// observe records a completed request.
+func (m *Metrics) observe(method string, code response.StatusCode, d time.Duration) {
+	if !slices.Contains(metricMethods, method) {
+		method = "OTHER"
+	}
+	seconds := d.Seconds()
+	i, _ := slices.BinarySearch(durationBuckets, seconds)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestKey{method, code}]++
+	m.buckets[i]++
+	m.duration += seconds
+	m.count++
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(out io.Writer) (int64, error) {
+	var b strings.Builder
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	metric("httpserver_connections_active", "gauge", "Connections currently open.")
+	fmt.Fprintf(&b, "httpserver_connections_active %d\n", m.activeConnections.Load())
+	metric("httpserver_connections_accepted_total", "counter", "Connections accepted.")
+	fmt.Fprintf(&b, "httpserver_connections_accepted_total %d\n", m.acceptedConnections.Load())
+	metric("httpserver_connections_rejected_total", "counter", "Connections closed right away because a connection limit was reached.")
+	fmt.Fprintf(&b, "httpserver_connections_rejected_total %d\n", m.rejectedConnections.Load())
+	metric("httpserver_parse_errors_total", "counter", "Requests rejected because they could not be parsed.")
+	fmt.Fprintf(&b, "httpserver_parse_errors_total %d\n", m.parseErrors.Load())
+	metric("httpserver_received_bytes_total", "counter", "Bytes read from connections.")
+	fmt.Fprintf(&b, "httpserver_received_bytes_total %d\n", m.bytesReceived.Load())
+	metric("httpserver_sent_bytes_total", "counter", "Bytes written to connections.")
+	fmt.Fprintf(&b, "httpserver_sent_bytes_total %d\n", m.bytesSent.Load())
+
+	m.mu.Lock()
+	keys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b requestKey) int {
+		if c := strings.Compare(a.method, b.method); c != 0 {
+			return c
+		}
+		return int(a.code) - int(b.code)
+	})
+	metric("httpserver_requests_total", "counter", "Requests handled by method and status code.")
+	for _, key := range keys {
+		fmt.Fprintf(&b, "httpserver_requests_total{method=%q,code=\"%d\"} %d\n", key.method, key.code, m.requests[key])
+	}
+	metric("httpserver_request_duration_seconds", "histogram", "Time from the end of the request header section to the complete response.")
+	var cumulative uint64
+	for i, count := range m.buckets {
+		cumulative += count
+		le := "+Inf"
+		if i < len(durationBuckets) {
+			le = strconv.FormatFloat(durationBuckets[i], 'g', -1, 64)
+		}
+		fmt.Fprintf(&b, "httpserver_request_duration_seconds_bucket{le=%q} %d\n", le, cumulative)
+	}
+	fmt.Fprintf(&b, "httpserver_request_duration_seconds_sum %s\n", strconv.FormatFloat(m.duration, 'g', -1, 64))
+	fmt.Fprintf(&b, "httpserver_request_duration_seconds_count %d\n", m.count)
+	m.mu.Unlock()
+
+	n, err := io.WriteString(out, b.String())
+	return int64(n), err
+}
+
+// Serve is a Handler that answers with the metrics.
+func (m *Metrics) Serve(w *response.Writer, req *request.Request) {
+	if req.RequestLine.Method != "GET" && req.RequestLine.Method != "HEAD" {
+		writeStatus(w, response.MethodNotAllowed, []string{"GET", "HEAD"})
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// countingConn adds the bytes that go through a connection to the metrics.
+type countingConn struct {
+	net.Conn
+	metrics *Metrics
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.metrics.bytesReceived.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.metrics.bytesSent.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/request"
+	"github.com/ohrelaxo/httpfromtcp/internal/response"
+)
+
+// Router dispatches requests by method and path. A pattern that ends in a
+// slash matches every path below it, the longest matching pattern wins.
+// HEAD is served by the GET handler, OPTIONS is answered with an Allow
+// header unless a handler is registered for it, and OPTIONS * lists every
+// method the router knows.
+type Router struct {
+	routes map[string]map[string]Handler
+}
+
+func NewRouter() *Router {
+	return &Router{routes: map[string]map[string]Handler{}}
+}
+
+// Handle registers handler for method on pattern.
+func (r *Router) Handle(method, pattern string, handler Handler) {
+	if r.routes[pattern] == nil {
+		r.routes[pattern] = map[string]Handler{}
+	}
+	r.routes[pattern][method] = handler
+}
+
+// Serve is the Handler that dispatches to the registered routes.
+func (r *Router) Serve(w *response.Writer, req *request.Request) {
+	method := req.RequestLine.Method
+	if req.RequestLine.RequestTarget == "*" {
+		if method != "OPTIONS" {
+			writeStatus(w, response.BadRequest, nil)
+			return
+		}
+		var methods []string
+		for _, handlers := range r.routes {
+			for m := range handlers {
+				methods = append(methods, m)
+			}
+		}
+		writeStatus(w, response.NoContent, allowed(methods))
+		return
+	}
+
+	handlers := r.match(targetPath(req.RequestLine.RequestTarget))
+	if handlers == nil {
+		writeStatus(w, response.NotFound, nil)
+		return
+	}
+	handler, ok := handlers[method]
+	if !ok && method == "HEAD" {
+		handler, ok = handlers["GET"]
+	}
+	if ok {
+		handler(w, req)
+		return
+	}
+	methods := allowed(slices.Collect(maps.Keys(handlers)))
+	if method == "OPTIONS" {
+		writeStatus(w, response.NoContent, methods)
+		return
+	}
+	writeStatus(w, response.MethodNotAllowed, methods)
+}
+
+func (r *Router) match(path string) map[string]Handler {
+	if handlers, ok := r.routes[path]; ok {
+		return handlers
+	}
+	best := ""
+	for pattern := range r.routes {
+		if strings.HasSuffix(pattern, "/") && strings.HasPrefix(path, pattern) && len(pattern) > len(best) {
+			best = pattern
+		}
+	}
+	if best == "" {
+		return nil
+	}
+	return r.routes[best]
+}
+
+// targetPath returns the path of an origin-form or absolute-form target.
+func targetPath(target string) string {
+	if !strings.HasPrefix(target, "/") {
+		if u, err := url.Parse(target); err == nil {
+			target = u.RequestURI()
+		}
+	}
+	path, _, _ := strings.Cut(target, "?")
+	return path
+}
+
+// allowed builds the Allow header value for the given methods, adding the
+// ones the router answers itself.
+func allowed(methods []string) []string {
+	if slices.Contains(methods, "GET") {
+		methods = append(methods, "HEAD")
+	}
+	methods = append(methods, "OPTIONS")
+	slices.Sort(methods)
+	return slices.Compact(methods)
+}
+
+func writeStatus(w *response.Writer, code response.StatusCode, allow []string) {
+	if allow != nil {
+		w.Header().Set("Allow", strings.Join(allow, ", "))
+	}
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(code)
+}
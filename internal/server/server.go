@@ -1,22 +1,124 @@
 package server
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"strings"
+	"time"
 
+	"github.com/ohrelaxo/httpfromtcp/internal/http2"
 	"github.com/ohrelaxo/httpfromtcp/internal/request"
 	"github.com/ohrelaxo/httpfromtcp/internal/response"
 )
 
 type Server struct {
-	state    serverState
-	listener net.Listener
-	handler  Handler
+	state         serverState
+	listener      net.Listener
+	handler       Handler
+	parser        request.Parser
+	errorRenderer ErrorRenderer
+	// ctx is the parent of every request context, Close cancels it.
+	ctx            context.Context
+	cancel         context.CancelFunc
+	requestTimeout time.Duration
+	// pipelineDepth is the number of requests read ahead on a persistent
+	// connection, zero closes connections after one request.
+	pipelineDepth int
+	idleTimeout   time.Duration
+	tlsConfig     *tls.Config
+	// middleware wraps the handler once all options are applied.
+	middleware  []Middleware
+	metrics     *Metrics
+	metricsPath string
+	// slots holds one element per served connection when the number of
+	// connections is limited.
+	slots    chan struct{}
+	whenFull FullBehavior
+	perIP    *ipLimiter
 }
 
+// Handler writes the response to req. A request that carries Expect:
+// 100-continue has no body until the handler calls req.ReadBody. The
+// context of req is cancelled when the client disconnects, the server is
+// closed or the request timeout expires.
 type Handler func(w *response.Writer, req *request.Request)
 
+// Option configures a Server before it starts accepting connections.
+type Option func(*Server)
+
+// Middleware wraps a Handler to run code around it.
+type Middleware func(Handler) Handler
+
+// WithMiddleware wraps the handler in mw, the first one runs outermost.
+func WithMiddleware(mw ...Middleware) Option {
+	return func(s *Server) {
+		s.middleware = append(s.middleware, mw...)
+	}
+}
+
+// WithMetrics serves the metrics at path. The endpoint sits inside the
+// middleware, so access logs and authentication apply to it.
+func WithMetrics(path string) Option {
+	return func(s *Server) {
+		s.metricsPath = path
+	}
+}
+
+// WithParser sets the parser settings used to read requests.
+func WithParser(parser request.Parser) Option {
+	return func(s *Server) {
+		s.parser = parser
+	}
+}
+
+// WithErrorRenderer replaces the page written when a request cannot be parsed.
+func WithErrorRenderer(renderer ErrorRenderer) Option {
+	return func(s *Server) {
+		s.errorRenderer = renderer
+	}
+}
+
+// WithRequestTimeout sets a deadline on the context of every request.
+func WithRequestTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.requestTimeout = d
+	}
+}
+
+// WithPipelining keeps connections open for further requests and reads up
+// to depth of them ahead while earlier ones are answered. The responses are
+// always written in request order.
+func WithPipelining(depth int) Option {
+	return func(s *Server) {
+		s.pipelineDepth = max(depth, 1)
+	}
+}
+
+// WithIdleTimeout closes persistent connections that wait longer than d for
+// the next request, one minute by default.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.idleTimeout = d
+	}
+}
+
+// WithTLS serves HTTPS with config. Clients that negotiate h2 with ALPN
+// are served HTTP/2.
+func WithTLS(config *tls.Config) Option {
+	return func(s *Server) {
+		config = config.Clone()
+		if len(config.NextProtos) == 0 {
+			config.NextProtos = []string{"h2", "http/1.1"}
+		}
+		s.tlsConfig = config
+	}
+}
+
 type serverState int
 
 const (
@@ -24,19 +126,52 @@ const (
 	closed
 )
 
-func Serve(port int, handler Handler) (*Server, error) {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+// Serve listens on port on all interfaces.
+func Serve(port int, handler Handler, opts ...Option) (*Server, error) {
+	return Listen(fmt.Sprintf(":%d", port), handler, opts...)
+}
+
+// Listen starts serving handler on the TCP address addr, such as
+// "127.0.0.1:8080" or ":443".
+func Listen(addr string, handler Handler, opts ...Option) (*Server, error) {
+	listener, err := net.Listen("tcp", addr)
 	if err != nil {
-		log.Fatalf("failed to Listen on port: %v, error: %v", port, err)
-		return nil, err
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
 	}
+	ctx, cancel := context.WithCancel(context.Background())
 	s := &Server{
-		state:    listening,
-		listener: listener,
-		handler:  handler,
+		state:         listening,
+		listener:      listener,
+		handler:       handler,
+		errorRenderer: DefaultErrorRenderer,
+		ctx:           ctx,
+		cancel:        cancel,
+		metrics:       newMetrics(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.idleTimeout <= 0 {
+		s.idleTimeout = defaultIdleTimeout
+	}
+	if s.tlsConfig != nil {
+		s.listener = tls.NewListener(listener, s.tlsConfig)
+	}
+	if s.metricsPath != "" {
+		next := s.handler
+		s.handler = func(w *response.Writer, req *request.Request) {
+			if targetPath(req.RequestLine.RequestTarget) == s.metricsPath {
+				s.metrics.Serve(w, req)
+				return
+			}
+			next(w, req)
+		}
+	}
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		s.handler = s.middleware[i](s.handler)
 	}
 	go s.listen()
-	return s, err
+	return s, nil
 }
 
 func (s *Server) listen() {
@@ -49,29 +184,156 @@ func (s *Server) listen() {
 			log.Printf("failed to accept connection: %v\n", err)
 			continue
 		}
+		s.metrics.acceptedConnections.Add(1)
+		if code, ok := s.admit(conn); !ok {
+			s.metrics.rejectedConnections.Add(1)
+			go reject(conn, code)
+			continue
+		}
 		go s.handle(conn)
 	}
 }
 
 func (s *Server) handle(conn net.Conn) {
+	defer s.release(conn)
 	defer conn.Close()
-	writer := response.NewWriter(conn)
-	req, err := request.RequestFromReader(conn)
-	if err != nil {
-		log.Printf("request failed: %v\n", err)
-		writer.WriteStatusLine(response.BadRequest)
-		body := fmt.Appendf(nil, "Error parsing request: %v", err)
-		writer.WriteHeaders(response.GetDefaultHeaders(len(body)))
-		writer.WriteBody(body)
+	s.metrics.activeConnections.Add(1)
+	defer s.metrics.activeConnections.Add(-1)
+	conn = &countingConn{Conn: conn, metrics: s.metrics}
+	reader := bufio.NewReader(conn)
+	if hasHTTP2Preface(reader) {
+		err := http2.ServeConn(s.ctx, &bufferedConn{Conn: conn, reader: reader}, s.http2Handler, s.http2Options())
+		if err != nil {
+			log.Printf("http2 connection failed: %v\n", err)
+		}
 		return
 	}
 
-	s.handler(writer, req)
-	return
+	newConn(s, conn, reader).serve()
+}
+
+// requestContext derives the context of one request from parent.
+func (s *Server) requestContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if s.requestTimeout > 0 {
+		return context.WithTimeout(parent, s.requestTimeout)
+	}
+	return context.WithCancel(parent)
+}
+
+// http2Options carries the limits of the parser over to HTTP/2 streams.
+func (s *Server) http2Options() http2.Options {
+	return http2.Options{MaxBodyBytes: s.parser.MaxBodyBytes}
+}
+
+// http2Handler applies the request timeout to streams, the http2 package
+// already cancels them on reset and when the connection ends.
+func (s *Server) http2Handler(w *response.Writer, req *request.Request) {
+	ctx, cancel := s.requestContext(req.Context())
+	defer cancel()
+	s.serveRequest(w, req.WithContext(ctx))
+}
+
+// serveRequest runs the handler and records the request in the metrics
+// once its response is complete.
+func (s *Server) serveRequest(w *response.Writer, req *request.Request) {
+	start := time.Now()
+	w.AfterClose(func() {
+		s.metrics.observe(req.RequestLine.Method, w.Status(), time.Since(start))
+	})
+	s.handler(w, req)
+}
+
+// expect handles the Expect header. Without it the body is read before the
+// handler runs, with 100-continue it is left for the handler to read.
+func (s *Server) expect(req *request.Request, body *continueReader) error {
+	expect := req.Headers.Get("Expect")
+	switch {
+	case expect == "":
+		_, err := req.ReadBody()
+		return err
+	case strings.EqualFold(expect, "100-continue"):
+		body.armed = true
+		return nil
+	default:
+		return fmt.Errorf("%w: %q", ErrExpectationFailed, expect)
+	}
+}
+
+// continueReader sends 100 Continue the first time the body of a request
+// with Expect: 100-continue is read. A handler that rejects the request
+// with a final status first never asks the client for the body.
+type continueReader struct {
+	reader io.Reader
+	writer *response.Writer
+	armed  bool
+}
+
+func (c *continueReader) Read(p []byte) (int, error) {
+	if c.armed {
+		c.armed = false
+		if !c.writer.Started() {
+			if err := c.writer.WriteInformational(response.Continue, nil); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return c.reader.Read(p)
+}
+
+// finishResponse completes whatever the handler left open, so the client
+// always gets a well-formed response.
+func finishResponse(writer *response.Writer, req *request.Request) {
+	if unfinished := writer.Unfinished(); unfinished != "" {
+		if req != nil {
+			log.Printf("handler for %s %s left the response unfinished: %s\n", req.RequestLine.Method, req.RequestLine.RequestTarget, unfinished)
+		} else {
+			log.Printf("error renderer left the response unfinished: %s\n", unfinished)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		log.Printf("failed to complete response: %v\n", err)
+	}
+}
+
+// hasHTTP2Preface peeks at the first bytes of the connection and reports
+// whether the client speaks HTTP/2 with prior knowledge. It only waits for
+// more data while everything read so far still matches the preface.
+func hasHTTP2Preface(reader *bufio.Reader) bool {
+	for n := 1; n <= len(http2.ClientPreface); n++ {
+		peek, err := reader.Peek(n)
+		if err != nil || peek[n-1] != http2.ClientPreface[n-1] {
+			return false
+		}
+	}
+	return true
+}
+
+// bufferedConn reads through the bufio.Reader that was used to peek at the
+// connection, so no bytes are lost when handing it over.
+type bufferedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// Metrics returns the metrics of the server.
+func (s *Server) Metrics() *Metrics {
+	return s.metrics
+}
+
+// Addr returns the address the server is listening on.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
 }
 
 func (s *Server) Close() error {
 	s.state = closed
+	if s.cancel != nil {
+		s.cancel()
+	}
 	if s.listener != nil {
 		return s.listener.Close()
 	}
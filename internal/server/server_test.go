@@ -0,0 +1,511 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/headers"
+	"github.com/ohrelaxo/httpfromtcp/internal/request"
+	"github.com/ohrelaxo/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func okHandler(w *response.Writer, req *request.Request) {
+	body := "ok"
+	w.WriteStatusLine(response.Ok)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody([]byte(body))
+}
+
+// roundTrip sends raw to a fresh server and returns everything it answers
+// before closing the connection.
+func roundTrip(t *testing.T, handler Handler, raw string, opts ...Option) string {
+	t.Helper()
+	s, err := Serve(0, handler, opts...)
+	require.NoError(t, err)
+	defer s.Close()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(conn, raw)
+	require.NoError(t, err)
+	resp, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	return string(resp)
+}
+
+func TestStatusForError(t *testing.T) {
+	assert.Equal(t, response.HTTPVersionNotSupported, StatusForError(fmt.Errorf("%w: 2.0", request.ErrUnsupportedVersion)))
+	assert.Equal(t, response.ContentTooLarge, StatusForError(request.ErrBodyTooLarge))
+	assert.Equal(t, response.URITooLong, StatusForError(request.ErrURITooLong))
+	assert.Equal(t, response.RequestHeaderFieldsTooLarge, StatusForError(request.ErrHeadersTooLarge))
+	assert.Equal(t, response.NotImplemented, StatusForError(request.ErrUnsupportedTransferCoding))
+	assert.Equal(t, response.BadRequest, StatusForError(request.ErrInvalidMethod))
+	assert.Equal(t, response.BadRequest, StatusForError(errors.New("something else")))
+}
+
+func TestParseErrorResponses(t *testing.T) {
+	// Test: Unsupported version does not leak the parser error
+	resp := roundTrip(t, okHandler, "GET / HTTP/2.0\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 505 HTTP Version Not Supported\r\n"), resp)
+	assert.NotContains(t, resp, "unsupported HTTP-version")
+
+	// Test: Long request-target
+	resp = roundTrip(t, okHandler, "GET /"+strings.Repeat("a", 100)+" HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		WithParser(request.Parser{MaxTargetLength: 50}))
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 414 URI Too Long\r\n"), resp)
+
+	// Test: Custom renderer
+	resp = roundTrip(t, okHandler, "GET / HTTP/1.1\r\nTransfer-Encoding: gzip, chunked\r\n\r\n",
+		WithErrorRenderer(func(w *response.Writer, code response.StatusCode, err error) {
+			body := fmt.Sprintf("custom %d", code)
+			w.WriteStatusLine(code)
+			w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+			w.WriteBody([]byte(body))
+		}))
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 501 Not Implemented\r\n"), resp)
+	assert.True(t, strings.HasSuffix(resp, "custom 501"), resp)
+
+	// Test: Valid requests still reach the handler
+	resp = roundTrip(t, okHandler, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"), resp)
+}
+
+func TestUnfinishedResponses(t *testing.T) {
+	get := "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"
+
+	// Test: A handler that writes nothing gets a 500
+	resp := roundTrip(t, func(w *response.Writer, req *request.Request) {}, get)
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 500 Internal Server Error\r\n"), resp)
+	assert.Contains(t, resp, "content-length: 0\r\n")
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\n"), resp)
+
+	// Test: A lone status line gets a header section
+	resp = roundTrip(t, func(w *response.Writer, req *request.Request) {
+		w.Header().Set("X-Reason", "gone")
+		w.WriteStatusLine(response.InternalServerError)
+	}, get)
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 500 Internal Server Error\r\n"), resp)
+	assert.Contains(t, resp, "x-reason: gone\r\n")
+	assert.Contains(t, resp, "content-length: 0\r\n")
+
+	// Test: An open chunked body gets its last-chunk
+	resp = roundTrip(t, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.Ok)
+		h := response.GetDefaultHeaders(0)
+		h.Delete("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		w.WriteHeaders(h)
+		w.WriteChunkedBody([]byte("abc"))
+	}, get)
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\n3\r\nabc\r\n0\r\n\r\n"), resp)
+
+	// Test: A missing trailer section is terminated
+	resp = roundTrip(t, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.Ok)
+		h := response.GetDefaultHeaders(0)
+		h.Delete("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		w.WriteHeaders(h)
+		w.WriteChunkedBody([]byte("abc"))
+		w.WriteChunkedBodyDone()
+	}, get)
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\n3\r\nabc\r\n0\r\n\r\n"), resp)
+}
+
+func TestExpectContinue(t *testing.T) {
+	echoHandler := func(w *response.Writer, req *request.Request) {
+		body, err := req.ReadBody()
+		if err != nil {
+			w.WriteHeader(StatusForError(err))
+			return
+		}
+		w.Write(body)
+	}
+	s, err := Serve(0, echoHandler)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: 100 Continue is sent once the handler reads the body
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n")
+	require.NoError(t, err)
+	interim := make([]byte, len("HTTP/1.1 100 Continue\r\n\r\n"))
+	_, err = io.ReadFull(conn, interim)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\n", string(interim))
+	_, err = io.WriteString(conn, "hello")
+	require.NoError(t, err)
+	resp, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(resp), "HTTP/1.1 200 OK\r\n"), string(resp))
+	assert.True(t, strings.HasSuffix(string(resp), "\r\n\r\nhello"), string(resp))
+
+	// Test: A handler that answers without reading the body sends no 100
+	rejectHandler := func(w *response.Writer, req *request.Request) {
+		w.WriteHeader(response.ContentTooLarge)
+	}
+	raw := "POST / HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n"
+	out := roundTrip(t, rejectHandler, raw)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 413 Content Too Large\r\n"), out)
+	assert.NotContains(t, out, "100 Continue")
+
+	// Test: Other expectations fail with 417
+	out = roundTrip(t, okHandler, "POST / HTTP/1.1\r\nHost: localhost\r\nExpect: 200-ok\r\nContent-Length: 5\r\n\r\nhello")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 417 Expectation Failed\r\n"), out)
+
+	// Test: Early Hints go out ahead of the final response
+	out = roundTrip(t, func(w *response.Writer, req *request.Request) {
+		hints := headers.NewHeaders()
+		hints.Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteInformational(response.EarlyHints, hints)
+		okHandler(w, req)
+	}, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 103 Early Hints\r\nlink: </style.css>; rel=preload; as=style\r\n\r\nHTTP/1.1 200 OK\r\n"), out)
+}
+
+func TestHeadAndOptions(t *testing.T) {
+	router := NewRouter()
+	router.Handle("GET", "/items/", func(w *response.Writer, req *request.Request) {
+		w.Write([]byte("item list"))
+	})
+	router.Handle("POST", "/items/", okHandler)
+	router.Handle("DELETE", "/admin", okHandler)
+
+	// Test: HEAD keeps the Content-Length but drops the body
+	resp := roundTrip(t, router.Serve, "HEAD /items/1 HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"), resp)
+	assert.Contains(t, resp, "content-length: 9\r\n")
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\n"), resp)
+
+	// Test: HEAD with an explicit Content-Length from a low-level handler
+	resp = roundTrip(t, okHandler, "HEAD / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Contains(t, resp, "content-length: 2\r\n")
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\n"), resp)
+
+	// Test: Per-route OPTIONS lists the allowed methods
+	resp = roundTrip(t, router.Serve, "OPTIONS /items/1 HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 204 No Content\r\n"), resp)
+	assert.Contains(t, resp, "allow: GET, HEAD, OPTIONS, POST\r\n")
+	assert.NotContains(t, resp, "content-length")
+
+	// Test: OPTIONS * lists every method
+	resp = roundTrip(t, router.Serve, "OPTIONS * HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Contains(t, resp, "allow: DELETE, GET, HEAD, OPTIONS, POST\r\n")
+
+	// Test: Unknown methods and paths
+	resp = roundTrip(t, router.Serve, "PUT /admin HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 405 Method Not Allowed\r\n"), resp)
+	assert.Contains(t, resp, "allow: DELETE, OPTIONS\r\n")
+	resp = roundTrip(t, router.Serve, "GET /nothing?x=/items/ HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 404 Not Found\r\n"), resp)
+
+	// Test: 204 and 304 never carry a body
+	for _, code := range []response.StatusCode{response.NoContent, response.NotModified} {
+		resp = roundTrip(t, func(w *response.Writer, req *request.Request) {
+			w.WriteHeader(code)
+			w.Write([]byte("ignored"))
+		}, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		assert.NotContains(t, resp, "ignored")
+		assert.NotContains(t, resp, "transfer-encoding")
+		assert.True(t, strings.HasSuffix(resp, "\r\n\r\n"), resp)
+	}
+}
+
+type userKey struct{}
+
+func TestRequestContext(t *testing.T) {
+	// Test: Middleware values reach the handler
+	withUser := func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			next(w, req.WithContext(context.WithValue(req.Context(), userKey{}, "ada")))
+		}
+	}
+	resp := roundTrip(t, func(w *response.Writer, req *request.Request) {
+		user, _ := req.Context().Value(userKey{}).(string)
+		w.Write([]byte(user))
+	}, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n", WithMiddleware(withUser))
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\nada"), resp)
+
+	// Test: The request timeout ends the context
+	resp = roundTrip(t, func(w *response.Writer, req *request.Request) {
+		<-req.Context().Done()
+		w.Write([]byte(req.Context().Err().Error()))
+	}, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n", WithRequestTimeout(10*time.Millisecond))
+	assert.True(t, strings.HasSuffix(resp, "context deadline exceeded"), resp)
+
+	// Test: A client that goes away cancels the handler
+	cancelled := make(chan error, 1)
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		select {
+		case <-req.Context().Done():
+			cancelled <- req.Context().Err()
+		case <-time.After(5 * time.Second):
+			cancelled <- nil
+		}
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	_, err = io.WriteString(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 2\r\n\r\nhi")
+	require.NoError(t, err)
+	conn.Close()
+	assert.ErrorIs(t, <-cancelled, context.Canceled)
+
+	// Test: Closing the server cancels running handlers
+	started := make(chan struct{})
+	s, err = Serve(0, func(w *response.Writer, req *request.Request) {
+		close(started)
+		<-req.Context().Done()
+		cancelled <- req.Context().Err()
+	})
+	require.NoError(t, err)
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	<-started
+	s.Close()
+	assert.ErrorIs(t, <-cancelled, context.Canceled)
+}
+
+func TestMetrics(t *testing.T) {
+	s, err := Serve(0, okHandler, WithMetrics("/metrics"))
+	require.NoError(t, err)
+	defer s.Close()
+	send := func(raw string) string {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.WriteString(conn, raw)
+		require.NoError(t, err)
+		resp, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		return string(resp)
+	}
+	send("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	send("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	send("BREW /pot HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	send("GET / HTTP/9.9\r\nHost: localhost\r\n\r\n")
+
+	// Test: Requests are counted by method and status, unknown methods as OTHER
+	resp := send("GET /metrics HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"), resp)
+	assert.Contains(t, resp, "content-type: text/plain; version=0.0.4; charset=utf-8\r\n")
+	assert.Contains(t, resp, "# TYPE httpserver_requests_total counter\n")
+	assert.Contains(t, resp, "httpserver_requests_total{method=\"GET\",code=\"200\"} 2\n")
+	assert.Contains(t, resp, "httpserver_requests_total{method=\"OTHER\",code=\"200\"} 1\n")
+	assert.Contains(t, resp, "httpserver_parse_errors_total 1\n")
+	assert.Contains(t, resp, "httpserver_connections_accepted_total 5\n")
+	assert.Contains(t, resp, "httpserver_request_duration_seconds_bucket{le=\"+Inf\"} 3\n")
+	assert.Contains(t, resp, "httpserver_request_duration_seconds_count 3\n")
+	assert.NotContains(t, resp, "httpserver_received_bytes_total 0\n")
+
+	// Test: Only GET and HEAD are served
+	resp = send("POST /metrics HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 405 Method Not Allowed\r\n"), resp)
+	assert.Contains(t, resp, "allow: GET, HEAD\r\n")
+}
+
+func TestConnectionLimits(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	blocking := func(w *response.Writer, req *request.Request) {
+		started <- struct{}{}
+		<-release
+		okHandler(w, req)
+	}
+	dial := func(s *Server) net.Conn {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		require.NoError(t, err)
+		return conn
+	}
+	readAll := func(conn net.Conn) string {
+		defer conn.Close()
+		resp, _ := io.ReadAll(conn)
+		return string(resp)
+	}
+
+	// Test: Connections over the limit are rejected with 503
+	s, err := Serve(0, blocking, WithMaxConnections(1, RejectWhenFull))
+	require.NoError(t, err)
+	first := dial(s)
+	<-started
+	resp := readAll(dial(s))
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 503 Service Unavailable\r\n"), resp)
+	assert.Contains(t, resp, "retry-after: 1\r\n")
+	release <- struct{}{}
+	assert.True(t, strings.HasPrefix(readAll(first), "HTTP/1.1 200 OK\r\n"))
+	s.Close()
+
+	// Test: Queued connections are served once a slot is free
+	s, err = Serve(0, blocking, WithMaxConnections(1, QueueWhenFull))
+	require.NoError(t, err)
+	first = dial(s)
+	<-started
+	second := dial(s)
+	select {
+	case <-started:
+		t.Fatal("second connection served while the first is running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release <- struct{}{}
+	assert.True(t, strings.HasPrefix(readAll(first), "HTTP/1.1 200 OK\r\n"))
+	<-started
+	release <- struct{}{}
+	assert.True(t, strings.HasPrefix(readAll(second), "HTTP/1.1 200 OK\r\n"))
+	s.Close()
+
+	// Test: A client over its own limit gets 429
+	s, err = Serve(0, blocking, WithMaxConnectionsPerIP(1))
+	require.NoError(t, err)
+	defer s.Close()
+	first = dial(s)
+	<-started
+	resp = readAll(dial(s))
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 429 Too Many Requests\r\n"), resp)
+	release <- struct{}{}
+	assert.True(t, strings.HasPrefix(readAll(first), "HTTP/1.1 200 OK\r\n"))
+}
+
+func TestPipelining(t *testing.T) {
+	echo := func(w *response.Writer, req *request.Request) {
+		w.Write([]byte(req.RequestLine.RequestTarget + " " + string(req.Body)))
+	}
+	pipeline := "GET /first HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"POST /second HTTP/1.1\r\nHost: localhost\r\nContent-Length: 3\r\n\r\nabc" +
+		"GET /third HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"
+
+	// Test: Pipelined requests are answered in order on one connection
+	resp := roundTrip(t, echo, pipeline, WithPipelining(2))
+	responses := strings.Split(resp, "HTTP/1.1 200 OK\r\n")[1:]
+	require.Len(t, responses, 3, resp)
+	assert.True(t, strings.HasSuffix(responses[0], "\r\n\r\n/first "), responses[0])
+	assert.True(t, strings.HasSuffix(responses[1], "\r\n\r\n/second abc"), responses[1])
+	assert.True(t, strings.HasSuffix(responses[2], "\r\n\r\n/third "), responses[2])
+	assert.NotContains(t, responses[0], "connection:")
+	assert.NotContains(t, responses[1], "connection:")
+	assert.Contains(t, responses[2], "connection: close\r\n")
+
+	// Test: Without pipelining the connection closes after one response
+	resp = roundTrip(t, echo, pipeline)
+	assert.Equal(t, 1, strings.Count(resp, "HTTP/1.1"), resp)
+	assert.Contains(t, resp, "connection: close\r\n")
+
+	// Test: A handler asking for close ends the connection
+	resp = roundTrip(t, okHandler, pipeline, WithPipelining(2))
+	assert.Equal(t, 1, strings.Count(resp, "HTTP/1.1"), resp)
+
+	// Test: Requests are read ahead up to the depth of the pipeline
+	for _, depth := range []int{2, 3} {
+		release := make(chan struct{})
+		s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+			<-release
+			echo(w, req)
+		}, WithPipelining(depth))
+		require.NoError(t, err)
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.WriteString(conn, "GET /1 HTTP/1.1\r\nHost: localhost\r\n\r\nGET /2 HTTP/1.1\r\nHost: localhost\r\n\r\nBROKEN\r\n\r\n")
+		require.NoError(t, err)
+		if depth == 2 {
+			assert.Never(t, func() bool { return s.Metrics().parseErrors.Load() > 0 }, 50*time.Millisecond, time.Millisecond)
+		} else {
+			assert.Eventually(t, func() bool { return s.Metrics().parseErrors.Load() == 1 }, time.Second, time.Millisecond)
+		}
+		close(release)
+		resp, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		assert.Equal(t, 2, strings.Count(string(resp), "HTTP/1.1 200 OK"), string(resp))
+		assert.True(t, strings.Contains(string(resp), "HTTP/1.1 400 Bad Request"), string(resp))
+		conn.Close()
+		s.Close()
+	}
+
+	// Test: The request timeout of a request read ahead starts with its
+	// handler
+	resp = roundTrip(t, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/slow" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		w.Write([]byte(fmt.Sprintf("%s %v", req.RequestLine.RequestTarget, req.Context().Err())))
+	}, "GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\nGET /fast HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n",
+		WithPipelining(4), WithRequestTimeout(200*time.Millisecond))
+	assert.Contains(t, resp, "/slow context deadline exceeded")
+	assert.True(t, strings.HasSuffix(resp, "/fast <nil>"), resp)
+
+	// Test: Idle persistent connections are closed
+	s, err := Serve(0, echo, WithPipelining(2), WithIdleTimeout(20*time.Millisecond))
+	require.NoError(t, err)
+	defer s.Close()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(conn, "GET /idle HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	resp2, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(string(resp2), "/idle "), string(resp2))
+}
+
+func TestVirtualHosts(t *testing.T) {
+	named := func(name string) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			host, _ := Host(req)
+			w.Write([]byte(name + " " + host))
+		}
+	}
+	vhosts := NewVirtualHosts()
+	vhosts.Handle("example.com", named("apex"))
+	vhosts.Handle("*.example.com", named("sub"))
+	vhosts.Handle("*.api.example.com", named("api"))
+	get := func(target string, fields string) string {
+		return roundTrip(t, vhosts.Serve, "GET "+target+" HTTP/1.1\r\n"+fields+"\r\n")
+	}
+
+	// Test: Exact hosts match without port, case and trailing dot
+	assert.True(t, strings.HasSuffix(get("/", "Host: Example.COM.:8080\r\n"), "apex example.com"))
+
+	// Test: Wildcards match subdomains at any depth, the longest wins
+	assert.True(t, strings.HasSuffix(get("/", "Host: www.example.com\r\n"), "sub www.example.com"))
+	assert.True(t, strings.HasSuffix(get("/", "Host: a.b.example.com\r\n"), "sub a.b.example.com"))
+	assert.True(t, strings.HasSuffix(get("/", "Host: v1.api.example.com\r\n"), "api v1.api.example.com"))
+
+	// Test: An absolute-form target overrides the Host header
+	assert.True(t, strings.HasSuffix(get("http://www.example.com/x", "Host: other.org\r\n"), "sub www.example.com"))
+
+	// Test: Unknown hosts get 421 without a default handler
+	resp := get("/", "Host: badexample.com\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 421 Misdirected Request\r\n"), resp)
+	vhosts.Default(named("default"))
+	assert.True(t, strings.HasSuffix(get("/", "Host: [::1]:42069\r\n"), "default ::1"))
+	assert.True(t, strings.HasSuffix(get("/", "Host:\r\n"), "default "))
+
+	// Test: A missing, repeated or malformed Host header is a 400
+	for _, fields := range []string{"", "Host: example.com\r\nHost: evil.com\r\n",
+		"Host: example.com\r\nHost: \r\n", "Host: \r\nHost: evil.com\r\n", "Host: example.com:80x\r\n", "Host: exa mple.com\r\n", "Host: [::1\r\n", "Host: user@example.com\r\n", "Host: .example.com\r\n"} {
+		resp := get("/", fields)
+		assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 400 Bad Request\r\n"), fields)
+	}
+	_, err := Host(&request.Request{RequestLine: request.RequestLine{HttpVersion: "1.1", RequestTarget: "/"}, Headers: headers.NewHeaders()})
+	assert.ErrorIs(t, err, ErrMissingHost)
+}
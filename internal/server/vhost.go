@@ -0,0 +1,136 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/request"
+	"github.com/ohrelaxo/httpfromtcp/internal/response"
+)
+
+var (
+	ErrMissingHost = errors.New("missing host header")
+	ErrInvalidHost = errors.New("invalid host")
+)
+
+// VirtualHosts dispatches requests by the host they are for. A pattern
+// such as "example.com" matches that host only, "*.example.com" matches
+// every subdomain of it and the longest matching wildcard wins. Other hosts
+// go to the default handler, or get 421 Misdirected Request without one.
+type VirtualHosts struct {
+	exact map[string]Handler
+	// wildcard is keyed by the suffix the pattern matches, ".example.com".
+	wildcard map[string]Handler
+	fallback Handler
+}
+
+func NewVirtualHosts() *VirtualHosts {
+	return &VirtualHosts{exact: map[string]Handler{}, wildcard: map[string]Handler{}}
+}
+
+// Handle registers handler for the hosts matching pattern.
+func (v *VirtualHosts) Handle(pattern string, handler Handler) {
+	pattern = strings.TrimSuffix(strings.ToLower(pattern), ".")
+	if domain, ok := strings.CutPrefix(pattern, "*."); ok {
+		v.wildcard["."+domain] = handler
+		return
+	}
+	v.exact[pattern] = handler
+}
+
+// Default sets the handler for hosts that match no pattern.
+func (v *VirtualHosts) Default(handler Handler) {
+	v.fallback = handler
+}
+
+// Serve is the Handler that dispatches to the registered hosts. Requests
+// without a valid Host header get 400 Bad Request.
+func (v *VirtualHosts) Serve(w *response.Writer, req *request.Request) {
+	host, err := Host(req)
+	if err != nil {
+		writeStatus(w, response.BadRequest, nil)
+		return
+	}
+	if handler := v.match(host); handler != nil {
+		handler(w, req)
+		return
+	}
+	if v.fallback != nil {
+		v.fallback(w, req)
+		return
+	}
+	writeStatus(w, response.MisdirectedRequest, nil)
+}
+
+func (v *VirtualHosts) match(host string) Handler {
+	if handler, ok := v.exact[host]; ok {
+		return handler
+	}
+	best := ""
+	for suffix := range v.wildcard {
+		if strings.HasSuffix(host, suffix) && len(suffix) > len(best) {
+			best = suffix
+		}
+	}
+	if best == "" {
+		return nil
+	}
+	return v.wildcard[best]
+}
+
+// Host returns the host req is for, lowercase and without the port or a
+// trailing dot. An absolute-form target takes precedence over the Host
+// header, and HTTP/1.1 requests must carry exactly one Host header, RFC
+// 9112 section 3.2.
+func Host(req *request.Request) (string, error) {
+	value, ok := req.Headers["host"]
+	if !ok && req.RequestLine.HttpVersion == "1.1" {
+		return "", ErrMissingHost
+	}
+	// Field lines with the same name, empty ones included, are combined
+	// with commas, which a valid host never contains.
+	if strings.Contains(value, ",") {
+		return "", fmt.Errorf("%w: more than one Host header", ErrInvalidHost)
+	}
+	target := req.RequestLine.RequestTarget
+	if req.RequestLine.Method != "CONNECT" && !strings.HasPrefix(target, "/") && target != "*" {
+		if u, err := url.Parse(target); err == nil && u.Host != "" {
+			value = u.Host
+		}
+	}
+	return normalizeHost(value)
+}
+
+func normalizeHost(value string) (string, error) {
+	host, port := value, ""
+	if rest, ok := strings.CutPrefix(value, "["); ok {
+		literal, after, ok := strings.Cut(rest, "]")
+		if !ok || net.ParseIP(literal) == nil || after != "" && after[0] != ':' {
+			return "", fmt.Errorf("%w: %q", ErrInvalidHost, value)
+		}
+		host, port = literal, strings.TrimPrefix(after, ":")
+	} else if name, p, ok := strings.Cut(value, ":"); ok {
+		host, port = name, p
+	}
+	for _, c := range []byte(port) {
+		if c < '0' || c > '9' {
+			return "", fmt.Errorf("%w: %q", ErrInvalidHost, value)
+		}
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if strings.HasPrefix(value, "[") {
+		return host, nil
+	}
+	if strings.HasPrefix(host, ".") || strings.Contains(host, "..") {
+		return "", fmt.Errorf("%w: %q", ErrInvalidHost, value)
+	}
+	for _, c := range []byte(host) {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_') {
+			return "", fmt.Errorf("%w: %q", ErrInvalidHost, value)
+		}
+	}
+	return host, nil
+}
@@ -0,0 +1,65 @@
+// Package servertest talks raw HTTP to servers in tests. The tests of the
+// server package itself, and of http2 which it imports, cannot use it.
+package servertest
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/require"
+)
+
+// timeout bounds every connection, so a server that hangs fails the test
+// instead of blocking it.
+const timeout = 5 * time.Second
+
+// Send starts a server with handler and opts, sends raw to it with
+// RoundTrip and closes it again.
+func Send(t testing.TB, handler server.Handler, raw string, opts ...server.Option) string {
+	t.Helper()
+	s, err := server.Serve(0, handler, opts...)
+	require.NoError(t, err)
+	defer s.Close()
+	return RoundTrip(t, s.Addr().String(), raw)
+}
+
+// RoundTrip sends raw to addr and returns everything the server writes
+// until it closes the connection.
+func RoundTrip(t testing.TB, addr, raw string) string {
+	t.Helper()
+	conn := Dial(t, addr, raw)
+	defer conn.Close()
+	resp, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	return string(resp)
+}
+
+// Dial sends raw to addr and leaves the connection open, for responses that
+// are read as they stream. It is closed when the test ends.
+func Dial(t testing.TB, addr, raw string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(timeout))
+	_, err = io.WriteString(conn, raw)
+	require.NoError(t, err)
+	return conn
+}
+
+// ReadUntil reads from conn until the data received contains want.
+func ReadUntil(t testing.TB, conn net.Conn, want string) string {
+	t.Helper()
+	var received strings.Builder
+	buf := make([]byte, 1024)
+	for !strings.Contains(received.String(), want) {
+		n, err := conn.Read(buf)
+		received.Write(buf[:n])
+		require.NoError(t, err, received.String())
+	}
+	return received.String()
+}
@@ -0,0 +1,134 @@
+package session
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// MinKeySize is the minimum length of a CookieStore key.
+const MinKeySize = 32
+
+// maxCookieToken keeps the cookie below the 4096 bytes browsers store.
+const maxCookieToken = 3800
+
+var ErrTooLarge = errors.New("session values too large for a cookie")
+
+// CookieStore keeps the session values in the cookie itself. The values are
+// encrypted with AES-GCM and the result is signed with HMAC-SHA256. The
+// first key seals new cookies, the others are still accepted so keys can be
+// rotated without logging everybody out.
+type CookieStore struct {
+	keys []cookieKey
+	now  func() time.Time
+}
+
+type cookieKey struct {
+	aead cipher.AEAD
+	mac  []byte
+}
+
+type cookiePayload struct {
+	Expires int64             `json:"e"`
+	Values  map[string]string `json:"v"`
+}
+
+func NewCookieStore(keys ...[]byte) (*CookieStore, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("cookie store needs at least one key")
+	}
+	store := &CookieStore{now: time.Now}
+	for i, key := range keys {
+		if len(key) < MinKeySize {
+			return nil, fmt.Errorf("cookie store key %d is shorter than %d bytes", i, MinKeySize)
+		}
+		block, err := aes.NewCipher(derive(key, "session encryption"))
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		store.keys = append(store.keys, cookieKey{aead: aead, mac: derive(key, "session signature")})
+	}
+	return store, nil
+}
+
+// derive gives the encryption and the signature their own key.
+func derive(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func sign(key, payload []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+func (c *CookieStore) Load(token string) (map[string]string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(data) < sha256.Size {
+		return nil, ErrNotFound
+	}
+	payload, signature := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+	for _, key := range c.keys {
+		if !hmac.Equal(signature, sign(key.mac, payload)) {
+			continue
+		}
+		nonceSize := key.aead.NonceSize()
+		if len(payload) < nonceSize {
+			return nil, ErrNotFound
+		}
+		plaintext, err := key.aead.Open(nil, payload[:nonceSize], payload[nonceSize:], nil)
+		if err != nil {
+			return nil, ErrNotFound
+		}
+		var p cookiePayload
+		if err := json.Unmarshal(plaintext, &p); err != nil {
+			return nil, ErrNotFound
+		}
+		if c.now().Unix() >= p.Expires {
+			return nil, ErrNotFound
+		}
+		if p.Values == nil {
+			p.Values = map[string]string{}
+		}
+		return p.Values, nil
+	}
+	return nil, ErrNotFound
+}
+
+// Save seals values into a new token, the old token is not needed.
+func (c *CookieStore) Save(_ string, values map[string]string, ttl time.Duration) (string, error) {
+	plaintext, err := json.Marshal(cookiePayload{Expires: c.now().Add(ttl).Unix(), Values: values})
+	if err != nil {
+		return "", err
+	}
+	key := c.keys[0]
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	payload := key.aead.Seal(nonce, nonce, plaintext, nil)
+	token := base64.RawURLEncoding.EncodeToString(append(payload, sign(key.mac, payload)...))
+	if len(token) > maxCookieToken {
+		return "", fmt.Errorf("%w: %d bytes", ErrTooLarge, len(token))
+	}
+	return token, nil
+}
+
+// Delete does nothing, a cookie session ends when the cookie is expired or
+// its key is retired.
+func (c *CookieStore) Delete(string) error {
+	return nil
+}
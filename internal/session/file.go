@@ -0,0 +1,104 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileStore keeps every session as a JSON file in a directory. Expired
+// files are removed when they are loaded.
+type FileStore struct {
+	dir string
+	now func() time.Time
+}
+
+type fileEntry struct {
+	Expires time.Time         `json:"expires"`
+	Values  map[string]string `json:"values"`
+}
+
+// NewFileStore creates dir if it does not exist.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir, now: time.Now}, nil
+}
+
+func (f *FileStore) path(token string) string {
+	return filepath.Join(f.dir, token+".json")
+}
+
+func (f *FileStore) Load(token string) (map[string]string, error) {
+	if !validID(token) {
+		return nil, ErrNotFound
+	}
+	data, err := os.ReadFile(f.path(token))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entry fileEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+	if !f.now().Before(entry.Expires) {
+		os.Remove(f.path(token))
+		return nil, ErrNotFound
+	}
+	if entry.Values == nil {
+		entry.Values = map[string]string{}
+	}
+	return entry.Values, nil
+}
+
+func (f *FileStore) Save(token string, values map[string]string, ttl time.Duration) (string, error) {
+	if token == "" || !validID(token) {
+		id, err := newID()
+		if err != nil {
+			return "", err
+		}
+		token = id
+	}
+	data, err := json.Marshal(fileEntry{Expires: f.now().Add(ttl), Values: values})
+	if err != nil {
+		return "", err
+	}
+	// Write to a temporary file first so a concurrent Load never sees a
+	// partial session.
+	tmp, err := os.CreateTemp(f.dir, token+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), f.path(token)); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return token, nil
+}
+
+func (f *FileStore) Delete(token string) error {
+	if !validID(token) {
+		return nil
+	}
+	err := os.Remove(f.path(token))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,76 @@
+package session
+
+import (
+	"maps"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often the memory store looks for expired sessions.
+const sweepInterval = time.Minute
+
+// MemoryStore keeps sessions in memory. Expired sessions are not returned
+// and are evicted by a sweep that runs on Save at most once per minute.
+type MemoryStore struct {
+	mu        sync.Mutex
+	sessions  map[string]memoryEntry
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type memoryEntry struct {
+	values  map[string]string
+	expires time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{sessions: map[string]memoryEntry{}, now: time.Now}
+}
+
+func (m *MemoryStore) Load(token string) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.sessions[token]
+	if !ok || !m.now().Before(entry.expires) {
+		return nil, ErrNotFound
+	}
+	return maps.Clone(entry.values), nil
+}
+
+func (m *MemoryStore) Save(token string, values map[string]string, ttl time.Duration) (string, error) {
+	if token == "" {
+		id, err := newID()
+		if err != nil {
+			return "", err
+		}
+		token = id
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	if now.Sub(m.lastSweep) >= sweepInterval {
+		m.lastSweep = now
+		for id, entry := range m.sessions {
+			if !now.Before(entry.expires) {
+				delete(m.sessions, id)
+			}
+		}
+	}
+	m.sessions[token] = memoryEntry{values: maps.Clone(values), expires: now.Add(ttl)}
+	return token, nil
+}
+
+func (m *MemoryStore) Delete(token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, token)
+	return nil
+}
+
+// Len returns the number of sessions held, including expired ones that
+// were not swept yet.
+func (m *MemoryStore) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.sessions)
+}
@@ -0,0 +1,183 @@
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"maps"
+	"time"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/cookie"
+	"github.com/ohrelaxo/httpfromtcp/internal/request"
+	"github.com/ohrelaxo/httpfromtcp/internal/response"
+	"github.com/ohrelaxo/httpfromtcp/internal/server"
+)
+
+// ErrNotFound is returned by a Store for unknown, expired or tampered tokens.
+var ErrNotFound = errors.New("session not found")
+
+// Store keeps session values between requests. The token is what the
+// session cookie carries.
+type Store interface {
+	// Load returns the values saved under token.
+	Load(token string) (map[string]string, error)
+	// Save stores values for ttl and returns the token for the cookie, an
+	// empty token asks for a new one.
+	Save(token string, values map[string]string, ttl time.Duration) (string, error)
+	Delete(token string) error
+}
+
+// Session holds the values of one client. Changes are saved when the
+// response header section is written.
+type Session struct {
+	token    string
+	values   map[string]string
+	modified bool
+	// destroyed removes the session from the store and the client,
+	// regenerate moves the values to a new token.
+	destroyed  bool
+	regenerate bool
+}
+
+// IsNew reports whether the client did not send a valid session cookie.
+func (s *Session) IsNew() bool {
+	return s.token == ""
+}
+
+func (s *Session) Get(key string) (string, bool) {
+	value, ok := s.values[key]
+	return value, ok
+}
+
+func (s *Session) Set(key, value string) {
+	s.values[key] = value
+	s.modified = true
+}
+
+func (s *Session) Delete(key string) {
+	delete(s.values, key)
+	s.modified = true
+}
+
+// Destroy removes all values and expires the session cookie.
+func (s *Session) Destroy() {
+	clear(s.values)
+	s.destroyed = true
+}
+
+// Regenerate moves the session to a new token, which should happen after a
+// login to prevent session fixation.
+func (s *Session) Regenerate() {
+	s.regenerate = true
+	s.modified = true
+}
+
+// Options configures the session cookie.
+type Options struct {
+	// CookieName defaults to "session".
+	CookieName string
+	// TTL defaults to 24 hours.
+	TTL      time.Duration
+	Domain   string
+	Path     string
+	Secure   bool
+	SameSite cookie.SameSite
+}
+
+type contextKey struct{}
+
+// Get returns the session of req, or nil if the Middleware does not run
+// for it.
+func Get(req *request.Request) *Session {
+	s, _ := req.Context().Value(contextKey{}).(*Session)
+	return s
+}
+
+// Middleware loads the session named in the request cookie before the
+// handler runs and saves it right before the header section is written.
+func Middleware(store Store, opts Options) server.Middleware {
+	if opts.CookieName == "" {
+		opts.CookieName = "session"
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = 24 * time.Hour
+	}
+	if opts.Path == "" {
+		opts.Path = "/"
+	}
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			s := &Session{values: map[string]string{}}
+			if token, ok := cookie.FromRequest(req).Get(opts.CookieName); ok {
+				if values, err := store.Load(token); err == nil {
+					s.token, s.values = token, values
+				}
+			}
+			w.BeforeHeaders(func() {
+				if err := save(w, store, opts, s); err != nil {
+					log.Printf("failed to save session: %v\n", err)
+				}
+			})
+			next(w, req.WithContext(context.WithValue(req.Context(), contextKey{}, s)))
+		}
+	}
+}
+
+func save(w *response.Writer, store Store, opts Options, s *Session) error {
+	c := &cookie.Cookie{
+		Name:     opts.CookieName,
+		Domain:   opts.Domain,
+		Path:     opts.Path,
+		Secure:   opts.Secure,
+		HttpOnly: true,
+		SameSite: opts.SameSite,
+	}
+	if s.destroyed {
+		if s.token == "" {
+			return nil
+		}
+		c.MaxAge = -1
+		if err := store.Delete(s.token); err != nil {
+			return err
+		}
+		return cookie.Set(w, c)
+	}
+	if !s.modified {
+		return nil
+	}
+	token := s.token
+	if s.regenerate && token != "" {
+		if err := store.Delete(token); err != nil {
+			return err
+		}
+		token = ""
+	}
+	token, err := store.Save(token, maps.Clone(s.values), opts.TTL)
+	if err != nil {
+		return err
+	}
+	c.Value = token
+	c.MaxAge = int(opts.TTL / time.Second)
+	return cookie.Set(w, c)
+}
+
+// newID returns a random session id for the server side stores.
+func newID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// validID reports whether id has the format of newID, so it is safe to use
+// in a file name.
+func validID(id string) bool {
+	if len(id) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
@@ -0,0 +1,185 @@
+package session
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/request"
+	"github.com/ohrelaxo/httpfromtcp/internal/response"
+	"github.com/ohrelaxo/httpfromtcp/internal/server"
+	"github.com/ohrelaxo/httpfromtcp/internal/servertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var setCookie = regexp.MustCompile(`set-cookie: session=([^;]*);([^\r]*)\r\n`)
+
+// counterHandler counts the requests of a session and handles /logout
+// and /login.
+func counterHandler(w *response.Writer, req *request.Request) {
+	s := Get(req)
+	switch req.RequestLine.RequestTarget {
+	case "/logout":
+		s.Destroy()
+	case "/login":
+		s.Regenerate()
+	default:
+		count, _ := s.Get("count")
+		s.Set("count", count+"+")
+	}
+	value, _ := s.Get("count")
+	w.Write([]byte(value))
+}
+
+// get sends a GET with the session cookie and returns the body and the
+// cookie value and attributes the server set.
+func get(t *testing.T, addr, target, token string) (body, newToken, attrs string) {
+	t.Helper()
+	raw := "GET " + target + " HTTP/1.1\r\nHost: localhost\r\n"
+	if token != "" {
+		raw += "Cookie: theme=dark; session=" + token + "\r\n"
+	}
+	resp := servertest.RoundTrip(t, addr, raw+"\r\n")
+	_, body, _ = strings.Cut(resp, "\r\n\r\n")
+	if m := setCookie.FindStringSubmatch(resp); m != nil {
+		return body, m[1], m[2]
+	}
+	return body, "", ""
+}
+
+func TestMiddleware(t *testing.T) {
+	stores := map[string]Store{"memory": NewMemoryStore()}
+	fileStore, err := NewFileStore(t.TempDir())
+	require.NoError(t, err)
+	stores["file"] = fileStore
+	cookieStore, err := NewCookieStore(bytes.Repeat([]byte("k"), 32))
+	require.NoError(t, err)
+	stores["cookie"] = cookieStore
+
+	for name, store := range stores {
+		s, err := server.Serve(0, counterHandler, server.WithMiddleware(Middleware(store, Options{TTL: time.Hour})))
+		require.NoError(t, err)
+		addr := s.Addr().String()
+
+		// Test: A new session is saved and sent as an HttpOnly cookie
+		body, token, attrs := get(t, addr, "/", "")
+		assert.Equal(t, "+", body, name)
+		require.NotEmpty(t, token, name)
+		assert.Equal(t, " Max-Age=3600; Path=/; HttpOnly", attrs, name)
+
+		// Test: The cookie brings the values back
+		body, token, _ = get(t, addr, "/", token)
+		assert.Equal(t, "++", body, name)
+
+		// Test: Regenerate keeps the values under a new token
+		body, newToken, _ := get(t, addr, "/login", token)
+		assert.Equal(t, "++", body, name)
+		require.NotEmpty(t, newToken, name)
+		assert.NotEqual(t, token, newToken, name)
+		if name != "cookie" {
+			body, _, _ = get(t, addr, "/", token)
+			assert.Equal(t, "+", body, "%s: old token still valid", name)
+		}
+		token = newToken
+
+		// Test: Destroy expires the cookie and removes the values
+		body, expired, attrs := get(t, addr, "/logout", token)
+		assert.Empty(t, body, name)
+		assert.Empty(t, expired, name)
+		assert.Contains(t, attrs, "Max-Age=0", name)
+		if name != "cookie" {
+			body, _, _ = get(t, addr, "/", token)
+			assert.Equal(t, "+", body, name)
+		}
+
+		// Test: A garbage cookie starts a new session
+		body, _, _ = get(t, addr, "/", "../../etc/passwd")
+		assert.Equal(t, "+", body, name)
+		s.Close()
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	now := time.Now()
+	store := NewMemoryStore()
+	store.now = func() time.Time { return now }
+
+	// Test: Values expire after the TTL and are swept on a later Save
+	token, err := store.Save("", map[string]string{"user": "ada"}, time.Minute)
+	require.NoError(t, err)
+	values, err := store.Load(token)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"user": "ada"}, values)
+	now = now.Add(2 * time.Minute)
+	_, err = store.Load(token)
+	require.ErrorIs(t, err, ErrNotFound)
+	assert.Equal(t, 1, store.Len())
+	_, err = store.Save("", map[string]string{}, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, 1, store.Len())
+}
+
+func TestFileStore(t *testing.T) {
+	now := time.Now()
+	store, err := NewFileStore(t.TempDir())
+	require.NoError(t, err)
+	store.now = func() time.Time { return now }
+
+	// Test: Round trip and expiry
+	token, err := store.Save("", map[string]string{"user": "ada"}, time.Minute)
+	require.NoError(t, err)
+	values, err := store.Load(token)
+	require.NoError(t, err)
+	assert.Equal(t, "ada", values["user"])
+	now = now.Add(2 * time.Minute)
+	_, err = store.Load(token)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	// Test: Tokens that are not ids never reach the file system
+	_, err = store.Load("../" + token)
+	require.ErrorIs(t, err, ErrNotFound)
+	token, err = store.Save("../escape", map[string]string{}, time.Minute)
+	require.NoError(t, err)
+	assert.True(t, validID(token))
+}
+
+func TestCookieStore(t *testing.T) {
+	oldKey := bytes.Repeat([]byte("o"), 32)
+	newKey := bytes.Repeat([]byte("n"), 32)
+	store, err := NewCookieStore(oldKey)
+	require.NoError(t, err)
+	token, err := store.Save("", map[string]string{"user": "ada-lovelace-1815"}, time.Hour)
+	require.NoError(t, err)
+	assert.NotContains(t, token, "ada-lovelace-1815")
+
+	// Test: Rotation keeps old cookies valid while the old key is listed
+	rotated, err := NewCookieStore(newKey, oldKey)
+	require.NoError(t, err)
+	values, err := rotated.Load(token)
+	require.NoError(t, err)
+	assert.Equal(t, "ada-lovelace-1815", values["user"])
+	retired, err := NewCookieStore(newKey)
+	require.NoError(t, err)
+	_, err = retired.Load(token)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	// Test: Any change to the token is rejected
+	tampered := []byte(token)
+	tampered[10] ^= 1
+	_, err = store.Load(string(tampered))
+	require.ErrorIs(t, err, ErrNotFound)
+
+	// Test: Expired cookies are rejected
+	store.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	_, err = store.Load(token)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	// Test: Short keys and oversized values
+	_, err = NewCookieStore([]byte("short"))
+	require.Error(t, err)
+	_, err = store.Save("", map[string]string{"big": strings.Repeat("x", 4096)}, time.Hour)
+	require.ErrorIs(t, err, ErrTooLarge)
+}
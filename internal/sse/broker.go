@@ -0,0 +1,149 @@
+package sse
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/server"
+)
+
+// subscriberBuffer is how many events a subscriber may fall behind before
+// it is disconnected. The client then resumes from the replay buffer.
+const subscriberBuffer = 64
+
+// ReplayBuffer keeps recent events so reconnecting clients can resume
+// where they left off.
+type ReplayBuffer interface {
+	Add(e Event)
+	// Since returns the events after the one with id, ok is false if id is
+	// no longer known.
+	Since(id string) (events []Event, ok bool)
+}
+
+// MemoryReplay is a ReplayBuffer holding the last events in memory.
+type MemoryReplay struct {
+	mu     sync.Mutex
+	events []Event
+	size   int
+}
+
+func NewMemoryReplay(size int) *MemoryReplay {
+	return &MemoryReplay{size: size}
+}
+
+func (m *MemoryReplay) Add(e Event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.size <= 0 {
+		return
+	}
+	if len(m.events) == m.size {
+		m.events = append(m.events[:0], m.events[1:]...)
+	}
+	m.events = append(m.events, e)
+}
+
+func (m *MemoryReplay) Since(id string) ([]Event, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := len(m.events) - 1; i >= 0; i-- {
+		if m.events[i].ID == id {
+			return append([]Event(nil), m.events[i+1:]...), true
+		}
+	}
+	return nil, false
+}
+
+// Broker sends every published event to all connected streams.
+type Broker struct {
+	mu          sync.Mutex
+	replay      ReplayBuffer
+	subscribers map[chan Event]struct{}
+	lastID      uint64
+}
+
+// NewBroker creates a broker, replay may be nil to disable resuming.
+func NewBroker(replay ReplayBuffer) *Broker {
+	return &Broker{replay: replay, subscribers: map[chan Event]struct{}{}}
+}
+
+// Publish sends e to all subscribers. Events without an ID get the next
+// number of the broker so clients can resume after them.
+func (b *Broker) Publish(e Event) error {
+	if err := e.validate(); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if e.ID == "" {
+		b.lastID++
+		e.ID = strconv.FormatUint(b.lastID, 10)
+	}
+	if b.replay != nil {
+		b.replay.Add(e)
+	}
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+			// A subscriber that cannot keep up is dropped.
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+	return nil
+}
+
+// subscribe registers a subscriber and returns the events it missed since
+// lastID, atomically so none is lost or sent twice.
+func (b *Broker) subscribe(lastID string) (chan Event, []Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var missed []Event
+	if lastID != "" && b.replay != nil {
+		missed, _ = b.replay.Since(lastID)
+	}
+	ch := make(chan Event, subscriberBuffer)
+	b.subscribers[ch] = struct{}{}
+	return ch, missed
+}
+
+func (b *Broker) unsubscribe(ch chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Len returns the number of connected streams.
+func (b *Broker) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subscribers)
+}
+
+// Handler streams the published events, starting with the ones a
+// reconnecting client missed.
+func (b *Broker) Handler(opts Options) server.Handler {
+	return Handler(opts, func(s *Stream) {
+		ch, missed := b.subscribe(s.LastEventID())
+		defer b.unsubscribe(ch)
+		for _, e := range missed {
+			if s.Send(e) != nil {
+				return
+			}
+		}
+		for {
+			select {
+			case <-s.Context().Done():
+				return
+			case e, ok := <-ch:
+				if !ok || s.Send(e) != nil {
+					return
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,187 @@
+package sse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/request"
+	"github.com/ohrelaxo/httpfromtcp/internal/response"
+	"github.com/ohrelaxo/httpfromtcp/internal/server"
+)
+
+const defaultHeartbeat = 15 * time.Second
+
+var ErrInvalidField = errors.New("invalid event field")
+
+// Event is one message of an event stream. Data may span several lines,
+// ID and Type must not.
+type Event struct {
+	ID   string
+	Type string
+	Data string
+	// Retry tells the client how long to wait before reconnecting.
+	Retry time.Duration
+}
+
+func (e Event) validate() error {
+	if strings.ContainsAny(e.ID, "\r\n\x00") {
+		return fmt.Errorf("%w: id %q", ErrInvalidField, e.ID)
+	}
+	if strings.ContainsAny(e.Type, "\r\n") {
+		return fmt.Errorf("%w: event %q", ErrInvalidField, e.Type)
+	}
+	return nil
+}
+
+// encode formats e in the text/event-stream format, every line of Data
+// becomes its own data field.
+func (e Event) encode() string {
+	var b strings.Builder
+	if e.ID != "" {
+		b.WriteString("id: " + e.ID + "\n")
+	}
+	if e.Type != "" {
+		b.WriteString("event: " + e.Type + "\n")
+	}
+	if e.Retry > 0 {
+		b.WriteString("retry: " + strconv.FormatInt(e.Retry.Milliseconds(), 10) + "\n")
+	}
+	// An event without data is not dispatched, unless it has a type.
+	if e.Data != "" || e.Type != "" {
+		data := strings.ReplaceAll(e.Data, "\r\n", "\n")
+		data = strings.ReplaceAll(data, "\r", "\n")
+		for line := range strings.SplitSeq(data, "\n") {
+			b.WriteString("data: " + line + "\n")
+		}
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// Options configures the streams of a Handler.
+type Options struct {
+	// Heartbeat is the interval of the comments that keep idle connections
+	// open, 15 seconds by default. A negative value disables them.
+	Heartbeat time.Duration
+	// Retry is sent to the client at the start of every stream if set.
+	Retry time.Duration
+}
+
+// Stream writes the events of one response. It is safe for concurrent use.
+type Stream struct {
+	mu     sync.Mutex
+	w      *response.Writer
+	req    *request.Request
+	ctx    context.Context
+	cancel context.CancelFunc
+	err    error
+}
+
+// Send writes e and flushes it to the client.
+func (s *Stream) Send(e Event) error {
+	if err := e.validate(); err != nil {
+		return err
+	}
+	return s.write(e.encode())
+}
+
+// Comment writes a comment line, which clients ignore.
+func (s *Stream) Comment(text string) error {
+	if strings.ContainsAny(text, "\r\n") {
+		return fmt.Errorf("%w: comment %q", ErrInvalidField, text)
+	}
+	return s.write(": " + text + "\n\n")
+}
+
+func (s *Stream) write(data string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if err := s.ctx.Err(); err != nil {
+		s.err = err
+		return err
+	}
+	_, err := s.w.Write([]byte(data))
+	if err == nil {
+		err = s.w.Flush()
+	}
+	if err != nil {
+		s.err = err
+		s.cancel()
+	}
+	return err
+}
+
+// Context is cancelled when the client disconnects or a write fails.
+func (s *Stream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *Stream) Request() *request.Request {
+	return s.req
+}
+
+// LastEventID returns the id of the last event the client received before
+// it reconnected, or "" on the first connection.
+func (s *Stream) LastEventID() string {
+	return strings.TrimSpace(s.req.Headers.Get("Last-Event-ID"))
+}
+
+// Handler starts an event stream and calls serve with it. The response ends
+// when serve returns, serve should return once the stream's context is
+// done.
+func Handler(opts Options, serve func(s *Stream)) server.Handler {
+	if opts.Heartbeat == 0 {
+		opts.Heartbeat = defaultHeartbeat
+	}
+	return func(w *response.Writer, req *request.Request) {
+		ctx, cancel := context.WithCancel(req.Context())
+		defer cancel()
+		s := &Stream{w: w, req: req, ctx: ctx, cancel: cancel}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		if err := w.WriteHeader(response.Ok); err != nil {
+			return
+		}
+		if req.RequestLine.Method == "HEAD" {
+			return
+		}
+		if opts.Retry > 0 {
+			s.write("retry: " + strconv.FormatInt(opts.Retry.Milliseconds(), 10) + "\n\n")
+		} else {
+			// Flushing sends the header section before the first event.
+			s.write("")
+		}
+
+		var wg sync.WaitGroup
+		if opts.Heartbeat > 0 {
+			wg.Go(func() { s.heartbeat(opts.Heartbeat) })
+		}
+		serve(s)
+		cancel()
+		wg.Wait()
+	}
+}
+
+func (s *Stream) heartbeat(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			if s.write(":\n\n") != nil {
+				return
+			}
+		}
+	}
+}
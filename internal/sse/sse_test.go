@@ -0,0 +1,105 @@
+package sse
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/server"
+	"github.com/ohrelaxo/httpfromtcp/internal/servertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func dial(t *testing.T, s *server.Server, fields string) net.Conn {
+	t.Helper()
+	return servertest.Dial(t, s.Addr().String(), "GET /events HTTP/1.1\r\nHost: localhost\r\n"+fields+"\r\n")
+}
+
+func TestEventEncoding(t *testing.T) {
+	// Test: Every field is written, data is split across lines
+	e := Event{ID: "7", Type: "update", Data: "first\nsecond\r\nthird\rfourth", Retry: 1500 * time.Millisecond}
+	assert.Equal(t, "id: 7\nevent: update\nretry: 1500\ndata: first\ndata: second\ndata: third\ndata: fourth\n\n", e.encode())
+
+	// Test: Empty data is still dispatched for typed events
+	assert.Equal(t, "event: ping\ndata: \n\n", Event{Type: "ping"}.encode())
+	assert.Equal(t, "id: 1\n\n", Event{ID: "1"}.encode())
+
+	// Test: Line breaks in single line fields are rejected
+	assert.ErrorIs(t, Event{ID: "1\n2"}.validate(), ErrInvalidField)
+	assert.ErrorIs(t, Event{ID: "1\x00"}.validate(), ErrInvalidField)
+	assert.ErrorIs(t, Event{Type: "a\rb"}.validate(), ErrInvalidField)
+}
+
+func TestHandler(t *testing.T) {
+	done := make(chan error, 1)
+	handler := Handler(Options{Heartbeat: 20 * time.Millisecond, Retry: 3 * time.Second}, func(s *Stream) {
+		s.Send(Event{Data: "hello"})
+		<-s.Context().Done()
+		done <- s.Comment("too late")
+	})
+	s, err := server.Serve(0, handler)
+	require.NoError(t, err)
+	defer s.Close()
+	conn := dial(t, s, "")
+
+	// Test: The stream starts with the headers, retry and the first event
+	resp := servertest.ReadUntil(t, conn, "data: hello\n\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"), resp)
+	assert.Contains(t, resp, "content-type: text/event-stream\r\n")
+	assert.Contains(t, resp, "cache-control: no-cache\r\n")
+	assert.Contains(t, resp, "transfer-encoding: chunked\r\n")
+	assert.Contains(t, resp, "retry: 3000\n\n")
+
+	// Test: Heartbeats keep the idle stream alive
+	servertest.ReadUntil(t, conn, ":\n\n")
+
+	// Test: A disconnect cancels the stream
+	conn.Close()
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("stream was not cancelled")
+	}
+}
+
+func TestBroker(t *testing.T) {
+	b := NewBroker(NewMemoryReplay(2))
+	s, err := server.Serve(0, b.Handler(Options{Heartbeat: -1}))
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: Published events reach every subscriber with an ID
+	first, second := dial(t, s, ""), dial(t, s, "")
+	require.Eventually(t, func() bool { return b.Len() == 2 }, time.Second, time.Millisecond)
+	require.NoError(t, b.Publish(Event{Type: "news", Data: "one"}))
+	for _, conn := range []net.Conn{first, second} {
+		assert.Contains(t, servertest.ReadUntil(t, conn, "data: one\n\n"), "id: 1\nevent: news\ndata: one\n\n")
+	}
+	assert.ErrorIs(t, b.Publish(Event{Type: "bad\n"}), ErrInvalidField)
+
+	// Test: A reconnecting client gets what it missed after Last-Event-ID
+	first.Close()
+	second.Close()
+	require.Eventually(t, func() bool { return b.Len() == 0 }, 2*time.Second, time.Millisecond)
+	b.Publish(Event{Data: "two"})
+	b.Publish(Event{Data: "three"})
+	resumed := dial(t, s, "Last-Event-ID: 2\r\n")
+	resp := servertest.ReadUntil(t, resumed, "data: three\n\n")
+	assert.NotContains(t, resp, "data: two")
+	b.Publish(Event{Data: "four"})
+	assert.Contains(t, servertest.ReadUntil(t, resumed, "data: four\n\n"), "id: 4\n")
+
+	// Test: The replay buffer only keeps the last events
+	replay := NewMemoryReplay(2)
+	for _, id := range []string{"a", "b", "c"} {
+		replay.Add(Event{ID: id})
+	}
+	_, ok := replay.Since("a")
+	assert.False(t, ok)
+	events, ok := replay.Since("b")
+	assert.True(t, ok)
+	assert.Equal(t, []Event{{ID: "c"}}, events)
+}
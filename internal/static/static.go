@@ -0,0 +1,139 @@
+package static
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/request"
+	"github.com/ohrelaxo/httpfromtcp/internal/response"
+	"github.com/ohrelaxo/httpfromtcp/internal/server"
+)
+
+// httpDate is the IMF-fixdate format of Last-Modified.
+const httpDate = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// Options configures a directory handler.
+type Options struct {
+	// StripPrefix is removed from the request path before it is looked up,
+	// usually the pattern the handler is routed on.
+	StripPrefix string
+	// Index is served for requests that name a directory, "index.html" by
+	// default.
+	Index string
+}
+
+// Dir serves the files below dir. Paths that would leave dir, through ".."
+// or symbolic links, are not found.
+func Dir(dir string, opts Options) (server.Handler, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Index == "" {
+		opts.Index = "index.html"
+	}
+	return func(w *response.Writer, req *request.Request) {
+		name := strings.TrimPrefix(targetPath(req.RequestLine.RequestTarget), opts.StripPrefix)
+		name = strings.TrimPrefix(path.Clean("/"+name), "/")
+		if name == "" {
+			name = "."
+		}
+		f, info, err := open(root, name)
+		if err == nil && info.IsDir() {
+			f.Close()
+			f, info, err = open(root, path.Join(name, opts.Index))
+		}
+		if err != nil {
+			notFound(w, err)
+			return
+		}
+		defer f.Close()
+		if !info.Mode().IsRegular() {
+			notFound(w, nil)
+			return
+		}
+		serveContent(w, req, f, info)
+	}, nil
+}
+
+func open(root *os.Root, name string) (*os.File, fs.FileInfo, error) {
+	f, err := root.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, info, nil
+}
+
+// File serves the file at name for every request.
+func File(name string) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		f, err := os.Open(name) // #nosec G304 -- name comes from the configuration
+		if err != nil {
+			notFound(w, err)
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			notFound(w, err)
+			return
+		}
+		serveContent(w, req, f, info)
+	}
+}
+
+// serveContent writes f with its type and length, or 304 when the client's
+// copy is still current.
+func serveContent(w *response.Writer, req *request.Request, f io.Reader, info fs.FileInfo) {
+	modified := info.ModTime().UTC().Truncate(time.Second)
+	if since, err := time.Parse(httpDate, req.Headers.Get("If-Modified-Since")); err == nil && !modified.After(since) {
+		w.Header().Set("Last-Modified", modified.Format(httpDate))
+		w.WriteHeader(response.NotModified)
+		return
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(info.Name()))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	w.Header().Set("Last-Modified", modified.Format(httpDate))
+	w.WriteHeader(response.Ok)
+	if _, err := io.Copy(w, f); err != nil {
+		log.Printf("static: failed to send %s: %v\n", info.Name(), err)
+	}
+}
+
+func notFound(w *response.Writer, err error) {
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("static: %v\n", err)
+	}
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(response.NotFound)
+}
+
+// targetPath returns the decoded path of an origin-form or absolute-form
+// target.
+func targetPath(target string) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		p, _, _ := strings.Cut(target, "?")
+		return p
+	}
+	return u.Path
+}
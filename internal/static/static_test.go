@@ -0,0 +1,74 @@
+package static
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ohrelaxo/httpfromtcp/internal/server"
+	"github.com/ohrelaxo/httpfromtcp/internal/servertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func get(t *testing.T, handler server.Handler, target string, fields ...string) string {
+	t.Helper()
+	return servertest.Send(t, handler, "GET "+target+" HTTP/1.1\r\nHost: localhost\r\n"+strings.Join(fields, "")+"\r\n")
+}
+
+func TestDir(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "index.html"), []byte("<h1>home</h1>"), 0o600))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "docs"), 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "docs", "my notes.txt"), []byte("notes"), 0o600))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "empty"), 0o700))
+	outside := filepath.Join(t.TempDir(), "secret.txt")
+	require.NoError(t, os.WriteFile(outside, []byte("secret"), 0o600))
+	require.NoError(t, os.Symlink(outside, filepath.Join(dir, "link.txt")))
+	handler, err := Dir(dir, Options{StripPrefix: "/files"})
+	require.NoError(t, err)
+
+	// Test: Files are served with their type, length and modification time
+	resp := get(t, handler, "/files/docs/my%20notes.txt?download=1")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"), resp)
+	assert.Contains(t, resp, "content-type: text/plain; charset=utf-8\r\n")
+	assert.Contains(t, resp, "content-length: 5\r\n")
+	assert.Contains(t, resp, "last-modified: ")
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\nnotes"), resp)
+
+	// Test: Directories serve their index
+	assert.True(t, strings.HasSuffix(get(t, handler, "/files/"), "<h1>home</h1>"))
+	assert.True(t, strings.HasPrefix(get(t, handler, "/files/empty/"), "HTTP/1.1 404 Not Found\r\n"))
+
+	// Test: Nothing outside the directory is reachable
+	for _, target := range []string{"/files/../secret.txt", "/files/%2e%2e/secret.txt", "/files/link.txt", "/files/missing"} {
+		resp := get(t, handler, target)
+		assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 404 Not Found\r\n"), target)
+		assert.NotContains(t, resp, "secret")
+	}
+
+	// Test: A current copy of the client gets 304
+	resp = get(t, handler, "/files/index.html", "If-Modified-Since: "+time.Now().UTC().Add(time.Hour).Format(httpDate)+"\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 304 Not Modified\r\n"), resp)
+	assert.NotContains(t, resp, "home")
+
+	// Test: A missing directory is an error
+	_, err = Dir(filepath.Join(dir, "nope"), Options{})
+	assert.Error(t, err)
+}
+
+func TestFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "clip.mp4")
+	require.NoError(t, os.WriteFile(name, []byte("video"), 0o600))
+
+	// Test: Every request gets the file
+	resp := get(t, File(name), "/video/anything")
+	assert.Contains(t, resp, "content-type: video/mp4\r\n")
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\nvideo"), resp)
+
+	// Test: A missing file is not found
+	resp = get(t, File(name+".gone"), "/video")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 404 Not Found\r\n"), resp)
+}